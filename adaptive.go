@@ -0,0 +1,112 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import "time"
+
+const (
+	// outcomeWindow is the number of recent outcomes the error rate of a node is based on.
+	outcomeWindow = 20
+	// outcomeMaxAge is how long an outcome counts for the error rate of a node.
+	outcomeMaxAge = 5 * time.Minute
+)
+
+// outcomes is a sliding window of the most recent outcomes of dials and health checks
+// of a node.
+type outcomes struct {
+	failed [outcomeWindow]bool
+	at     [outcomeWindow]time.Time
+	next   int
+	count  int
+}
+
+func (o *outcomes) add(success bool, now time.Time) {
+	o.failed[o.next], o.at[o.next] = !success, now
+	o.next = (o.next + 1) % outcomeWindow
+	if o.count < outcomeWindow {
+		o.count++
+	}
+}
+
+// errorRate returns the fraction of failures among the outcomes in the window that
+// are not older than outcomeMaxAge at now, 0 if there are none.
+func (o *outcomes) errorRate(now time.Time) float64 {
+	failures, total := 0, 0
+	for i := 0; i < o.count; i++ {
+		if now.Sub(o.at[i]) > outcomeMaxAge {
+			continue
+		}
+		total++
+		if o.failed[i] {
+			failures++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(failures) / float64(total)
+}
+
+// successRatio is the complement of errorRate, 1 if there are no recent outcomes.
+func (o *outcomes) successRatio(now time.Time) float64 {
+	return 1 - o.errorRate(now)
+}
+
+// SetAdaptiveWeighting makes the weight of every node, as seen by the Balancer, shrink
+// with its recent error rate: the effective weight is the configured one times the
+// fraction of the last 20 dials and health checks of the node that succeeded, leaving
+// out those older than 5 minutes (see NodeState.SuccessRatio). The effective weight of
+// a node is published as EffectiveWeight in its expvar map.
+func (d *Driver) SetAdaptiveWeighting(enabled bool) {
+	d.mu.Lock()
+	d.adaptive = enabled
+	d.mu.Unlock()
+}
+
+// SetSlowDialThreshold makes successful dials of a node that take longer than threshold,
+// including the ping of SetPingOnDial, count as soft failures: such a dial still succeeds,
+// but additionally adds a failed outcome for adaptive weighting. So a node that always
+// connects, but slowly, ends up with about half its weight. Slow dials are counted as
+// SlowDials in the expvar map of the node. 0 turns this off, which is the default.
+func (d *Driver) SetSlowDialThreshold(threshold time.Duration) {
+	d.mu.Lock()
+	d.slowDialThreshold = threshold
+	d.mu.Unlock()
+}
+
+// checkSlowDial counts a successful dial of n that took elapsed as a soft failure if it
+// was slow, see SetSlowDialThreshold.
+func (d *Driver) checkSlowDial(n *node, elapsed time.Duration) {
+	d.mu.Lock()
+	slow := d.slowDialThreshold > 0 && elapsed > d.slowDialThreshold
+	if slow {
+		n.recent.add(false, d.now())
+	}
+	d.mu.Unlock()
+	if slow {
+		d.count(n, "SlowDials")
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// NodeState is a snapshot of the routing relevant state of a node, as handed to a Balancer.
+//
+// New fields may be added in later versions, existing ones keep their meaning.
+type NodeState struct {
+	Name      string
+	Weight    float64 // the effective weight, see SetNodeWeight and SetSlowStart
+	Healthy   bool    // false if the most recent attempt to open a connection to the node failed, see also SetFailbackDebounce
+	Capacity  int     // 0 if unknown
+	Tier      int     // see AddNodeWithTier
+	LiveConns int     // connections handed out by Open and not closed yet
+	Role      Role
+
+	// IdleConns is the number of live connections database/sql has returned to its pool
+	// and not used since.
+	IdleConns int
+
+	// Latency is the moving average of the time it took to open a connection to the
+	// node, 0 if none was opened yet.
+	Latency time.Duration
+	// ConsecutiveSuccesses and ConsecutiveFailures count the most recent dials and health
+	// checks of the node that succeeded or failed in a row. At most one of them is non-zero.
+	ConsecutiveSuccesses int
+	ConsecutiveFailures  int
+	// SuccessRatio is the fraction of the last 20 dials and health checks of the node,
+	// within the last 5 minutes, that succeeded; 1 if there were none. It is published
+	// as SuccessRatio in the expvar map of the node, too.
+	SuccessRatio float64
+	// Load is the latest load of the node sampled by the probe set with SetLoadProbe, 0
+	// if none.
+	Load float64
+
+	Labels map[string]string // see SetNodeLabels
+}
+
+// ewma is an exponentially weighted moving average of durations.
+type ewma struct {
+	avg time.Duration
+	set bool
+}
+
+// ewmaWeight is the weight of a new sample in an ewma.
+const ewmaWeight = 0.2
+
+func (e *ewma) add(sample time.Duration) {
+	if !e.set {
+		e.avg, e.set = sample, true
+		return
+	}
+	e.avg = time.Duration(ewmaWeight*float64(sample) + (1-ewmaWeight)*float64(e.avg))
+}
+
+func (e *ewma) value() time.Duration {
+	return e.avg
+}
+
+// Balancer decides in which order the nodes are tried by Open. It gets the state
+// of every registered node, sorted by name, and returns the names of the nodes to
+// try. Nodes left out of the result are not dialed at all, unknown names and
+// duplicates are ignored. ctx is the context of the connection being opened
+// (context.Background() for Open). Weighted, LeastLoaded and ConsistentHash are the
+// built-in ones; anything else can be plugged in with SetBalancer or WithBalancer.
+//
+// Order is called concurrently and must not modify nodes.
+//
+// By default, all nodes returned are dialed in parallel and the first one to answer
+// wins. A Balancer can implement
+//
+//	Fanout() int
+//
+// to limit how many nodes are dialed at the same time, in which case nodes are
+// dialed in order, the next one being started whenever a dial fails.
+type Balancer interface {
+	Order(ctx context.Context, nodes []NodeState) []string
+}
+
+// fanouter is implemented by balancers limiting the number of parallel dials.
+type fanouter interface {
+	Fanout() int
+}
+
+// BalancerFunc adapts an ordinary function to the Balancer interface.
+type BalancerFunc func(ctx context.Context, nodes []NodeState) []string
+
+// Order calls f(ctx, nodes).
+func (f BalancerFunc) Order(ctx context.Context, nodes []NodeState) []string {
+	return f(ctx, nodes)
+}
+
+// Weighted is the default Balancer. It puts healthy nodes before unhealthy ones
+// and orders nodes of equal health by descending weight, then by name.
+type Weighted struct{}
+
+// Order implements Balancer.
+func (Weighted) Order(ctx context.Context, nodes []NodeState) []string {
+	sorted := append([]NodeState(nil), nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Healthy != sorted[j].Healthy {
+			return sorted[i].Healthy
+		}
+		return sorted[i].Weight > sorted[j].Weight
+	})
+	return names(sorted)
+}
+
+// Tiered is a Balancer for failover tiers, e.g. a primary and a disaster recovery data
+// center: Open dials all nodes of the lowest tier (see AddNodeWithTier) in parallel, and
+// only goes on to the next tier once all of them failed. Within a tier, nodes are
+// ordered like Weighted does.
+type Tiered struct{}
+
+// Order implements Balancer.
+func (Tiered) Order(ctx context.Context, nodes []NodeState) []string {
+	sorted := append([]NodeState(nil), nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Tier != sorted[j].Tier {
+			return sorted[i].Tier < sorted[j].Tier
+		}
+		if sorted[i].Healthy != sorted[j].Healthy {
+			return sorted[i].Healthy
+		}
+		return sorted[i].Weight > sorted[j].Weight
+	})
+	return names(sorted)
+}
+
+func (Tiered) tiered() {}
+
+// tierer is implemented by balancers making Open dial nodes tier by tier.
+type tierer interface {
+	tiered()
+}
+
+// LeastLoaded is a Balancer preferring the nodes with the most spare capacity,
+// i.e. the highest ratio of (capacity - live connections) / capacity. Nodes without
+// a known capacity count as having all of it to spare. Unhealthy nodes come last,
+// ties are broken by the number of live connections, then by name.
+type LeastLoaded struct{}
+
+// Order implements Balancer.
+func (LeastLoaded) Order(ctx context.Context, nodes []NodeState) []string {
+	sorted := append([]NodeState(nil), nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Healthy != sorted[j].Healthy {
+			return sorted[i].Healthy
+		}
+		if ri, rj := spare(sorted[i]), spare(sorted[j]); ri != rj {
+			return ri > rj
+		}
+		return sorted[i].LiveConns < sorted[j].LiveConns
+	})
+	return names(sorted)
+}
+
+// spare is the fraction of the capacity of n that is still unused.
+func spare(n NodeState) float64 {
+	if n.Capacity <= 0 {
+		return 1
+	}
+	return float64(n.Capacity-n.LiveConns) / float64(n.Capacity)
+}
+
+// IdleAware is a Balancer preferring the nodes that are least busy, i.e. have the fewest
+// connections in use (live connections not idle in the pool) per unit of weight, counting
+// the one to be opened. Nodes without spare capacity come after the others, unhealthy
+// nodes last. Ties are broken by latency, then by name.
+type IdleAware struct{}
+
+// Order implements Balancer.
+func (IdleAware) Order(ctx context.Context, nodes []NodeState) []string {
+	sorted := append([]NodeState(nil), nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Healthy != sorted[j].Healthy {
+			return sorted[i].Healthy
+		}
+		if fi, fj := spare(sorted[i]) <= 0, spare(sorted[j]) <= 0; fi != fj {
+			return fj
+		}
+		if bi, bj := busy(sorted[i]), busy(sorted[j]); bi != bj {
+			return bi < bj
+		}
+		return sorted[i].Latency < sorted[j].Latency
+	})
+	return names(sorted)
+}
+
+// busy is the number of connections in use at n per unit of weight, counting one more.
+func busy(n NodeState) float64 {
+	if n.Weight <= 0 {
+		return math.Inf(1)
+	}
+	return float64(n.LiveConns-n.IdleConns+1) / n.Weight
+}
+
+func names(nodes []NodeState) []string {
+	list := make([]string, len(nodes))
+	for i, n := range nodes {
+		list[i] = n.Name
+	}
+	return list
+}
+
+// ConsistentHash is a Balancer giving connections with the same routing key (see
+// WithRoutingKey) an affinity to the same node. Node names are placed on a hash ring,
+// Replicas times each (100 if zero); a key is routed to the first node following it
+// on the ring, then to the next ones as fallback. Removing a node only reroutes the
+// keys that went to it. Unhealthy nodes are moved to the end.
+//
+// Nodes are dialed one at a time. Connections without a routing key are ordered
+// like Weighted does.
+type ConsistentHash struct {
+	Replicas int
+}
+
+// Order implements Balancer.
+func (h ConsistentHash) Order(ctx context.Context, nodes []NodeState) []string {
+	key, ok := RoutingKey(ctx)
+	if !ok {
+		return Weighted{}.Order(ctx, nodes)
+	}
+	replicas := h.Replicas
+	if replicas <= 0 {
+		replicas = 100
+	}
+	type point struct {
+		hash uint32
+		node int
+	}
+	ring := make([]point, 0, len(nodes)*replicas)
+	for i, n := range nodes {
+		for r := 0; r < replicas; r++ {
+			ring = append(ring, point{hash32(n.Name + "#" + strconv.Itoa(r)), i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	k := hash32(key)
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= k })
+	seen := make([]bool, len(nodes))
+	sorted := make([]NodeState, 0, len(nodes))
+	for i := 0; i < len(ring) && len(sorted) < len(nodes); i++ {
+		p := ring[(start+i)%len(ring)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			sorted = append(sorted, nodes[p.node])
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Healthy && !sorted[j].Healthy })
+	return names(sorted)
+}
+
+// Fanout makes connections be opened one node at a time, to keep the affinity.
+func (ConsistentHash) Fanout() int {
+	return 1
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,846 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPreviewSelection(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "a", "b", "c", "d")
+	d.SetNodeWeight("b", 5)
+	d.SetNodeWeight("c", 3)
+	d.SetNodeWeight("d", 10)
+	d.setHealthy(d.nodes["d"], false)
+
+	want := []string{"b", "c", "a", "d"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() not stable: %v, want %v", got, want)
+	}
+	for _, dsn := range want {
+		if n := up.dialed(dsn); n != 0 {
+			t.Errorf("PreviewSelection dialed %s", dsn)
+		}
+	}
+
+	d.DelNode("c")
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string {
+		return []string{"d", "x", "a", "d"}
+	}))
+	want = []string{"d", "a"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() with custom balancer = %v, want %v", got, want)
+	}
+}
+
+func TestOpenRecordsHealth(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 50*time.Millisecond)
+	d := newTestDriver(up, "a", "b")
+	d.SetNodeWeight("b", 2)
+	if got, want := d.PreviewSelection(), []string{"b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+	conn, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got, want := d.PreviewSelection(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() after failure of b = %v, want %v", got, want)
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	d.AddNodeWithCapacity("small", "small", 10)
+	d.AddNodeWithCapacity("big", "big", 100)
+	d.AddNodeWithCapacity("medium", "medium", 50)
+	d.SetBalancer(LeastLoaded{})
+	up.node("small", nil, 0)
+
+	// open 5 connections to small (50% used), then let big (60 of 100) and medium (10 of 50) look busy
+	var conns []driver.Conn
+	for i := 0; i < 5; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	d.nodes["big"].live = 60
+	d.nodes["medium"].live = 10
+	d.nodes["big"].healthy = true
+	d.nodes["medium"].healthy = true
+
+	want := []string{"medium", "small", "big"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+
+	// closing the connections to small frees its capacity again
+	for _, c := range conns {
+		c.Close()
+		c.Close()
+	}
+	if live := d.nodes["small"].live; live != 0 {
+		t.Errorf("small has %d live connections after closing all", live)
+	}
+	want = []string{"small", "medium", "big"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+}
+
+func TestIdleAware(t *testing.T) {
+	up := newFakeDriver()
+	for _, dsn := range []string{"a", "b", "c"} {
+		up.node(dsn, nil, 0)
+	}
+	d := newTestDriver(up, "a", "b", "c")
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now } // no latency, ties go by name
+	d.SetBalancer(IdleAware{})
+	open := func(name string) driver.Conn {
+		c, err := d.openConn(context.Background(), func(n *node) bool { return n.Name == name })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// a has 2 connections in use, b 2 in the pool, c 1 in use
+	open("a")
+	open("a")
+	for i := 0; i < 2; i++ {
+		if !open("b").(driver.Validator).IsValid() {
+			t.Fatal("fresh connection is invalid")
+		}
+	}
+	inUse := open("c")
+	want := []string{"b", "c", "a"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+	if idle := d.nodes["b"].idle; idle != 2 {
+		t.Errorf("b has %d idle connections, want 2", idle)
+	}
+
+	// c goes idle, b is used again
+	inUse.(driver.Validator).IsValid()
+	for c := range d.nodes["b"].conns {
+		if _, err := c.ExecContext(context.Background(), "SELECT 1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want = []string{"c", "a", "b"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+
+	// weight and capacity count, health comes first
+	d.SetNodeWeight("b", 3)
+	d.nodes["c"].capacity = 1
+	d.nodes["a"].healthy = false
+	want = []string{"b", "c", "a"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+
+	inUse.Close()
+	if idle := d.nodes["c"].idle; idle != 0 {
+		t.Errorf("c has %d idle connections after Close", idle)
+	}
+}
+
+func TestTiered(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	for _, name := range []string{"dc1-a", "dc1-b"} {
+		d.AddNode(name, name)
+		up.node(name, errFakeUnreachable, 10*time.Millisecond)
+	}
+	for _, name := range []string{"dr-a", "dr-b"} {
+		d.AddNodeWithTier(name, name, 1)
+		up.node(name, nil, 0)
+	}
+	d.AddNodeWithTier("last", "last", 2)
+	up.node("last", nil, 0)
+	d.SetBalancer(Tiered{})
+	dials := func(names ...string) int {
+		n := 0
+		for _, name := range names {
+			n += up.dialed(name)
+		}
+		return n
+	}
+
+	want := []string{"dc1-a", "dc1-b", "dr-a", "dr-b", "last"}
+	if got := d.PreviewSelection(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+	// tier 0 fails, slowly: tier 1 is only contacted after both of its nodes failed
+	var mu sync.Mutex
+	var early []string // nodes of tier 1 dialed before tier 0 failed
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if strings.HasPrefix(dsn, "dr-") {
+				d.mu.Lock()
+				up := d.nodes["dc1-a"].healthy || d.nodes["dc1-b"].healthy
+				d.mu.Unlock()
+				if up {
+					mu.Lock()
+					early = append(early, dsn)
+					mu.Unlock()
+				}
+			}
+			return next(dsn)
+		}
+	})
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(wrapped).base().n.tier; got != 1 {
+		t.Errorf("connection went to tier %d, want 1", got)
+	}
+	c.Close()
+	waitDials(t, d)
+	mu.Lock()
+	if len(early) > 0 {
+		t.Errorf("%v dialed before tier 0 failed", early)
+	}
+	mu.Unlock()
+	if n := dials("dc1-a", "dc1-b"); n != 2 {
+		t.Errorf("tier 0 dialed %d times, want 2", n)
+	}
+	if n := dials("last"); n != 0 {
+		t.Errorf("tier 2 dialed although tier 1 is fine")
+	}
+
+	// a success in tier 0 never touches tier 1
+	up.node("dc1-b", nil, 0)
+	before := dials("dr-a", "dr-b")
+	for i := 0; i < 3; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != "dc1-b" {
+			t.Errorf("connection went to %s, want dc1-b", got)
+		}
+		c.Close()
+	}
+	waitDials(t, d)
+	if n := dials("dr-a", "dr-b"); n != before {
+		t.Errorf("tier 1 dialed %d times while tier 0 is up", n-before)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	up := newFakeDriver()
+	dsns := []string{"a", "b", "c", "d"}
+	for _, dsn := range dsns {
+		up.node(dsn, nil, 0)
+	}
+	d := newTestDriver(up, dsns...)
+	d.SetBalancer(ConsistentHash{})
+	connector, _ := d.OpenConnector("")
+
+	route := func(key string) string {
+		c, err := connector.Connect(WithRoutingKey(context.Background(), key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.(wrapped).base().n.Name
+	}
+
+	keys := make([]string, 200)
+	before := map[string]string{}
+	used := map[string]bool{}
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		before[keys[i]] = route(keys[i])
+		used[before[keys[i]]] = true
+	}
+	if len(used) != len(dsns) {
+		t.Errorf("keys only spread over %d nodes: %v", len(used), used)
+	}
+	for _, key := range keys {
+		if got := route(key); got != before[key] {
+			t.Errorf("%s routed to %s, then to %s", key, before[key], got)
+		}
+	}
+	total := 0
+	for _, dsn := range dsns {
+		total += up.dialed(dsn)
+	}
+	if total != 2*len(keys) {
+		t.Errorf("expected one dial per connection, got %d for %d connections", total, 2*len(keys))
+	}
+
+	// removing a node reroutes its keys, and only those, consistently
+	d.DelNode("b")
+	after := map[string]string{}
+	for _, key := range keys {
+		after[key] = route(key)
+		if before[key] != "b" && after[key] != before[key] {
+			t.Errorf("%s moved from %s to %s after removing b", key, before[key], after[key])
+		}
+		if after[key] == "b" {
+			t.Errorf("%s still routed to removed node", key)
+		}
+		if again := route(key); again != after[key] {
+			t.Errorf("%s rerouted inconsistently to %s and %s", key, after[key], again)
+		}
+	}
+
+	// a failing node falls back to the next one on the ring
+	up.node("c", errFakeUnreachable, 0)
+	for _, key := range keys {
+		if after[key] == "c" {
+			if got := route(key); got == "c" {
+				t.Errorf("%s routed to failing node", key)
+			}
+		}
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := newTestDriver(newFakeDriver(), "a", "b")
+	d.now = func() time.Time { return now }
+	d.SetNodeWeight("a", 10)
+	d.SetNodeWeight("b", 4)
+	d.SetSlowStart(10 * time.Second)
+
+	weights := func() map[string]float64 {
+		w := map[string]float64{}
+		d.mu.Lock()
+		for name, n := range d.nodes {
+			w[name] = d.effectiveWeight(n, now)
+		}
+		d.mu.Unlock()
+		return w
+	}
+	if w := weights(); w["a"] != 10 || w["b"] != 4 {
+		t.Errorf("nodes healthy from the start are ramping up: %v", w)
+	}
+
+	d.setHealthy(d.nodes["a"], false)
+	d.setHealthy(d.nodes["a"], true)
+	for _, step := range []struct {
+		after time.Duration
+		want  float64
+	}{{0, 0}, {time.Second, 1}, {5 * time.Second, 5}, {10 * time.Second, 10}, {time.Minute, 10}} {
+		now = time.Unix(1000, 0).Add(step.after)
+		if w := weights()["a"]; w != step.want {
+			t.Errorf("%s after recovery: weight %g, want %g", step.after, w, step.want)
+		}
+	}
+
+	// while ramping up, a is ordered after b
+	now = time.Unix(1000, 0).Add(2 * time.Second)
+	if got, want := d.PreviewSelection(), []string{"b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+	// staying healthy does not restart the ramp
+	d.setHealthy(d.nodes["a"], true)
+	now = time.Unix(1000, 0).Add(6 * time.Second)
+	if w := weights()["a"]; w != 6 {
+		t.Errorf("ramp restarted by successful dial: weight %g", w)
+	}
+}
+
+func TestWithBalancer(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	only := func(name string) Balancer {
+		return BalancerFunc(func(ctx context.Context, nodes []NodeState) []string { return []string{name} })
+	}
+	d.SetBalancer(only("a"))
+	connector, err := d.OpenConnector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ctx  context.Context
+		want string
+	}{
+		{context.Background(), "a"},
+		{WithBalancer(context.Background(), only("b")), "b"},
+		{WithBalancer(context.Background(), nil), "a"},
+	} {
+		c, err := connector.Connect(test.ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != test.want {
+			t.Errorf("connection went to %s, want %s", got, test.want)
+		}
+		c.Close()
+	}
+	// the context balancer does not replace the default
+	if got, want := d.PreviewSelection(), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+}
+
+func TestSetFanout(t *testing.T) {
+	up := newFakeDriver()
+	dsns := []string{"a", "b", "c", "d", "e"}
+	d := newTestDriver(up, dsns...)
+	for i, dsn := range dsns {
+		up.node(dsn, nil, 0)
+		d.SetNodeWeight(dsn, len(dsns)-i) // a is preferred, then b, ...
+	}
+	d.SetFanout(2)
+
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	waitDials(t, d) // the losing dial included
+	for _, dsn := range dsns {
+		want := 0
+		if dsn == "a" || dsn == "b" {
+			want = 1
+		}
+		if n := up.dialed(dsn); n != want {
+			t.Errorf("%s dialed %d times, want %d", dsn, n, want)
+		}
+	}
+
+	// failures of a and b make c and d be dialed
+	up.node("a", errFakeUnreachable, 0)
+	up.node("b", errFakeUnreachable, 0)
+	c, err = d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(wrapped).base().n.Name; got != "c" && got != "d" {
+		t.Errorf("connection went to %s", got)
+	}
+	c.Close()
+	if n := up.dialed("e"); n != 0 {
+		t.Errorf("e dialed %d times", n)
+	}
+}
+
+func TestWarmFanout(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 150*time.Millisecond)
+	up.node("b", nil, 0)
+	up.node("c", nil, 50*time.Millisecond)
+	d := newTestDriver(up, "a", "b", "c")
+	d.SetNodeWeight("a", 10) // preferred by the Balancer, but slowest
+	d.SetFanout(1)
+	d.SetWarmFanout(true)
+	// a and c answer only once b won, so they are slower whatever the scheduling
+	won := make(chan struct{})
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn != "b" {
+				<-won
+			}
+			return next(dsn)
+		}
+	})
+	open := func() string {
+		t.Helper()
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.(wrapped).base().n.Name
+	}
+	dialed := func(want map[string]int) {
+		t.Helper()
+		waitDials(t, d)
+		for dsn, n := range want {
+			if got := up.dialed(dsn); got != n {
+				t.Errorf("%s dialed %d times, want %d", dsn, got, n)
+			}
+		}
+	}
+
+	// the first Open explores all nodes
+	if got := open(); got != "b" {
+		t.Errorf("first connection went to %s, want the fastest, b", got)
+	}
+	close(won)
+	dialed(map[string]int{"a": 1, "b": 1, "c": 1})
+
+	// then only the fastest node is dialed
+	for i := 0; i < 3; i++ {
+		if got := open(); got != "b" {
+			t.Errorf("connection went to %s, want b", got)
+		}
+	}
+	dialed(map[string]int{"a": 1, "b": 4, "c": 1})
+
+	// unless it fails, in which case the next fastest one is dialed
+	up.node("b", errFakeUnreachable, 0)
+	if got := open(); got != "c" {
+		t.Errorf("connection went to %s with b down, want c", got)
+	}
+	dialed(map[string]int{"a": 1, "b": 5, "c": 2})
+}
+
+func TestAdaptiveWeighting(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.SetNodeWeight("a", 4)
+	d.SetNodeWeight("b", 2)
+	d.SetFanout(1)
+	d.SetAdaptiveWeighting(true)
+	weight := func(name string) string { return d.nodes[name].exp.Get("EffectiveWeight").String() }
+
+	if w := weight("a"); w != "4" {
+		t.Errorf("a: EffectiveWeight = %s without any outcomes, want 4", w)
+	}
+	// 12 of 20 outcomes of a fail, then it recovers
+	for i := 0; i < 8; i++ {
+		d.setHealthy(d.nodes["a"], true)
+	}
+	for i := 0; i < 12; i++ {
+		d.setHealthy(d.nodes["a"], false)
+	}
+	d.setHealthy(d.nodes["a"], true)
+	if w := weight("a"); w != "1.6" {
+		t.Errorf("a: EffectiveWeight = %s, want 1.6", w)
+	}
+	if w := weight("b"); w != "2" {
+		t.Errorf("b: EffectiveWeight = %s, want 2", w)
+	}
+	for i := 0; i < 5; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != "b" {
+			t.Errorf("connection went to %s, traffic did not shift away from a", got)
+		}
+		c.Close()
+	}
+
+	// as a stabilizes, it takes over again
+	for i := 0; i < 20; i++ {
+		d.setHealthy(d.nodes["a"], true)
+	}
+	if got := d.PreviewSelection(); got[0] != "a" {
+		t.Errorf("PreviewSelection() = %v after a recovered", got)
+	}
+	d.SetAdaptiveWeighting(false)
+	for i := 0; i < 20; i++ {
+		d.setHealthy(d.nodes["a"], false)
+	}
+	if w := weight("a"); w != "4" {
+		t.Errorf("a: EffectiveWeight = %s with adaptive weighting off, want 4", w)
+	}
+}
+
+func TestSlowDials(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.SetNodeWeight("a", 3)
+	d.SetNodeWeight("b", 2)
+	d.SetFanout(1)
+	d.SetAdaptiveWeighting(true)
+	d.SetSlowDialThreshold(100 * time.Millisecond)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "a" {
+				now = now.Add(200 * time.Millisecond) // slow, but working
+			} else {
+				now = now.Add(10 * time.Millisecond)
+			}
+			return next(dsn)
+		}
+	})
+
+	share := map[string]int{}
+	for i := 0; i < 10; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		share[c.(wrapped).base().n.Name]++
+		c.Close()
+	}
+	// a has the higher weight, so it takes the first connection, which halves it
+	if share["a"] != 1 || share["b"] != 9 {
+		t.Errorf("connections per node: %v, want 1 to a and 9 to b", share)
+	}
+	if w := d.nodes["a"].exp.Get("EffectiveWeight").String(); w != "1.5" {
+		t.Errorf("a: EffectiveWeight = %s, want 1.5", w)
+	}
+	if w := d.nodes["b"].exp.Get("EffectiveWeight").String(); w != "2" {
+		t.Errorf("b: EffectiveWeight = %s, want 2", w)
+	}
+	if v := d.nodes["a"].exp.Get("SlowDials"); v == nil || v.String() != "1" {
+		t.Errorf("a: SlowDials = %v, want 1", v)
+	}
+	if v := d.nodes["b"].exp.Get("SlowDials"); v != nil {
+		t.Errorf("b: SlowDials = %v, want none", v)
+	}
+	if c := d.nodes["a"].exp.Get("Connections").String(); c != "1" {
+		t.Errorf("a: Connections = %s, slow dials must still succeed", c)
+	}
+}
+
+func TestSuccessRatio(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a")
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	n := d.nodes["a"]
+	ratio := func() float64 {
+		v, err := strconv.ParseFloat(n.exp.Get("SuccessRatio").String(), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if r := ratio(); r != 1 {
+		t.Errorf("SuccessRatio = %v without any outcomes, want 1", r)
+	}
+
+	// old outcomes: all failures, pushed out of the window by count
+	for i := 0; i < 10; i++ {
+		d.setHealthy(n, false)
+	}
+	now = now.Add(time.Minute)
+	// 3 of 4 succeed, 5 times over
+	for i := 0; i < 20; i++ {
+		d.setHealthy(n, i%4 != 0)
+	}
+	if r := ratio(); math.Abs(r-0.75) > 1e-9 {
+		t.Errorf("SuccessRatio = %v, want 0.75", r)
+	}
+	var states []NodeState
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string {
+		states = nodes
+		return nil
+	}))
+	d.PreviewSelection()
+	if len(states) != 1 || math.Abs(states[0].SuccessRatio-0.75) > 1e-9 {
+		t.Errorf("NodeState = %+v, want SuccessRatio 0.75", states)
+	}
+
+	// newer outcomes only count while the older ones decay
+	now = now.Add(4 * time.Minute)
+	for i := 0; i < 4; i++ {
+		d.setHealthy(n, false)
+	}
+	if r := ratio(); math.Abs(r-12.0/20) > 1e-9 {
+		t.Errorf("SuccessRatio = %v, want 0.6", r)
+	}
+	now = now.Add(2 * time.Minute)
+	if r := ratio(); r != 0 {
+		t.Errorf("SuccessRatio = %v once older outcomes decayed, want 0", r)
+	}
+	now = now.Add(10 * time.Minute)
+	if r := ratio(); r != 1 {
+		t.Errorf("SuccessRatio = %v once all outcomes decayed, want 1", r)
+	}
+}
+
+func TestCustomBalancerState(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.AddNodeWithCapacity("c", "c", 10)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	latency := map[string]time.Duration{"a": 10 * time.Millisecond, "b": 30 * time.Millisecond}
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			now = now.Add(latency[dsn])
+			return next(dsn)
+		}
+	})
+	d.SetNodeWeight("a", 3)
+	d.SetNodeRole("b", RoleReplica)
+
+	var seen []NodeState
+	target := "a"
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string {
+		seen = append([]NodeState(nil), nodes...)
+		return []string{target, "unknown", target}
+	}))
+	open := func(name string) driver.Conn {
+		target = name
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != name {
+			t.Errorf("connection went to %s, the balancer chose %s", got, name)
+		}
+		return c
+	}
+	open("a").Close()
+	latency["a"] = 20 * time.Millisecond
+	held := open("a")
+	open("b").Close()
+	target = "c"
+	if _, err := d.Open(""); err == nil {
+		t.Fatal("c is not reachable")
+	}
+	if up.dialed("c") != 1 {
+		t.Errorf("c dialed %d times, duplicates are not ignored", up.dialed("c"))
+	}
+	d.PreviewSelection()
+
+	want := []NodeState{
+		{Name: "a", Weight: 3, Healthy: true, LiveConns: 1, Latency: 12 * time.Millisecond, ConsecutiveSuccesses: 2, SuccessRatio: 1},
+		{Name: "b", Weight: 1, Healthy: true, Role: RoleReplica, Latency: 30 * time.Millisecond, ConsecutiveSuccesses: 1, SuccessRatio: 1},
+		{Name: "c", Weight: 1, Capacity: 10, ConsecutiveFailures: 1},
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("balancer got\n%+v\nwant\n%+v", seen, want)
+	}
+	held.Close()
+}
+
+func TestFailbackDebounce(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := start
+	d := newTestDriver(newFakeDriver(), "primary", "secondary")
+	d.now = func() time.Time { return now }
+	d.SetNodeWeight("primary", 10)
+	d.SetFailbackDebounce(10 * time.Second)
+	primary := d.nodes["primary"]
+	first := func() string { return d.PreviewSelection()[0] }
+
+	if got := first(); got != "primary" {
+		t.Fatalf("%s preferred before any failure", got)
+	}
+	d.setHealthy(primary, false)
+	for _, step := range []struct {
+		at      time.Duration
+		healthy bool
+		want    string
+	}{
+		{1 * time.Second, true, "secondary"},  // recovered, but not for long
+		{5 * time.Second, false, "secondary"}, // flapped
+		{6 * time.Second, true, "secondary"},  // the window starts over
+		{15 * time.Second, true, "secondary"},
+		{16 * time.Second, true, "primary"}, // stable for 10s
+	} {
+		now = start.Add(step.at)
+		d.setHealthy(primary, step.healthy)
+		if got := first(); got != step.want {
+			t.Errorf("after %s: %s preferred, want %s", step.at, got, step.want)
+		}
+	}
+
+	d.setHealthy(primary, false)
+	d.setHealthy(primary, true)
+	d.SetFailbackDebounce(0)
+	if got := first(); got != "primary" {
+		t.Errorf("%s preferred without debouncing", got)
+	}
+}
+
+func TestLocalZone(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	for _, n := range []struct{ name, zone string }{
+		{"a1", "eu-1a"}, {"a2", "eu-1a"}, {"b1", "eu-1b"}, {"c1", "eu-1c"},
+	} {
+		up.node(n.name, nil, 0)
+		d.AddNode(n.name, n.name)
+		if err := d.SetNodeLabels(n.name, map[string]string{ZoneLabel: n.zone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.SetNodeWeight("c1", 5)
+	d.SetLocalZone("eu-1b")
+
+	if got, want := d.PreviewSelection(), []string{"b1", "c1", "a1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+	for i := 0; i < 5; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != "b1" {
+			t.Errorf("connection went to %s, not the local zone", got)
+		}
+		c.Close()
+	}
+	waitDials(t, d)
+	if n := up.dialed("a1") + up.dialed("a2") + up.dialed("c1"); n != 0 {
+		t.Errorf("other zones dialed %d times while the local one was up", n)
+	}
+
+	// cross-zone failover
+	up.node("b1", errFakeUnreachable, 0)
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(wrapped).base().n.Name; got == "b1" {
+		t.Errorf("connection went to failed node %s", got)
+	}
+	c.Close()
+	if got := d.PreviewSelection(); got[0] != "c1" {
+		t.Errorf("PreviewSelection() = %v with the local zone down", got)
+	}
+
+	if err := d.SetNodeLabels("x", nil); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("expected ErrUnknownNode, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// AddCanaryNode registers a node that is kept out of the normal rotation, but gets
+// roughly fraction (between 0 and 1) of the connections opened, e.g. to try out a new
+// server before adding it for real. If opening a canary fails, the connection is
+// opened to the other nodes as usual; failures of canaries are recorded for the canary,
+// but have no effect on the routing between the other nodes. Canaries do not count
+// for State.
+//
+// A canary can be promoted by deleting it and adding it again with AddNode.
+func (d *Driver) AddCanaryNode(name, DSN string, fraction float64) {
+	d.addNode(node{Name: name, DSN: DSN, canary: fraction})
+}
+
+// pickCanary decides whether the next connection goes to a canary, and to which. Only
+// canaries accepted by accept (all if nil) are considered.
+func (d *Driver) pickCanary(accept func(*node) bool) *node {
+	d.mu.Lock()
+	var canaries []*node
+	for _, n := range d.nodes {
+		if n != nil && n.canary > 0 && !n.quarantined && (accept == nil || accept(n)) {
+			canaries = append(canaries, n)
+		}
+	}
+	d.mu.Unlock()
+	if len(canaries) == 0 {
+		return nil
+	}
+	sort.Slice(canaries, func(i, j int) bool { return canaries[i].Name < canaries[j].Name })
+	r, sum := rand.Float64(), 0.0
+	for _, n := range canaries {
+		sum += n.canary
+		if r < sum {
+			return n
+		}
+	}
+	return nil
+}
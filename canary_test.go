@@ -0,0 +1,79 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanaryNode(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("canary", nil, 0)
+	d := newTestDriver(up, "a")
+	d.AddCanaryNode("canary", "canary", 0.1)
+
+	if got, want := d.PreviewSelection(), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+
+	const opens = 2000
+	canary := 0
+	for i := 0; i < opens; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.(wrapped).base().n.Name == "canary" {
+			canary++
+		}
+		c.Close()
+	}
+	// 0.1 of 2000 is 200, with a standard deviation of about 13
+	if canary < 140 || canary > 260 {
+		t.Errorf("canary got %d of %d connections, want about %d", canary, opens, opens/10)
+	}
+
+	// a failing canary neither fails Open nor affects the other nodes
+	up.node("canary", errFakeUnreachable, 0)
+	for i := 0; i < 100; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if d.nodes["canary"].healthy || d.nodes["canary"].exp.Get("Errors") == nil {
+		t.Error("canary failures not recorded")
+	}
+	if !d.nodes["a"].healthy || d.nodes["a"].exp.Get("Errors") != nil {
+		t.Error("canary failures affected a")
+	}
+	if s := d.State(); s != Healthy {
+		t.Errorf("State() = %s with only the canary down", s)
+	}
+}
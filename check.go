@@ -0,0 +1,164 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDialTimeout is returned for a node that did not answer within the given timeout.
+var ErrDialTimeout = errors.New("clustersql: dial timed out")
+
+// NodeConfig describes a node by name and upstream DSN, outside of any Driver.
+type NodeConfig struct {
+	Name string
+	DSN  string
+}
+
+// CheckConnectivity dials every node once, using upstream, and returns the
+// outcome per node name (nil for reachable nodes). Successfully opened connections
+// are pinged (if the upstream connection supports it) and closed again right away.
+//
+// This does not need a Driver or sql.DB and is intended for validating a cluster
+// configuration, e.g. from command line tools or init containers.
+func CheckConnectivity(upstream driver.Driver, nodes []NodeConfig, timeout time.Duration) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := make(map[string]error, len(nodes))
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n NodeConfig) {
+			defer wg.Done()
+			err := probe(context.Background(), upstream.Open, n.DSN, timeout)
+			mu.Lock()
+			result[n.Name] = err
+			mu.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	return result
+}
+
+// probe opens and pings dsn, closing the connection afterwards. It gives up after
+// timeout (if positive) with ErrDialTimeout, or when ctx is done with its error.
+func probe(ctx context.Context, dial func(dsn string) (driver.Conn, error), dsn string, timeout time.Duration) error {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := pingContext(ctx, dial, dsn)
+	if err == context.DeadlineExceeded && parent.Err() == nil {
+		err = ErrDialTimeout
+	}
+	return err
+}
+
+// pingContext opens and pings dsn, closing the connection afterwards, or gives up when
+// ctx is done, with its error. An upstream not honoring ctx is left to finish in the
+// background.
+func pingContext(ctx context.Context, dial func(dsn string) (driver.Conn, error), dsn string) error {
+	conn, err := openContext(ctx, dial, dsn)
+	if err != nil {
+		return err
+	}
+	p, ok := conn.(driver.Pinger)
+	if !ok {
+		conn.Close()
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := p.Ping(ctx)
+		conn.Close()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// openTimeout opens dsn using dial, giving up after timeout (if positive) with
+// ErrDialTimeout, or when ctx is done with its error. A connection that is established
+// afterwards is closed in the background.
+func openTimeout(ctx context.Context, dial func(dsn string) (driver.Conn, error), dsn string, timeout time.Duration) (driver.Conn, error) {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := openContext(ctx, dial, dsn)
+	if err == context.DeadlineExceeded && conn == nil && parent.Err() == nil {
+		err = ErrDialTimeout
+	}
+	return conn, err
+}
+
+// openContext opens dsn using dial, giving up when ctx is done, with its error. A
+// connection that is established afterwards is closed in the background.
+func openContext(ctx context.Context, dial func(dsn string) (driver.Conn, error), dsn string) (driver.Conn, error) {
+	if ctx.Done() == nil {
+		return dial(dsn)
+	}
+	type c struct {
+		conn driver.Conn
+		err  error
+	}
+	done := make(chan c, 1)
+	go func() {
+		conn, err := dial(dsn)
+		done <- c{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// timeoutContext returns a context expiring after timeout, or a plain cancelable
+// one if timeout is not positive.
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
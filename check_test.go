@@ -0,0 +1,64 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckConnectivity(t *testing.T) {
+	up := newFakeDriver()
+	up.node("up1", nil, 0)
+	up.node("up2", nil, 10*time.Millisecond)
+	up.node("slow", nil, time.Second)
+	res := CheckConnectivity(up, []NodeConfig{
+		{"up1", "up1"},
+		{"up2", "up2"},
+		{"slow", "slow"},
+		{"down", "down"},
+	}, 200*time.Millisecond)
+
+	if len(res) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(res))
+	}
+	for _, name := range []string{"up1", "up2"} {
+		if err := res[name]; err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+	if err := res["slow"]; err != ErrDialTimeout {
+		t.Errorf("slow: expected ErrDialTimeout, got %v", err)
+	}
+	if err := res["down"]; err != errFakeUnreachable {
+		t.Errorf("down: expected %v, got %v", errFakeUnreachable, err)
+	}
+	for _, dsn := range []string{"up1", "up2", "slow", "down"} {
+		if n := up.dialed(dsn); n != 1 {
+			t.Errorf("%s dialed %d times, expected once", dsn, n)
+		}
+	}
+}
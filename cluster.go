@@ -85,39 +85,588 @@
 package clustersql
 
 import (
+	"context"
 	"database/sql/driver"
+	"errors"
 	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrNoNodes is returned by Open if there is no node to connect to.
+var ErrNoNodes = errors.New("clustersql: no nodes available")
+
+// ErrNodesAtLimit is returned by Open if all nodes have reached their connection limit, see SetNodeMaxConns.
+var ErrNodesAtLimit = errors.New("clustersql: all nodes are at their connection limit")
+
+// ErrClusterAtLimit is returned (possibly wrapped) by Open if the cluster has reached its connection limit, see
+// SetMaxTotalConns.
+var ErrClusterAtLimit = errors.New("clustersql: cluster is at its connection limit")
+
+// ErrUnknownNode is returned (wrapped, along with the name) by methods given the name of a node that is not registered.
+var ErrUnknownNode = errors.New("clustersql: unknown node")
+
+// ErrNoEligibleNodes is returned by Open if the selection guard excluded all nodes, see SetSelectionGuard.
+var ErrNoEligibleNodes = errors.New("clustersql: no eligible nodes")
+
+// ErrExpvarNameTaken is returned (wrapped, along with the name) by NewNamedDriver if the name is in use in expvar.
+var ErrExpvarNameTaken = errors.New("clustersql: expvar name already in use")
+
+// ErrNestedDriver is returned by NewNamedDriver and Open, and panicked with by NewDriver and NewPrivateDriver, if the
+// upstream driver is a Driver itself, see NewDriver.
+var ErrNestedDriver = errors.New("clustersql: upstream driver is a clustersql Driver")
+
 type Driver struct {
-	nodes          map[string]*node
-	upstreamDriver driver.Driver
-	exp            *expvar.Map
+	mu                   sync.Mutex
+	id                   uint64 // tells Drivers apart in the registries of the upstream driver, see registryKey
+	nodes                map[string]*node
+	upstreamDriver       driver.Driver
+	exp                  *expvar.Map
+	expName              string // see ExpvarName
+	balancer             Balancer
+	tlsRegistrar         TLSRegistrar
+	dialRegistrar        DialRegistrar
+	credentialRewriter   CredentialRewriter
+	credentials          *credentials // of the last RotateCredentials, for nodes added by discovery
+	dial                 func(dsn string) (driver.Conn, error)
+	stopHealth           chan struct{}
+	healthInterval       time.Duration
+	stopDiscovery        chan struct{}
+	stopSnapshots        chan struct{}
+	stopLoad             chan struct{} // see SetLoadProbe
+	loadProbe            LoadProbe
+	discovered           map[string]string // names of the nodes added by discovery, to the DSNs discovered
+	wg                   sync.WaitGroup    // background goroutines, see Close
+	closed               bool              // see Close
+	closing              context.Context   // done once Close is called, for shadow queries
+	stop                 context.CancelFunc
+	split                bool
+	lazy                 bool // see SetLazyConnections
+	isRead               func(query string) bool
+	isNodeError          func(err error) bool
+	isFatal              func(err error) bool
+	isNodeDown           func(err error) bool // see UseMySQLClassifier
+	maxErrorNodes        int
+	failFast             bool // see SetFailFast
+	passiveHealth        bool
+	pingOnDial           bool
+	strict               bool
+	readOnlyTxToReplicas bool
+	readOnlyFallback     bool
+	retry                retryPolicy
+	readRetry            bool
+	fanout               int
+	warmFanout           bool
+	selectWindow         time.Duration // see SetSelectWindow
+	selectScorer         func(node NodeState) float64
+	warmed               bool // whether an Open with warm fanout succeeded, see SetWarmFanout
+	dsnProvider          func(node NodeInfo) (string, error)
+	dialInterval         time.Duration // see SetDialRateLimit
+	nextDial             time.Time
+	selectionGuard       func(node NodeInfo, ctx context.Context) bool
+	connInit             func(ctx context.Context, conn driver.Conn, node NodeInfo) error
+	connLabels           map[string]string // see SetConnectionLabels
+	labelApplier         LabelApplier
+	replicationGate      ReplicationGate
+	isReadOnly           func(rows driver.Rows) (bool, error)
+	maxConnAge           time.Duration
+	queryTimeout         time.Duration
+	slowOpen             time.Duration    // see SetSlowOpenLog
+	loserCloseTimeout    time.Duration    // see closeLoser
+	routeTracer          func(RouteTrace) // see SetRouteTracer
+	logger               Logger
+	dialTimeout          time.Duration
+	nodeDefaults         NodeDefaults // see SetNodeDefaults
+	archive              *expvar.Map  // expvar maps of deleted nodes
+	archived             []string     // keys in archive, oldest first
+	keepStats            bool         // see SetKeepStatsOnReAdd
+	slowStart            time.Duration
+	lastNode             string
+	lastSuccess          time.Time
+	connSeq              uint64
+	shadowReport         func(ShadowDivergence)
+	metrics              MetricsSink
+	primaryResolver      func(ctx context.Context) (string, error)
+	maxTotalConns        int
+	paused               bool
+	pauseReason          string
+	totalConns           int           // connections handed out and Opens in progress
+	freed                chan struct{} // closed when a connection slot of the cluster is freed
+	maxPendingOpens      int
+	pendingOpens         int
+	opened               chan struct{} // closed when a pending Open finishes, see SetMaxPendingOpens
+	localZone            string
+	failbackDebounce     time.Duration
+	adaptive             bool
+	slowDialThreshold    time.Duration
+	now                  func() time.Time
 }
 
 type node struct {
-	Name string
-	DSN  string
-	exp  *expvar.Map
+	Name             string
+	DSN              string
+	exp              *expvar.Map
+	weight           int
+	capacity         int
+	tier             int // see AddNodeWithTier
+	live             int // connections handed out and not yet closed
+	idle             int // of the live connections, those in the pool of database/sql
+	dialing          int // dials in progress
+	maxConns         int
+	healthy          bool
+	canary           float64 // fraction of connections to take, see AddCanaryNode
+	shadow           float64 // fraction of reads to mirror, see SetShadowNode
+	maxConnAge       time.Duration
+	dialTimeout      time.Duration // see AddNodeWithTimeout
+	network          string        // of the DSN before SetNodeDialer replaced it
+	recent           outcomes
+	labels           map[string]string
+	meta             map[string]string // see AddNodeWithMeta
+	latency          ewma              // of successful dials, until the upstream Open returned
+	handshake        ewma              // of successful dials, from the upstream Open returning to the first ping, see SetPingOnDial
+	conns            map[*conn]bool    // connections handed out and not yet closed
+	evicted          bool
+	quarantined      bool // see QuarantineNode
+	quarantineReason string
+	load             float64 // the latest sample of the load probe, see SetLoadProbe
+	loaded           bool
+	upSince          time.Time          // when the node last became healthy after being unhealthy
+	succeeded        time.Time          // when the node was last dialed successfully, or else added
+	errs             []TimestampedError // the most recent ones, oldest first
+	successes        int                // consecutive
+	failures         int                // consecutive
+	role             Role
+}
+
+// inRotation reports whether n takes connections as usual, i.e. is neither a canary nor a shadow.
+func (n *node) inRotation() bool {
+	return n.canary == 0 && n.shadow == 0
 }
 
 // AddNode registers a new DSN as name with the upstream Driver.
 func (d *Driver) AddNode(name, DSN string) {
-	m := new(expvar.Map).Init()
-	n := node{name, DSN, m}
-	d.exp.Set(name, m)
-	d.nodes[name] = &n
+	d.AddNodeWithCapacity(name, DSN, 0)
+}
+
+// AddNodeWithTier is like AddNode, additionally putting the node into a failover tier, see Tiered. Nodes added
+// otherwise are in tier 0.
+func (d *Driver) AddNodeWithTier(name, DSN string, tier int) {
+	d.addNode(node{Name: name, DSN: DSN, tier: tier})
 }
 
+// AddNodeWithCapacity is like AddNode, additionally telling the Balancer how many connections the node can take
+// (e.g. its max_connections). A capacity of 0 means unknown.
+func (d *Driver) AddNodeWithCapacity(name, DSN string, capacity int) {
+	d.addNode(node{Name: name, DSN: DSN, capacity: capacity})
+}
+
+// AddNodeWithTimeout is like AddNode, additionally giving the node a dial timeout of its own, overriding the one
+// set with SetDialTimeout, e.g. for a node in a remote region that legitimately takes longer to connect.
+func (d *Driver) AddNodeWithTimeout(name, DSN string, dialTimeout time.Duration) {
+	d.addNode(node{Name: name, DSN: DSN, dialTimeout: dialTimeout})
+}
+
+// SetDialTimeout makes Open give up on a node that does not open a connection within timeout, counting it as a
+// failure of the node, with ErrDialTimeout. A connection established afterwards is closed in the background. Nodes
+// added with AddNodeWithTimeout use their own timeout instead. 0, the default, means no timeout.
+func (d *Driver) SetDialTimeout(timeout time.Duration) {
+	d.mu.Lock()
+	d.dialTimeout = timeout
+	d.mu.Unlock()
+}
+
+// AddNodeWithMeta is like AddNode, additionally attaching a copy of meta to the node. Metadata is free-form, like
+// the hardware class or who to ask about maintenance, and meant for display and tooling: unlike labels (see
+// SetNodeLabels), it is not handed to the Balancer. It is available from NodeInfo and DumpConfig.
+func (d *Driver) AddNodeWithMeta(name, DSN string, meta map[string]string) {
+	d.addNode(node{Name: name, DSN: DSN, meta: copyStrings(meta)})
+}
+
+// addNode registers n, setting up the defaults.
+func (d *Driver) addNode(n node) {
+	d.mu.Lock()
+	d.nodeDefaults.apply(&n)
+	d.mu.Unlock()
+	n.exp, n.healthy = new(expvar.Map).Init(), true
+	n.exp.Set("EffectiveWeight", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.effectiveWeight(&n, d.now())
+	}))
+	n.exp.Set("SuccessRatio", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return n.recent.successRatio(d.now())
+	}))
+	n.exp.Set("ConnectLatency", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return float64(n.latency.value()) / float64(time.Millisecond)
+	}))
+	n.exp.Set("HandshakeLatency", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return float64(n.handshake.value()) / float64(time.Millisecond)
+	}))
+	n.exp.Set("RecentErrors", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return n.recentErrors()
+	}))
+	d.publishQuarantine(&n)
+	d.publishLoad(&n)
+	// unlike the LastSuccess timestamp, a number to alert on; nodes never dialed count from being added
+	n.exp.Set("SecondsSinceLastSuccess", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.now().Sub(n.succeeded).Seconds()
+	}))
+	d.mu.Lock()
+	var archived *expvar.Map
+	if old, ok := d.nodes[n.Name]; ok && old == nil && d.keepStats {
+		archived = d.unarchive(n.Name)
+	}
+	d.mu.Unlock()
+	if archived != nil {
+		restoreVars(n.exp, archived)
+	}
+	d.exp.Set(n.Name, n.exp)
+	d.mu.Lock()
+	n.succeeded = d.now()
+	d.nodes[n.Name] = &n
+	l, dup := d.logger, d.sameAddrNode(&n)
+	d.mu.Unlock()
+	if dup != "" {
+		l.Print(fmt.Sprintf("clustersql: node %s points to the same address as node %s", n.Name, dup))
+	}
+}
+
+// sameAddrNode returns the name of another registered node pointing to the same host:port
+// as n, if any, which is most likely a mistake: the server counts twice. The caller must
+// hold d.mu.
+func (d *Driver) sameAddrNode(n *node) string {
+	for name, other := range d.nodes {
+		if other != nil && other != n && sameAddr(other.DSN, n.DSN) {
+			return name
+		}
+	}
+	return ""
+}
+
+// SetKeepStatsOnReAdd makes adding a node under the name of a deleted one (see DelNode) carry over the counters,
+// last errors and timestamps of the deleted node from the "_archived" map, like the node was never deleted. The
+// health of the node, its breaker state so to speak, and the gauges describing it (like ConsecutiveFailures)
+// start fresh either way, so a node deleted for maintenance is eligible right away when it is added again.
+func (d *Driver) SetKeepStatsOnReAdd(enabled bool) {
+	d.mu.Lock()
+	d.keepStats = enabled
+	d.mu.Unlock()
+}
+
+// unarchive removes the most recently archived expvar map of the node called name from the archive and returns it,
+// nil if there is none. d.mu must be held.
+func (d *Driver) unarchive(name string) *expvar.Map {
+	for i := len(d.archived) - 1; i >= 0; i-- {
+		key := d.archived[i]
+		if key[:strings.LastIndexByte(key, '@')] != name {
+			continue
+		}
+		m, _ := d.archive.Get(key).(*expvar.Map)
+		d.archive.Delete(key)
+		d.archived = append(d.archived[:i], d.archived[i+1:]...)
+		return m
+	}
+	return nil
+}
+
+// restoreVars copies the variables of archived to m, except for gauges and computed ones.
+func restoreVars(m, archived *expvar.Map) {
+	archived.Do(func(kv expvar.KeyValue) {
+		if _, computed := kv.Value.(expvar.Func); !computed && !gauges[kv.Key] {
+			m.Set(kv.Key, kv.Value)
+		}
+	})
+}
+
+// gauges are expvar values that describe the current state rather than count events, and survive ResetStats.
+var gauges = map[string]bool{
+	"ActiveConnections":      true,
+	"ActiveConnectionsTotal": true,
+	"ConsecutiveSuccesses":   true,
+	"ConsecutiveFailures":    true,
+	"FirstInstanciated":      true,
+}
+
+// ResetStats zeroes the counters and clears the last errors (including RecentErrors) and timestamps published in expvar, for the driver
+// and each registered node. Nodes, their health and the gauges describing current state (like ActiveConnections)
+// are left alone, as are the archived maps of deleted nodes.
+func (d *Driver) ResetStats() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resetVars(d.exp, d.archive)
+	for _, n := range d.nodes {
+		if n != nil {
+			n.errs = nil
+		}
+	}
+}
+
+func resetVars(m *expvar.Map, skip *expvar.Map) {
+	m.Do(func(kv expvar.KeyValue) {
+		if gauges[kv.Key] {
+			return
+		}
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			v.Set(0)
+		case *expvar.Float:
+			v.Set(0)
+		case *expvar.String:
+			v.Set("")
+		case *expvar.Map:
+			if v != skip {
+				resetVars(v, skip)
+			}
+		}
+	})
+}
+
+// maxArchived is the number of deleted nodes whose expvar maps are kept.
+const maxArchived = 32
+
 // DelNode unregisters a named Node from the upstream Driver. This SHOULD(TM) be non-invasive, allowing all pending SQL actions on that node to complete as expected
+//
+// The expvar map of the node is moved to the "_archived" map, keyed by name@time of deletion. Only the most recent
+// deletions are kept there.
 func (d *Driver) DelNode(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
 	d.nodes[name] = nil
+	if n == nil {
+		return
+	}
+	d.exp.Delete(name)
+	if d.archive == nil {
+		d.archive = new(expvar.Map).Init()
+		d.exp.Set("_archived", d.archive)
+	}
+	key := name + "@" + d.now().Format(time.RFC3339Nano)
+	d.archive.Set(key, n.exp)
+	d.archived = append(d.archived, key)
+	if len(d.archived) > maxArchived {
+		d.archive.Delete(d.archived[0])
+		d.archived = d.archived[1:]
+	}
+}
+
+// EvictNode removes a named Node like DelNode, and additionally closes all connections to it right away, without
+// waiting for them to be returned to the pool. Statements running on them, and any later use, fail; database/sql
+// then discards them.
+func (d *Driver) EvictNode(name string) error {
+	d.mu.Lock()
+	n := d.nodes[name]
+	if n == nil {
+		d.mu.Unlock()
+		return unknownNode(name)
+	}
+	n.evicted = true
+	conns := make([]*conn, 0, len(n.conns))
+	for c := range n.conns {
+		conns = append(conns, c)
+	}
+	d.mu.Unlock()
+	d.DelNode(name)
+	for _, c := range conns {
+		c.closeUpstream()
+	}
+	d.count(n, "Evicted")
+	return nil
+}
+
+// SetNodeWeight sets the weight of a named Node, as seen by the Balancer. Nodes start out with a weight of 1, see also SetNodeDefaults.
+func (d *Driver) SetNodeWeight(name string, weight int) {
+	d.mu.Lock()
+	if n := d.nodes[name]; n != nil {
+		n.weight = weight
+	}
+	d.mu.Unlock()
+}
+
+// SetSlowStart makes nodes that become healthy again after being unhealthy ramp up their weight, as seen by the
+// Balancer, linearly from 0 to the configured weight over d, instead of taking their full share of new connections
+// right away. 0 turns slow start off.
+func (d *Driver) SetSlowStart(window time.Duration) {
+	d.mu.Lock()
+	d.slowStart = window
+	d.mu.Unlock()
+}
+
+// SetFailbackDebounce makes nodes that become healthy again after being unhealthy count as unhealthy for the
+// Balancer until they stayed healthy for window, so that traffic does not bounce back and forth with a flapping
+// node. They are still tried if no other node can be opened. 0 turns this off.
+func (d *Driver) SetFailbackDebounce(window time.Duration) {
+	d.mu.Lock()
+	d.failbackDebounce = window
+	d.mu.Unlock()
+}
+
+// settling reports whether n recovered less than the failback debounce window before now. d.mu must be held.
+func (d *Driver) settling(n *node, now time.Time) bool {
+	return d.failbackDebounce > 0 && !n.upSince.IsZero() && now.Sub(n.upSince) < d.failbackDebounce
+}
+
+// effectiveWeight returns the weight of n at time now. d.mu must be held.
+func (d *Driver) effectiveWeight(n *node, now time.Time) float64 {
+	w := float64(n.weight) * d.loadFactor(n)
+	if d.adaptive {
+		w *= n.recent.successRatio(now)
+	}
+	if d.slowStart > 0 && n.healthy && !n.upSince.IsZero() {
+		if up := now.Sub(n.upSince); up < d.slowStart {
+			w *= float64(up) / float64(d.slowStart)
+		}
+	}
+	return w
+}
+
+// SetFanout limits Open to dialing the first k nodes in the order of the Balancer in parallel. Whenever one of
+// them fails, the next node is dialed. The first connection to be established wins, as usual. 0, the default,
+// dials all nodes at once. A Balancer limiting the fanout itself (see Balancer) can only lower it further.
+func (d *Driver) SetFanout(k int) {
+	d.mu.Lock()
+	d.fanout = k
+	d.mu.Unlock()
+}
+
+// SetWarmFanout turns warm fanout on or off. With it, Open explores until it first succeeds, dialing all nodes at
+// once (regardless of SetFanout) to learn their latencies quickly. After that, it exploits what it learned: healthy
+// nodes are dialed one at a time, fastest first, the next one only if a dial fails. Nodes that have never been
+// dialed successfully come last. Turning it on again starts a new exploration.
+func (d *Driver) SetWarmFanout(enabled bool) {
+	d.mu.Lock()
+	d.warmFanout, d.warmed = enabled, false
+	d.mu.Unlock()
+}
+
+// SetSelectWindow makes Open wait up to window after the first connection is established for the other nodes being
+// dialed in parallel to answer as well, and go with the best of them by the score set with SetSelectScorer, closing
+// the others. This trades a little latency for better placement: the node answering first isn't necessarily the
+// one best suited. No further nodes are dialed within the window. Connections closed this way are counted as
+// OutScored in the expvar map of their node. 0, the default, goes with the first connection.
+func (d *Driver) SetSelectWindow(window time.Duration) {
+	d.mu.Lock()
+	d.selectWindow = window
+	d.mu.Unlock()
+}
+
+// SetSelectScorer sets how connections are scored within the window of SetSelectWindow; the one to the node with the
+// highest score wins, the first one to be established among equals. score is given the state of the node including
+// the connection in question. nil restores the default, which scores nodes by their spare capacity (see
+// LeastLoaded).
+func (d *Driver) SetSelectScorer(score func(node NodeState) float64) {
+	d.mu.Lock()
+	d.selectScorer = score
+	d.mu.Unlock()
+}
+
+// pick returns the index of the node with the highest score among nodes, see SetSelectScorer.
+func (d *Driver) pick(nodes []*node) int {
+	d.mu.Lock()
+	score := d.selectScorer
+	if score == nil {
+		score = spare
+	}
+	now := d.now()
+	states := make([]NodeState, len(nodes))
+	for i, n := range nodes {
+		states[i] = d.state(n, now)
+	}
+	d.mu.Unlock()
+	best, bestScore := 0, math.Inf(-1)
+	for i, state := range states {
+		if s := score(state); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return best
+}
+
+// unsettle gives back the connection slot of n kept by settle for conn, which was not picked, and closes it.
+func (d *Driver) unsettle(n *node, conn driver.Conn) {
+	d.mu.Lock()
+	n.live--
+	n.exp.Add("ActiveConnections", -1)
+	d.exp.Add("ActiveConnectionsTotal", -1)
+	d.metrics.SetGauge("ActiveConnections", float64(n.live), n.metricLabels())
+	d.mu.Unlock()
+	d.count(n, "OutScored")
+	d.closeLoser(n, conn)
+}
+
+// defaultLoserCloseTimeout is how long closeLoser waits for a connection to close.
+const defaultLoserCloseTimeout = 5 * time.Second
+
+// closeLoser closes conn to n, which lost the race of Open, in the background, so that Open does not wait for it.
+// Errors are counted as CloseErrors in the expvar map of the node. If Close does not return within 5 seconds, it is
+// counted as CloseTimeouts and abandoned: the goroutine calling it is left to the upstream driver, nothing else waits
+// for it.
+func (d *Driver) closeLoser(n *node, conn driver.Conn) {
+	d.mu.Lock()
+	timeout := d.loserCloseTimeout
+	d.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Close()
+	}()
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case err := <-done:
+			if err != nil {
+				d.count(n, "CloseErrors")
+			}
+		case <-timer.C:
+			d.count(n, "CloseTimeouts")
+		}
+	}()
+}
+
+// byLatency sorts nodes by the latency of their dials, healthy nodes first, and those with unknown latency last
+// among them. d.mu must be held.
+func byLatency(nodes []*node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if a.latency.set != b.latency.set {
+			return a.latency.set
+		}
+		return a.latency.value() < b.latency.value()
+	})
+}
+
+// SetBalancer replaces the Balancer deciding the order in which nodes are tried. The default is Weighted.
+func (d *Driver) SetBalancer(b Balancer) {
+	d.mu.Lock()
+	d.balancer = b
+	d.mu.Unlock()
 }
 
 // Nodes returns a sorted list of the names of the registered Nodes.
 func (d *Driver) Nodes() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	var list []string
 	for name := range d.nodes {
 		list = append(list, name)
@@ -126,59 +675,969 @@ func (d *Driver) Nodes() []string {
 	return list
 }
 
+// LastSuccessfulNode returns the name of the node the most recent connection was opened to, and when. It returns
+// "" if no connection has been opened yet.
+func (d *Driver) LastSuccessfulNode() (string, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastNode, d.lastSuccess
+}
+
+// PreviewSelection returns the names of the nodes, in the order the Balancer would try them on the next Open.
+// Canary and shadow nodes are left out. Nothing is dialed.
+func (d *Driver) PreviewSelection() []string {
+	var names []string
+	nodes, _, _ := d.selection(context.Background(), func(n *node) bool { return n.inRotation() }, nil)
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+// selection asks the balancer (the one from ctx, if any) for the order in which to try
+// the nodes. If accept is not nil, only the nodes it accepts are considered. The first
+// local nodes are the healthy ones in the local zone. If trace is not nil, the candidates and the nodes left out
+// are recorded in it.
+func (d *Driver) selection(ctx context.Context, accept func(*node) bool, trace *RouteTrace) (nodes []*node, b Balancer, locals int) {
+	d.mu.Lock()
+	b = d.balancer
+	if cb, ok := ctx.Value(balancerCtx).(Balancer); ok && cb != nil {
+		b = cb
+	}
+	now, zone := d.now(), d.localZone
+	byName := make(map[string]*node, len(d.nodes))
+	local := map[*node]bool{}
+	_, read := ctx.Value(readIntentCtx).(bool)
+	requested, _ := ctx.Value(readPreferenceCtx).(string)
+	rank := map[*node]int{}
+	states := make([]NodeState, 0, len(d.nodes))
+	for name, n := range d.nodes {
+		if n == nil {
+			continue
+		}
+		if n.quarantined {
+			trace.exclude(name, RouteQuarantined, n.quarantineReason)
+			continue
+		}
+		if accept != nil && !accept(n) {
+			trace.exclude(name, RouteIneligible, "")
+			continue
+		}
+		byName[name] = n
+		state := d.state(n, now)
+		local[n] = zone != "" && state.Healthy && n.labels[ZoneLabel] == zone
+		if read {
+			rank[n] = n.readRank(requested)
+			if !state.Healthy {
+				rank[n] += readRanks // after all healthy nodes
+			}
+		}
+		states = append(states, state)
+	}
+	d.mu.Unlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	if trace != nil {
+		trace.Candidates = states
+	}
+
+	for _, name := range b.Order(ctx, states) {
+		if n, ok := byName[name]; ok {
+			nodes = append(nodes, n)
+			delete(byName, name)
+		}
+	}
+	if trace != nil && len(byName) > 0 {
+		d.mu.Lock()
+		for name, n := range byName {
+			trace.exclude(name, RouteLeftOut, d.posture(n, now))
+		}
+		d.mu.Unlock()
+	}
+	// reads go by read preference, see ReadPreferenceLabel
+	sort.SliceStable(nodes, func(i, j int) bool { return rank[nodes[i]] < rank[nodes[j]] })
+	// healthy nodes in the local zone go first, see SetLocalZone
+	sort.SliceStable(nodes, func(i, j int) bool { return local[nodes[i]] && !local[nodes[j]] })
+	for locals < len(nodes) && local[nodes[locals]] {
+		locals++
+	}
+	return nodes, b, locals
+}
+
+// state returns the NodeState of n at now. d.mu must be held.
+func (d *Driver) state(n *node, now time.Time) NodeState {
+	return NodeState{
+		Name:                 n.Name,
+		Weight:               d.effectiveWeight(n, now),
+		Healthy:              n.healthy && !d.settling(n, now),
+		Capacity:             n.capacity,
+		Tier:                 n.tier,
+		LiveConns:            n.live,
+		IdleConns:            n.idle,
+		Role:                 n.role,
+		Latency:              n.latency.value(),
+		ConsecutiveSuccesses: n.successes,
+		ConsecutiveFailures:  n.failures,
+		SuccessRatio:         n.recent.successRatio(now),
+		Load:                 n.load,
+		Labels:               n.copyLabels(),
+	}
+}
+
 // Open will be called by sql.Open once registered. The name argument is ignored (it is only there to satisfy the driver interface)
-func (d Driver) Open(name string) (driver.Conn, error) {
-	type c struct {
-		conn driver.Conn
-		err  error
-		n    *node
-	}
-	die := make(chan bool)
-	cc := make(chan c)
-	for _, n := range d.nodes {
-		go func(n *node, cc chan c, die chan bool) {
-			conn, err := d.upstreamDriver.Open(n.DSN)
-			select {
-			case cc <- c{conn, err, n}:
-				//log.Println("selected", node.Name)
-			case <-die:
-				if conn != nil {
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	return d.connect(context.Background())
+}
+
+// OpenAll opens a connection to every registered node at once, like WithForcedNode does for a single one, e.g. for
+// tooling verifying replication by writing to each node directly. It returns the connections by node name, and all
+// of them are the caller's to close. The errors of the nodes that could not be opened are joined, as *NodeError,
+// into the error returned along with the connections to the others.
+func (d *Driver) OpenAll(ctx context.Context) (map[string]driver.Conn, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	conns := map[string]driver.Conn{}
+	var errs []error
+	for _, n := range d.registered() {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			c, err := d.connect(WithForcedNode(ctx, name))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, &NodeError{Node: name, Err: err})
+				return
+			}
+			conns[name] = c
+		}(n.Name)
+	}
+	wg.Wait()
+	sort.Slice(errs, func(i, j int) bool { return errs[i].(*NodeError).Node < errs[j].(*NodeError).Node })
+	return conns, errors.Join(errs...)
+}
+
+// OpenConnector is called by sql.Open (instead of Open) since Go 1.10. The name argument is ignored. The
+// returned Connector passes the context of each new connection on to the Balancer.
+func (d *Driver) OpenConnector(name string) (driver.Connector, error) {
+	return connector{d}, nil
+}
+
+type connector struct {
+	d *Driver
+}
+
+func (c connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.d.connect(ctx)
+}
+
+func (c connector) Driver() driver.Driver {
+	return c.d
+}
+
+func (d *Driver) connect(ctx context.Context) (driver.Conn, error) {
+	if err := d.checkPaused(); err != nil {
+		return nil, err
+	}
+	if name, ok := ctx.Value(forcedNodeCtx).(string); ok {
+		d.mu.Lock()
+		forced := d.nodes[name]
+		d.mu.Unlock()
+		if forced == nil {
+			return nil, unknownNode(name)
+		}
+		return d.openConn(ctx, func(n *node) bool { return n == forced })
+	}
+	d.mu.Lock()
+	split, lazy := d.split, d.lazy
+	d.mu.Unlock()
+	if split {
+		return &splitConn{d: d}, nil
+	}
+	if lazy {
+		return &lazyConn{d: d}, nil
+	}
+	return d.openConn(ctx, nil)
+}
+
+// openConn opens a connection to one of the nodes accepted by accept (all if nil). Canary nodes are only tried for
+// their share of connections, see AddCanaryNode, unless the node is forced with WithForcedNode.
+func (d *Driver) openConn(ctx context.Context, accept func(*node) bool) (driver.Conn, error) {
+	start := d.now()
+	ctx, traced := d.traceOpen(ctx)
+	defer traced()
+	if err := d.acquireTotal(ctx); err != nil {
+		return nil, err
+	}
+	if err := d.enterOpen(ctx); err != nil {
+		d.mu.Lock()
+		d.releaseTotal()
+		d.mu.Unlock()
+		return nil, err
+	}
+	defer d.leaveOpen()
+	_, forced := ctx.Value(forcedNodeCtx).(string)
+	if canary := d.pickCanary(accept); canary != nil && !forced {
+		ignored := 0
+		c, err := d.openOnce(ctx, func(n *node) bool { return n == canary }, &ignored)
+		if err == nil {
+			d.recordAcquire(d.now().Sub(start))
+			return c, nil
+		}
+	}
+	main := accept
+	c, err := d.openRetry(ctx, func(n *node) bool { return (forced || n.inRotation()) && (main == nil || main(n)) })
+	if err != nil {
+		d.mu.Lock()
+		d.releaseTotal()
+		d.mu.Unlock()
+		return nil, err
+	}
+	d.recordAcquire(d.now().Sub(start))
+	return c, nil
+}
+
+// acquireBuckets are the upper bounds of the buckets of the AcquireLatency histogram.
+var acquireBuckets = []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+
+// recordAcquire publishes that opening a connection took elapsed, from the start of Open to having a connection,
+// in the AcquireLatency map: as moving average in milliseconds (EWMAMillis) and in a histogram.
+func (d *Driver) recordAcquire(elapsed time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.exp.Get("AcquireLatency").(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		d.exp.Set("AcquireLatency", m)
+	}
+	bucket := ">=" + acquireBuckets[len(acquireBuckets)-1].String()
+	for _, b := range acquireBuckets {
+		if elapsed < b {
+			bucket = "<" + b.String()
+			break
+		}
+	}
+	m.Add(bucket, 1)
+	d.metrics.ObserveLatency("AcquireLatency", elapsed, nil)
+
+	ms := float64(elapsed) / float64(time.Millisecond)
+	avg, ok := m.Get("EWMAMillis").(*expvar.Float)
+	if !ok {
+		avg = new(expvar.Float)
+		m.Set("EWMAMillis", avg)
+	}
+	if prev := avg.Value(); prev != 0 {
+		ms = ewmaWeight*ms + (1-ewmaWeight)*prev
+	}
+	avg.Set(ms)
+}
+
+// openOnce makes one attempt at opening a connection to one of the nodes accepted by accept (all if nil). failed
+// is the number of nodes that failed during earlier attempts of the same Open, and is increased by the failures
+// of this one.
+func (d *Driver) openOnce(ctx context.Context, accept func(*node) bool, failed *int) (driver.Conn, error) {
+	d.mu.Lock()
+	tracer, composed := d.routeTracer, d.maxErrorNodes > 0
+	d.mu.Unlock()
+	var trace *RouteTrace
+	if tracer != nil || composed {
+		// also for the nodes skipped, see OpenError
+		trace = &RouteTrace{}
+	}
+	nodes, b, locals := d.selection(ctx, accept, trace)
+	if len(nodes) == 0 {
+		traceRoute(tracer, trace, b, nil, 0)
+		return nil, ErrNoNodes
+	}
+	nodes, locals = d.guard(ctx, nodes, locals, trace)
+	if len(nodes) == 0 {
+		traceRoute(tracer, trace, b, nil, 0)
+		return nil, ErrNoEligibleNodes
+	}
+	d.mu.Lock()
+	fanout, window, failFast := d.fanout, d.selectWindow, d.failFast
+	warm, explore := d.warmFanout, d.warmFanout && !d.warmed
+	if warm && !explore {
+		// local nodes stay first, see SetLocalZone
+		byLatency(nodes[:locals])
+		byLatency(nodes[locals:])
+	}
+	d.mu.Unlock()
+	switch {
+	case explore:
+		fanout = len(nodes)
+	case warm:
+		fanout = 1
+	default:
+		if fanout <= 0 || fanout > len(nodes) {
+			fanout = len(nodes)
+		}
+		if f, ok := b.(fanouter); ok && f.Fanout() > 0 && f.Fanout() < fanout {
+			fanout = f.Fanout()
+		}
+		if locals > 0 && locals < fanout {
+			// only go to other zones if the local ones fail
+			fanout = locals
+		}
+	}
+	traceRoute(tracer, trace, b, nodes, fanout)
+	reserve := func(n *node) bool {
+		if !d.reserve(n) {
+			trace.exclude(n.Name, RouteAtLimit, "")
+			return false
+		}
+		return true
+	}
+	if max := maxAttempts(ctx); max > 0 {
+		// dial no more nodes than may still fail, see WithMaxAttempts
+		started, reserveSlot := *failed, reserve
+		reserve = func(n *node) bool {
+			if started >= max || !reserveSlot(n) {
+				return false
+			}
+			started++
+			return true
+		}
+	}
+	var errs []error // of the nodes that failed, see OpenError
+	s := dialStrategy{
+		fanout:   fanout,
+		failFast: failFast,
+		reserve:  reserve,
+		dial: func(ctx context.Context, n *node) (driver.Conn, error) {
+			traced := startDial(ctx, d, n.Name)
+			conn, err := d.dialNode(ctx, n)
+			if err == nil {
+				if err = d.initConn(ctx, n, conn); err != nil {
 					conn.Close()
+					conn = nil
 				}
 			}
-		}(n, cc, die)
-	}
-	var n c
-	for i := 0; i < len(d.nodes); i++ {
-		Time := new(expvar.String)
-		n = <-cc
-		Time.Set(time.Now().String())
-		if n.err == nil {
-			n.n.exp.Add("Connections", 1)
-			n.n.exp.Set("LastSuccess", Time)
-			close(die)
-			break
-		} else {
-			Err := new(expvar.String)
-			Err.Set(n.err.Error())
-			n.n.exp.Add("Errors", 1)
-			n.n.exp.Set("LastError", Time)
-			n.n.exp.Set("LastErrorMessage", Err)
-			//log.Println(n.n.Name, n.err)
-			if n.conn != nil {
-				n.conn.Close()
+			traced(err)
+			return conn, err
+		},
+		result: func(n *node, conn driver.Conn, err error) (driver.Conn, error, bool) {
+			conn, err, final := d.dialed(ctx, n, conn, err, failed)
+			if !final {
+				errs = append(errs, &NodeError{Node: n.Name, Err: err})
+			}
+			return conn, err, final
+		},
+		discard: func(n *node, conn driver.Conn) {
+			d.settle(n, false)
+			if conn != nil {
+				d.closeLoser(n, conn)
 			}
+		},
+		window:  window,
+		pick:    d.pick,
+		release: d.unsettle,
+	}
+	var conn driver.Conn
+	var n *node
+	var err error
+	if _, ok := b.(tierer); ok {
+		conn, n, err = dialTiers(ctx, nodes, s)
+	} else {
+		conn, n, err = dial(ctx, nodes, s)
+	}
+	if err != nil {
+		if n == nil && len(errs) > 0 && ctx.Err() == nil {
+			err = d.openError(err, errs, trace)
+		}
+		return nil, err
+	}
+	d.mu.Lock()
+	d.lastNode, d.lastSuccess = n.Name, n.succeeded // not known before, see SetSelectWindow
+	if explore {
+		d.warmed = true
+	}
+	d.mu.Unlock()
+	return d.wrap(conn, n), nil
+}
+
+// dialed takes stock of the outcome of dialing n for openOnce, see dialStrategy.result.
+func (d *Driver) dialed(ctx context.Context, n *node, conn driver.Conn, err error, failed *int) (driver.Conn, error, bool) {
+	if err == ErrDialRateLimited {
+		// not the node's fault
+		d.settle(n, false)
+		return nil, err, false
+	}
+	if d.fatal(err) {
+		// other nodes would fail the same way, and it's not this one's fault
+		d.settle(n, false)
+		d.recordError(n, err)
+		d.count(n, "FatalErrors")
+		return nil, err, true
+	}
+	if err == nil {
+		err := d.checkReplication(ctx, n, conn)
+		if err == nil {
+			err = d.checkWritable(ctx, n, conn)
+		}
+		if err != nil {
+			// the node is fine, but can't serve this connection
+			d.settle(n, false)
+			d.setHealthy(n, true)
+			conn.Close()
+			if err != ErrReplicationBehind && err != ErrNodeReadOnly {
+				d.recordError(n, err)
+				*failed++
+			}
+			return nil, err, false
+		}
+	}
+	d.settle(n, err == nil)
+	d.setHealthy(n, err == nil)
+	if err != nil {
+		d.recordError(n, err)
+		*failed++
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err, false
+	}
+	Time := new(expvar.String)
+	Time.Set(time.Now().String())
+	d.count(n, "Connections")
+	n.exp.Set("LastSuccess", Time)
+	d.count(nil, successAfter(*failed))
+	d.mu.Lock()
+	n.succeeded = d.now()
+	d.mu.Unlock()
+	return conn, nil, true
+}
+
+// successAfter returns the expvar counter for an Open succeeding after failed nodes failed to open.
+func successAfter(failed int) string {
+	switch failed {
+	case 0:
+		return "SuccessAfter_0Failures"
+	case 1:
+		return "SuccessAfter_1Failures"
+	}
+	return "SuccessAfter_2+Failures"
+}
+
+// reserve takes one of the connection slots of n, for a dial. It returns false,
+// counting the rejection, if n is at its connection limit.
+func (d *Driver) reserve(n *node) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n.maxConns > 0 && n.live+n.dialing >= n.maxConns {
+		n.exp.Add("Rejected", 1)
+		d.exp.Add("RejectedTotal", 1)
+		d.metrics.IncCounter("Rejected", n.metricLabels())
+		return false
+	}
+	n.dialing++
+	return true
+}
+
+// settle ends a dial to n started with reserve. If it succeeded, the connection
+// keeps the slot and is counted in the ActiveConnections gauge of the node and
+// ActiveConnectionsTotal of the cluster, until it is closed.
+func (d *Driver) settle(n *node, success bool) {
+	d.mu.Lock()
+	n.dialing--
+	if success {
+		n.live++
+		n.exp.Add("ActiveConnections", 1)
+		d.exp.Add("ActiveConnectionsTotal", 1)
+		d.metrics.SetGauge("ActiveConnections", float64(n.live), n.metricLabels())
+	}
+	d.mu.Unlock()
+}
+
+// SetNodeMaxConns limits the number of connections to a named Node, including those being dialed. A node at its
+// limit is skipped by Open, which is counted as Rejected in its expvar map and as RejectedTotal for the cluster.
+// 0 means no limit.
+func (d *Driver) SetNodeMaxConns(name string, max int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	n.maxConns = max
+	return nil
+}
+
+// SetMaxTotalConns limits the number of connections to all nodes together, including those being opened, to
+// protect shared infrastructure. Unlike sql.DB.SetMaxOpenConns, it holds across all sql.DBs using the Driver. When
+// the cluster is at its limit, Open waits for a connection to be closed as long as the context of the connection
+// allows, and fails with an error wrapping ErrClusterAtLimit and the context's error once it is done. Without a
+// context that can be done, as with Open, ErrClusterAtLimit is returned right away. Either is counted as
+// ClusterAtLimit in the expvar map of the driver. 0, the default, means no limit.
+func (d *Driver) SetMaxTotalConns(max int) {
+	d.mu.Lock()
+	d.maxTotalConns = max
+	d.connFreed()
+	d.mu.Unlock()
+}
+
+// acquireTotal takes one of the connection slots of the cluster, waiting for one as described for SetMaxTotalConns.
+// It must be given back with releaseTotal.
+func (d *Driver) acquireTotal(ctx context.Context) error {
+	d.mu.Lock()
+	for d.maxTotalConns > 0 && d.totalConns >= d.maxTotalConns {
+		if ctx.Done() == nil {
+			d.mu.Unlock()
+			d.count(nil, "ClusterAtLimit")
+			return ErrClusterAtLimit
+		}
+		if d.freed == nil {
+			d.freed = make(chan struct{})
+		}
+		freed := d.freed
+		d.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			d.count(nil, "ClusterAtLimit")
+			return fmt.Errorf("%w: %w", ErrClusterAtLimit, ctx.Err())
+		}
+		d.mu.Lock()
+	}
+	d.totalConns++
+	d.mu.Unlock()
+	return nil
+}
+
+// releaseTotal gives back a connection slot of the cluster. d.mu must be held.
+func (d *Driver) releaseTotal() {
+	d.totalConns--
+	d.connFreed()
+}
+
+// connFreed wakes up the Opens waiting in acquireTotal. d.mu must be held.
+func (d *Driver) connFreed() {
+	if d.freed != nil {
+		close(d.freed)
+		d.freed = nil
+	}
+}
+
+// SetMaxConnAge makes connections report themselves invalid (see driver.Validator) once they are older than age,
+// so that database/sql discards them when they are returned to the pool and dials a replacement. Connections in use
+// are not interrupted. 0, the default, lets connections live forever.
+func (d *Driver) SetMaxConnAge(age time.Duration) {
+	d.mu.Lock()
+	d.maxConnAge = age
+	d.mu.Unlock()
+}
+
+// SetNodeMaxConnAge is like SetMaxConnAge for a single named Node, overriding the setting of the driver. This
+// allows gradually moving connections off a node, e.g. before restarting it. 0 falls back to the setting of the
+// driver.
+func (d *Driver) SetNodeMaxConnAge(name string, age time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	n.maxConnAge = age
+	return nil
+}
+
+// SetDialMiddleware wraps every attempt to open a connection to a node. The
+// middleware gets the function that would otherwise be called with the node's DSN
+// and returns the function to call instead. Middlewares compose: each one wraps
+// everything set before, so the last one set runs first. This is e.g. useful for
+// instrumentation or to inject faults in tests.
+func (d *Driver) SetDialMiddleware(m func(next func(dsn string) (driver.Conn, error)) func(dsn string) (driver.Conn, error)) {
+	d.mu.Lock()
+	d.dial = m(d.dial)
+	d.mu.Unlock()
+}
+
+// SetPingOnDial makes every new connection to a node be pinged before it is used, if the upstream driver supports
+// that. A failing ping counts as a failure to open the node. As many upstream drivers connect lazily or return from
+// Open before authentication is done, this splits the dial latency of a node into the time until the upstream Open
+// returned, published as ConnectLatency in its expvar map, and the time from then until the ping succeeded,
+// published as HandshakeLatency. Both are moving averages in milliseconds. Pinging is off by default, which leaves
+// HandshakeLatency at 0.
+func (d *Driver) SetPingOnDial(enabled bool) {
+	d.mu.Lock()
+	d.pingOnDial = enabled
+	d.mu.Unlock()
+}
+
+// NodeInfo describes a node to a DSN provider, see SetDSNProvider.
+type NodeInfo struct {
+	Name   string
+	DSN    string // as registered with AddNode
+	Role   Role
+	Labels map[string]string // see SetNodeLabels
+	Meta   map[string]string // see AddNodeWithMeta
+}
+
+// SetDSNProvider makes every connection to a node, including those of health checks, be opened with the DSN
+// returned by provider instead of the registered one. This allows e.g. injecting short-lived credentials like
+// IAM auth tokens. An error returned by provider counts as a failure to open the node. nil turns it off.
+func (d *Driver) SetDSNProvider(provider func(node NodeInfo) (string, error)) {
+	d.mu.Lock()
+	d.dsnProvider = provider
+	d.mu.Unlock()
+}
+
+// SetSelectionGuard makes Open consult guard before dialing a node. If it returns false, the node is not used for
+// the connection being opened with ctx; if that leaves no node, Open fails with ErrNoEligibleNodes. Together with
+// values in the context, this allows e.g. enforcing data residency rules based on node labels. nil turns it off.
+func (d *Driver) SetSelectionGuard(guard func(node NodeInfo, ctx context.Context) bool) {
+	d.mu.Lock()
+	d.selectionGuard = guard
+	d.mu.Unlock()
+}
+
+// guard removes the nodes the selection guard rejects for ctx from nodes, keeping the order. locals is the number
+// of local nodes at the start of nodes, see selection; the number of those left is returned with the nodes. If
+// trace is not nil, the nodes rejected are recorded in it.
+func (d *Driver) guard(ctx context.Context, nodes []*node, locals int, trace *RouteTrace) ([]*node, int) {
+	d.mu.Lock()
+	guard := d.selectionGuard
+	if guard == nil {
+		d.mu.Unlock()
+		return nodes, locals
+	}
+	infos := make([]NodeInfo, len(nodes))
+	for i, n := range nodes {
+		infos[i] = n.info()
+	}
+	d.mu.Unlock()
+	eligible, eligibleLocals := nodes[:0:0], 0
+	for i, n := range nodes {
+		if guard(infos[i], ctx) {
+			eligible = append(eligible, n)
+			if i < locals {
+				eligibleLocals++
+			}
+		} else {
+			trace.exclude(n.Name, RouteGuarded, "")
 		}
 	}
-	return n.conn, n.err
+	return eligible, eligibleLocals
 }
 
-// NewDriver returns an initialized Cluster driver, using upstreamDriver as backend
-func NewDriver(upstreamDriver driver.Driver) Driver {
-	m := expvar.NewMap("ClusterSql")
+// info describes n to callbacks. d.mu must be held.
+func (n *node) info() NodeInfo {
+	return NodeInfo{Name: n.Name, DSN: n.DSN, Role: n.role, Labels: n.copyLabels(), Meta: copyStrings(n.meta)}
+}
+
+// SetConnInit makes init run on every newly opened upstream connection before it is handed out, e.g. to set
+// session variables like the time zone or sql_mode, which may differ between nodes. If init fails, the connection
+// is closed and counts as a failure to open the node, so the next node is tried. nil turns it off.
+func (d *Driver) SetConnInit(init func(ctx context.Context, conn driver.Conn, node NodeInfo) error) {
+	d.mu.Lock()
+	d.connInit = init
+	d.mu.Unlock()
+}
+
+// initConn applies the connection labels and runs the function set with SetConnInit, if any, on conn, a new
+// connection to n.
+func (d *Driver) initConn(ctx context.Context, n *node, conn driver.Conn) error {
+	if err := d.applyLabels(ctx, conn); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	init, info := d.connInit, n.info()
+	d.mu.Unlock()
+	if init == nil {
+		return nil
+	}
+	if err := init(ctx, conn, info); err != nil {
+		return fmt.Errorf("clustersql: conn init: %w", err)
+	}
+	return nil
+}
+
+// dialNode opens a new upstream connection to n, subject to the dial rate limit, and pings it if configured so by
+// SetPingOnDial.
+func (d *Driver) dialNode(ctx context.Context, n *node) (driver.Conn, error) {
+	if err := d.waitDial(ctx); err != nil {
+		return nil, err
+	}
+	dsn, dial, err := d.target(n)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	timeout := d.dialTimeout
+	if n.dialTimeout > 0 {
+		timeout = n.dialTimeout
+	}
+	d.mu.Unlock()
+	start := d.now()
+	conn, err := openTimeout(ctx, dial, dsn, timeout)
+	if err != nil {
+		return nil, err
+	}
+	opened := d.now()
+	d.mu.Lock()
+	n.latency.add(opened.Sub(start))
+	ping := d.pingOnDial
+	d.mu.Unlock()
+	if p, ok := conn.(driver.Pinger); ok && ping {
+		if err := p.Ping(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		d.mu.Lock()
+		n.handshake.add(d.now().Sub(opened))
+		d.mu.Unlock()
+	}
+	d.checkSlowDial(n, d.now().Sub(start))
+	return conn, nil
+}
+
+// queryNode runs query on a connection of its own to n, bypassing the accounting of Open, and hands the rows to
+// read. Everything is closed afterwards.
+func (d *Driver) queryNode(ctx context.Context, n *node, query string, args []driver.NamedValue, read func(rows driver.Rows) error) error {
+	conn, err := d.dialNode(ctx, n)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return queryConn(ctx, conn, query, args, read)
+}
+
+// queryConn runs query on conn, falling back to a prepared statement if conn does not implement querying directly,
+// and hands the rows to read. The rows and statement are closed afterwards, conn is not.
+func queryConn(ctx context.Context, conn driver.Conn, query string, args []driver.NamedValue, read func(rows driver.Rows) error) error {
+	rows, err := queryContext(ctx, conn, query, args)
+	if err == driver.ErrSkip {
+		stmt, perr := conn.Prepare(query)
+		if perr != nil {
+			return perr
+		}
+		defer stmt.Close()
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			rows, err = stmt.Query(values)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return read(rows)
+}
+
+// target returns the DSN to dial n with, and the function to dial it.
+func (d *Driver) target(n *node) (string, func(dsn string) (driver.Conn, error), error) {
+	d.mu.Lock()
+	info := n.info()
+	dial, provider := d.dial, d.dsnProvider
+	d.mu.Unlock()
+	if provider == nil {
+		return info.DSN, dial, nil
+	}
+	dsn, err := provider(info)
+	if err != nil {
+		return "", nil, fmt.Errorf("clustersql: DSN provider: %w", err)
+	}
+	return dsn, dial, nil
+}
+
+func unknownNode(name string) error {
+	return fmt.Errorf("%w %q", ErrUnknownNode, name)
+}
+
+// maxRecentErrors is the number of errors kept per node, see TimestampedError.
+const maxRecentErrors = 10
+
+// TimestampedError is an error that happened on a node, and when. The most recent ones of every node are kept
+// and published as RecentErrors in its expvar map, oldest first; see also NodeStats.
+type TimestampedError struct {
+	Time    time.Time
+	Message string
+}
+
+// recordError publishes err as the latest error of n.
+func (d *Driver) recordError(n *node, err error) {
+	Time := new(expvar.String)
+	Time.Set(time.Now().String())
+	Err := new(expvar.String)
+	Err.Set(err.Error())
+	d.count(n, "Errors")
+	n.exp.Set("LastError", Time)
+	n.exp.Set("LastErrorMessage", Err)
+	d.mu.Lock()
+	n.errs = append(n.errs, TimestampedError{d.now(), err.Error()})
+	if len(n.errs) > maxRecentErrors {
+		n.errs = n.errs[len(n.errs)-maxRecentErrors:]
+	}
+	d.mu.Unlock()
+}
+
+// recentErrors returns a copy of the errors kept for n. d.mu must be held.
+func (n *node) recentErrors() []TimestampedError {
+	return append([]TimestampedError(nil), n.errs...)
+}
+
+// setHealthy records the outcome of an interaction with n: a dial, a health check or
+// (with passive health checking) the clean close of a connection.
+func (d *Driver) setHealthy(n *node, healthy bool) {
+	d.mu.Lock()
+	up := healthy && !n.quarantined // until ClearQuarantine
+	if up && !n.healthy {
+		n.upSince = d.now()
+	}
+	changed := up != n.healthy
+	n.healthy = up
+	n.recent.add(healthy, d.now())
+	if healthy {
+		n.successes++
+		n.failures = 0
+	} else {
+		n.failures++
+		n.successes = 0
+	}
+	successes, failures := new(expvar.Int), new(expvar.Int)
+	successes.Set(int64(n.successes))
+	failures.Set(int64(n.failures))
+	sink := d.metrics
+	d.mu.Unlock()
+	n.exp.Set("ConsecutiveSuccesses", successes)
+	n.exp.Set("ConsecutiveFailures", failures)
+	sink.SetGauge("ConsecutiveSuccesses", float64(successes.Value()), n.metricLabels())
+	sink.SetGauge("ConsecutiveFailures", float64(failures.Value()), n.metricLabels())
+	if changed {
+		sink.SetGauge("OpenBreakers", float64(d.summarizeHealth().Unhealthy), nil)
+	}
+}
+
+// NewDriver returns an initialized Cluster driver, using upstreamDriver as backend. Its variables are published in
+// expvar as "ClusterSql" or, if that name is taken already, as "ClusterSql_2", "ClusterSql_3" and so on; see
+// ExpvarName.
+//
+// upstreamDriver must not be a Driver itself, or NewDriver panics with ErrNestedDriver, like sql.Register does on
+// misuse: every node of the outer Driver would dial all nodes of the inner one on each Open, multiplying the
+// fan-out. Register all nodes with one Driver instead, structured by tiers (see AddNodeWithTier) or zones (see
+// SetLocalZone). Use NewNamedDriver or Open to get an error instead of the panic.
+func NewDriver(upstreamDriver driver.Driver) *Driver {
+	mustNotNest(upstreamDriver)
+	for i := 1; ; i++ {
+		name := "ClusterSql"
+		if i > 1 {
+			name += "_" + strconv.Itoa(i)
+		}
+		if d, err := NewNamedDriver(upstreamDriver, name); err == nil {
+			return d
+		}
+	}
+}
+
+// NewNamedDriver is like NewDriver, publishing the variables of the driver in expvar as name. If name is taken, an
+// error wrapping ErrExpvarNameTaken is returned. A nested Driver is returned as ErrNestedDriver, rather than panicked.
+func NewNamedDriver(upstreamDriver driver.Driver, name string) (*Driver, error) {
+	if err := checkNesting(upstreamDriver); err != nil {
+		return nil, err
+	}
+	m, err := publishMap(name)
+	if err != nil {
+		return nil, err
+	}
+	d := newDriver(upstreamDriver, m)
+	d.expName = name
+	return d, nil
+}
+
+// publishMu serializes checking for and publishing expvar names.
+var publishMu sync.Mutex
+
+// publishMap publishes a new map in expvar as name, unless the name is taken.
+func publishMap(name string) (m *expvar.Map, err error) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	taken := fmt.Errorf("%w: %q", ErrExpvarNameTaken, name)
+	if expvar.Get(name) != nil {
+		return nil, taken
+	}
+	defer func() {
+		// someone else published name in the meantime
+		if recover() != nil {
+			m, err = nil, taken
+		}
+	}()
+	return expvar.NewMap(name), nil
+}
+
+// ExpvarName returns the name the variables of d are published as in expvar, or "" if they are not (see
+// NewPrivateDriver).
+func (d *Driver) ExpvarName() string {
+	return d.expName
+}
+
+// Upstream returns the driver d opens connections with, as passed to NewDriver, e.g. for its package-specific
+// registration functions.
+func (d *Driver) Upstream() driver.Driver {
+	return d.upstreamDriver
+}
+
+// NewPrivateDriver is like NewDriver, but does not publish anything in the global expvar namespace (where a name
+// can only be used once per process), e.g. for tests or running several clusters. The variables are available from
+// ExpvarHandler instead.
+func NewPrivateDriver(upstreamDriver driver.Driver) *Driver {
+	mustNotNest(upstreamDriver)
+	return newDriver(upstreamDriver, new(expvar.Map).Init())
+}
+
+// checkNesting returns ErrNestedDriver if upstreamDriver is a Driver, see NewDriver.
+func checkNesting(upstreamDriver driver.Driver) error {
+	if _, ok := upstreamDriver.(*Driver); ok {
+		return ErrNestedDriver
+	}
+	return nil
+}
+
+// mustNotNest panics if upstreamDriver is a Driver, see NewDriver.
+func mustNotNest(upstreamDriver driver.Driver) {
+	if err := checkNesting(upstreamDriver); err != nil {
+		panic(err)
+	}
+}
+
+// ExpvarHandler returns an http.Handler serving the expvar variables of d as JSON, like they appear under
+// "ClusterSql" in /debug/vars for drivers created with NewDriver.
+func (d *Driver) ExpvarHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, d.exp.String())
+	})
+}
+
+// driverIDs counts the Drivers created, see registryKey.
+var driverIDs uint64
+
+// registryKey returns the key the config of the named node is registered under with the
+// upstream driver, e.g. by SetNodeTLS. Upstream registries are global to the process, so
+// the key is unique to d as well as to the node.
+func (d *Driver) registryKey(name string) string {
+	return "clustersql-" + strconv.FormatUint(d.id, 10) + "-" + name
+}
+
+func newDriver(upstreamDriver driver.Driver, m *expvar.Map) *Driver {
+	d := &Driver{
+		id:                atomic.AddUint64(&driverIDs, 1),
+		nodes:             map[string]*node{},
+		upstreamDriver:    upstreamDriver,
+		exp:               m,
+		balancer:          Weighted{},
+		dial:              upstreamDriver.Open,
+		isRead:            IsReadQuery,
+		isNodeError:       IsNodeError,
+		isFatal:           IsFatalError,
+		logger:            defaultLogger,
+		loserCloseTimeout: defaultLoserCloseTimeout,
+		metrics:           NopMetrics{},
+		now:               time.Now,
+	}
+	d.closing, d.stop = context.WithCancel(context.Background())
 	Time := new(expvar.String)
 	Time.Set(time.Now().String())
 	m.Set("FirstInstanciated", Time)
-	cl := Driver{map[string]*node{}, upstreamDriver, m}
-	return cl
+	m.Set("HealthSummary", expvar.Func(func() interface{} { return d.summarizeHealth() }))
+	m.Set("OpenBreakers", expvar.Func(func() interface{} { return d.summarizeHealth().Unhealthy }))
+	return d
 }
@@ -0,0 +1,1177 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialMiddleware(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	// b is slow, so the (injected) failure of a is always seen before b wins
+	up.node("b", nil, 20*time.Millisecond)
+	d := newTestDriver(up, "a", "b")
+
+	errInjected := errors.New("injected")
+	var mu sync.Mutex
+	var calls []string
+	d.SetDialMiddleware(func(next func(dsn string) (driver.Conn, error)) func(dsn string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "a" {
+				return nil, errInjected
+			}
+			return next(dsn)
+		}
+	})
+	d.SetDialMiddleware(func(next func(dsn string) (driver.Conn, error)) func(dsn string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			mu.Lock()
+			calls = append(calls, dsn)
+			mu.Unlock()
+			return next(dsn)
+		}
+	})
+
+	for i := 0; i < 3; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != "b" {
+			t.Errorf("expected failover to b, got %s", got)
+		}
+		c.Close()
+	}
+	if n := up.dialed("a"); n != 0 {
+		t.Errorf("upstream was dialed %d times for a despite injected failure", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 6 {
+		t.Errorf("expected outer middleware to see 6 attempts, got %v", calls)
+	}
+	if msg := d.nodes["a"].exp.Get("LastErrorMessage").String(); !strings.Contains(msg, "injected") {
+		t.Errorf("injected failure not recorded for a: %s", msg)
+	}
+}
+
+func TestNodeMaxConnsRejected(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.SetNodeMaxConns("a", 1)
+	// b answers the first Open only once a won it
+	won := make(chan struct{})
+	var once sync.Once
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "b" {
+				once.Do(func() { <-won })
+			}
+			return next(dsn)
+		}
+	})
+
+	first, err := d.Open("")
+	close(won)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := first.(wrapped).base().n.Name; got != "a" {
+		t.Fatalf("first connection went to %s", got)
+	}
+	second, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := second.(wrapped).base().n.Name; got != "b" {
+		t.Errorf("second connection went to %s, a is at its limit", got)
+	}
+	a := d.nodes["a"]
+	if v := a.exp.Get("Rejected"); v == nil || v.String() != "1" {
+		t.Errorf("a: Rejected = %v, want 1", v)
+	}
+	if v := d.exp.Get("RejectedTotal"); v == nil || v.String() != "1" {
+		t.Errorf("RejectedTotal = %v, want 1", v)
+	}
+	if v := a.exp.Get("Errors"); v != nil {
+		t.Errorf("a: rejection counted as error: %v", v)
+	}
+	if n := up.dialed("a"); n != 1 {
+		t.Errorf("a dialed %d times, want 1", n)
+	}
+
+	d.SetNodeMaxConns("b", 1)
+	if _, err := d.Open(""); err != ErrNodesAtLimit {
+		t.Errorf("expected ErrNodesAtLimit, got %v", err)
+	}
+
+	// closing frees the slot
+	first.Close()
+	if c, err := d.Open(""); err != nil {
+		t.Errorf("slot not freed by Close: %v", err)
+	} else {
+		c.Close()
+	}
+	second.Close()
+}
+
+func TestMaxTotalConns(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.SetMaxTotalConns(2)
+
+	var conns []driver.Conn
+	for i := 0; i < 2; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	// without a context that can be done, Open fails right away
+	if _, err := d.Open(""); err != ErrClusterAtLimit {
+		t.Errorf("expected ErrClusterAtLimit, got %v", err)
+	}
+	// with one, it waits until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := d.openConn(ctx, nil); !errors.Is(err, ErrClusterAtLimit) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected ErrClusterAtLimit and the deadline, got %v", err)
+	}
+	if v := d.exp.Get("ClusterAtLimit"); v == nil || v.String() != "2" {
+		t.Errorf("ClusterAtLimit = %v, want 2", v)
+	}
+	waitDials(t, d)
+	dials := up.dialed("a") + up.dialed("b")
+
+	// or until a connection is closed
+	opened := make(chan error)
+	waiting, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		c, err := d.openConn(waiting, nil)
+		if err == nil {
+			c.Close()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		t.Fatalf("Open did not wait: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := up.dialed("a") + up.dialed("b"); n != dials {
+		t.Errorf("nodes dialed while the cluster is at its limit")
+	}
+	conns[0].Close()
+	if err := <-opened; err != nil {
+		t.Errorf("Open after Close: %v", err)
+	}
+
+	// failed Opens give their slot back
+	up.node("a", errFakeUnreachable, 0)
+	up.node("b", errFakeUnreachable, 0)
+	if _, err := d.Open(""); err == nil || errors.Is(err, ErrClusterAtLimit) {
+		t.Errorf("expected the nodes' error, got %v", err)
+	}
+	up.node("a", nil, 0)
+	d.SetMaxTotalConns(0)
+	if c, err := d.Open(""); err != nil {
+		t.Errorf("Open without limit: %v", err)
+	} else {
+		c.Close()
+	}
+	conns[1].Close()
+	if d.totalConns != 0 {
+		t.Errorf("%d slots taken after closing everything", d.totalConns)
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 20*time.Millisecond)
+	d := newTestDriver(up, "a", "b")
+	gauge := func(m *expvar.Map, key string) string {
+		if v := m.Get(key); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+
+	var conns []driver.Conn
+	for i := 0; i < 3; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if got := gauge(d.nodes["a"].exp, "ActiveConnections"); got != "3" {
+		t.Errorf("a: ActiveConnections = %s, want 3", got)
+	}
+	if got := gauge(d.exp, "ActiveConnectionsTotal"); got != "3" {
+		t.Errorf("ActiveConnectionsTotal = %s, want 3", got)
+	}
+	if got := gauge(d.nodes["a"].exp, "Connections"); got != "3" {
+		t.Errorf("a: Connections = %s, want 3", got)
+	}
+
+	for _, c := range conns {
+		c.Close()
+		c.Close() // closing twice counts once
+	}
+	waitDials(t, d) // the losing dials to b are closed as well
+	for _, name := range []string{"a", "b"} {
+		if got := gauge(d.nodes[name].exp, "ActiveConnections"); got != "0" {
+			t.Errorf("%s: ActiveConnections = %s after closing everything", name, got)
+		}
+	}
+	if got := gauge(d.exp, "ActiveConnectionsTotal"); got != "0" {
+		t.Errorf("ActiveConnectionsTotal = %s after closing everything", got)
+	}
+	if got := gauge(d.nodes["a"].exp, "Connections"); got != "3" {
+		t.Errorf("a: Connections = %s, the cumulative counter must not go down", got)
+	}
+}
+
+func TestDelNodeArchivesStats(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	d.AddNode("b", "b")
+
+	d.DelNode("a")
+	if d.exp.Get("a") != nil {
+		t.Error("deleted node still published under its name")
+	}
+	archive, ok := d.exp.Get("_archived").(*expvar.Map)
+	if !ok {
+		t.Fatal("no _archived map")
+	}
+	m, ok := archive.Get("a@2024-03-01T12:00:00Z").(*expvar.Map)
+	if !ok {
+		t.Fatalf("a not archived: %s", archive)
+	}
+	if v := m.Get("Connections"); v == nil || v.String() != "1" {
+		t.Errorf("archived Connections = %v, want 1", v)
+	}
+	d.DelNode("a") // already gone
+	d.DelNode("nonexistent")
+	if d.exp.Get("b") == nil {
+		t.Error("b no longer published")
+	}
+
+	// only the most recent deletions are kept
+	for i := 0; i < maxArchived+5; i++ {
+		now = now.Add(time.Second)
+		d.AddNode("b", "b")
+		d.DelNode("b")
+	}
+	count := 0
+	archive.Do(func(expvar.KeyValue) { count++ })
+	if count != maxArchived {
+		t.Errorf("%d archived nodes, want %d", count, maxArchived)
+	}
+	if archive.Get("a@2024-03-01T12:00:00Z") != nil {
+		t.Error("oldest archived node was not dropped")
+	}
+}
+
+func TestReAddNode(t *testing.T) {
+	up := newFakeDriver()
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.SetFailbackDebounce(time.Minute)
+	d.checkNode(context.Background(), d.nodes["a"], 0) // unreachable
+	if d.nodes["a"].healthy {
+		t.Fatal("a is healthy while unreachable")
+	}
+
+	// back from maintenance, a starts fresh
+	up.node("a", nil, 0)
+	d.DelNode("a")
+	d.AddNode("a", "a")
+	n := d.nodes["a"]
+	if !n.healthy || n.failures != 0 || d.settling(n, d.now()) {
+		t.Errorf("re-added node inherited its health: healthy %v, %d failures", n.healthy, n.failures)
+	}
+	if got := d.PreviewSelection(); len(got) != 2 {
+		t.Errorf("selection %v, want a to be eligible", got)
+	}
+	if v := n.exp.Get("Errors"); v != nil {
+		t.Errorf("Errors = %v, want the stats to start over", v)
+	}
+
+	// if asked to, the stats carry over
+	d.SetKeepStatsOnReAdd(true)
+	d.count(n, "Connections")
+	d.recordError(n, errFakeUnreachable)
+	d.setHealthy(n, false)
+	d.DelNode("a")
+	d.AddNode("a", "a")
+	n = d.nodes["a"]
+	if !n.healthy {
+		t.Error("re-added node inherited its health")
+	}
+	for name, want := range map[string]string{"Connections": "1", "Errors": "1", "ConsecutiveFailures": "<nil>"} {
+		if got := fmt.Sprint(n.exp.Get(name)); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+	if d.exp.Get("_archived").(*expvar.Map).Get(d.archived[0]) == nil || len(d.archived) != 1 {
+		t.Errorf("archive %v, want only the first deletion left", d.archived)
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a")
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	n := d.nodes["a"]
+	for i := 0; i < maxRecentErrors+3; i++ {
+		now = now.Add(time.Second)
+		d.recordError(n, fmt.Errorf("error %d", i))
+	}
+
+	errs := d.stats().Nodes["a"].RecentErrors
+	if len(errs) != maxRecentErrors {
+		t.Fatalf("%d errors kept, want %d", len(errs), maxRecentErrors)
+	}
+	for i, err := range errs {
+		want := TimestampedError{time.Unix(1004+int64(i), 0), fmt.Sprintf("error %d", i+3)}
+		if !err.Time.Equal(want.Time) || err.Message != want.Message {
+			t.Errorf("error %d: got %+v, want %+v", i, err, want)
+		}
+	}
+	var published []TimestampedError
+	if err := json.Unmarshal([]byte(n.exp.Get("RecentErrors").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != maxRecentErrors || published[maxRecentErrors-1].Message != "error 12" {
+		t.Errorf("published %+v", published)
+	}
+
+	d.ResetStats()
+	if errs := d.stats().Nodes["a"].RecentErrors; len(errs) != 0 {
+		t.Errorf("%d errors kept after ResetStats", len(errs))
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a", "b", "c")
+	d.DelNode("c")
+	d.SetRetry(1, time.Millisecond, 0)
+	d.SetNodeMaxConns("a", 1)
+
+	held, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Open("") // a is at its limit and b fails, twice
+	d.checkHealth(context.Background(), time.Second)
+
+	d.ResetStats()
+	var check func(prefix string, m *expvar.Map)
+	check = func(prefix string, m *expvar.Map) {
+		m.Do(func(kv expvar.KeyValue) {
+			switch v := kv.Value.(type) {
+			case *expvar.Map:
+				if kv.Key != "_archived" {
+					check(prefix+kv.Key+".", v)
+				}
+			case *expvar.Int:
+				if !gauges[kv.Key] && v.Value() != 0 {
+					t.Errorf("%s%s = %d after ResetStats", prefix, kv.Key, v.Value())
+				}
+			case *expvar.String:
+				if !gauges[kv.Key] && v.Value() != "" {
+					t.Errorf("%s%s = %q after ResetStats", prefix, kv.Key, v.Value())
+				}
+			}
+		})
+	}
+	check("", d.exp)
+
+	if v := d.nodes["a"].exp.Get("ActiveConnections"); v == nil || v.String() != "1" {
+		t.Errorf("a: ActiveConnections = %v, gauges must survive ResetStats", v)
+	}
+	if d.nodes["b"].healthy || !d.nodes["a"].healthy {
+		t.Error("health changed by ResetStats")
+	}
+	if got, want := d.PreviewSelection(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes changed by ResetStats: %v", got)
+	}
+	held.Close()
+	if v := d.exp.Get("ActiveConnectionsTotal"); v == nil || v.String() != "0" {
+		t.Errorf("ActiveConnectionsTotal = %v after closing", v)
+	}
+}
+
+func TestDSNProvider(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "a")
+	now := time.Unix(1000, 0)
+	d.SetNodeRole("a", RoleReplica)
+	d.SetDSNProvider(func(n NodeInfo) (string, error) {
+		if n.Name != "a" || n.DSN != "a" || n.Role != RoleReplica {
+			t.Errorf("unexpected NodeInfo %+v", n)
+		}
+		return "user:token-" + strconv.FormatInt(now.Unix(), 10) + "@" + n.DSN, nil
+	})
+
+	up.node("user:token-1000@a", nil, 0)
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := up.dialed("user:token-1000@a"); n != 1 {
+		t.Errorf("generated DSN dialed %d times, want 1", n)
+	}
+	if n := up.dialed("a"); n != 0 {
+		t.Errorf("static DSN dialed %d times", n)
+	}
+
+	// the token changes for the next dial, health checks included
+	now = now.Add(time.Minute)
+	up.node("user:token-1060@a", nil, 0)
+	if err := d.checkHealth(context.Background(), time.Second)["a"]; err != nil {
+		t.Error(err)
+	}
+	if n := up.dialed("user:token-1060@a"); n != 1 {
+		t.Errorf("health check dialed the new DSN %d times, want 1", n)
+	}
+
+	errToken := errors.New("token service unavailable")
+	d.SetDSNProvider(func(NodeInfo) (string, error) { return "", errToken })
+	if _, err := d.Open(""); !errors.Is(err, errToken) {
+		t.Errorf("got %v, want %v", err, errToken)
+	}
+	a := d.nodes["a"]
+	if a.healthy {
+		t.Error("provider failure did not make the node unhealthy")
+	}
+	if v := a.exp.Get("LastErrorMessage"); v == nil || !strings.Contains(v.String(), errToken.Error()) {
+		t.Errorf("LastErrorMessage = %v", v)
+	}
+}
+
+func TestSuccessAfterFailures(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "a", "b", "c")
+	d.SetFanout(1) // dial a, b and c in this order
+	d.SetNodeWeight("a", 3)
+	d.SetNodeWeight("b", 2)
+	counter := func(key string) string {
+		if v := d.exp.Get(key); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+
+	for _, test := range []struct {
+		up     []string // the nodes that can be opened
+		bucket string
+	}{
+		{[]string{"a", "b", "c"}, "SuccessAfter_0Failures"},
+		{[]string{"b", "c"}, "SuccessAfter_1Failures"},
+		{[]string{"c"}, "SuccessAfter_2+Failures"},
+	} {
+		for _, dsn := range []string{"a", "b", "c"} {
+			up.node(dsn, errFakeUnreachable, 0)
+			d.setHealthy(d.nodes[dsn], true) // keep the order
+		}
+		for _, dsn := range test.up {
+			up.node(dsn, nil, 0)
+		}
+		before := counter(test.bucket)
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if before != "0" || counter(test.bucket) != "1" {
+			t.Errorf("%v up: %s went from %s to %s, want 0 to 1", test.up, test.bucket, before, counter(test.bucket))
+		}
+	}
+
+	// failures of earlier attempts count
+	d2 := newTestDriver(up, "c")
+	calls := 0
+	d2.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if calls++; calls == 1 {
+				return nil, errFakeUnreachable
+			}
+			return next(dsn)
+		}
+	})
+	d2.SetRetry(1, time.Millisecond, 0)
+	if _, err := d2.Open(""); err != nil {
+		t.Fatal(err)
+	}
+	if v := d2.exp.Get("SuccessAfter_1Failures"); v == nil || v.String() != "1" {
+		t.Errorf("SuccessAfter_1Failures = %v after a retry, want 1", v)
+	}
+}
+
+func TestPrivateDriver(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	var drivers []*Driver
+	for i := 0; i < 10; i++ {
+		d := NewPrivateDriver(up)
+		d.AddNode("a", "a")
+		drivers = append(drivers, d)
+	}
+	c, err := drivers[3].Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for i, d := range drivers {
+		rec := httptest.NewRecorder()
+		d.ExpvarHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/clustersql", nil))
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("Content-Type %q", ct)
+		}
+		var vars struct {
+			FirstInstanciated string
+			A                 struct{ Connections int } `json:"a"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+			t.Fatalf("%v: %s", err, rec.Body)
+		}
+		want := 0
+		if i == 3 {
+			want = 1
+		}
+		if vars.FirstInstanciated == "" || vars.A.Connections != want {
+			t.Errorf("driver %d: unexpected vars %s", i, rec.Body)
+		}
+	}
+}
+
+func TestEvictNode(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 50*time.Millisecond)
+	d := newTestDriver(up, "a", "b")
+	var conns []driver.Conn
+	for i := 0; i < 3; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+
+	if err := d.EvictNode("a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range conns {
+		if !c.(wrapped).base().Conn.(*fakeConn).isClosed() {
+			t.Error("connection to evicted node not closed")
+		}
+		if _, err := c.(driver.ExecerContext).ExecContext(context.Background(), "DELETE", nil); err == nil {
+			t.Error("connection to evicted node still usable")
+		}
+		if c.(driver.Validator).IsValid() {
+			t.Error("connection to evicted node still valid")
+		}
+		c.Close()
+	}
+	if got, want := d.PreviewSelection(), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PreviewSelection() = %v, want %v", got, want)
+	}
+	if v := d.exp.Get("ActiveConnectionsTotal"); v == nil || v.String() != "0" {
+		t.Errorf("ActiveConnectionsTotal = %v after eviction", v)
+	}
+	if err := d.EvictNode("a"); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("evicting twice: got %v, want ErrUnknownNode", err)
+	}
+}
+
+func TestConnInit(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 20*time.Millisecond)
+	d := newTestDriver(up, "a", "b")
+	errInit := errors.New("unknown time zone")
+	var mu sync.Mutex
+	failing := map[string]bool{}
+	d.SetConnInit(func(ctx context.Context, conn driver.Conn, n NodeInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing[n.Name] {
+			return errInit
+		}
+		_, err := conn.(driver.Execer).Exec("SET time_zone = '+00:00'", nil)
+		return err
+	})
+
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if q := up.executed("a"); len(q) != 1 || q[0] != "SET time_zone = '+00:00'" {
+		t.Errorf("init not run on new connection to a: %v", q)
+	}
+
+	mu.Lock()
+	failing["a"] = true
+	mu.Unlock()
+	c, err = d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(wrapped).base().n.Name; got != "b" {
+		t.Errorf("connection went to %s, init failed there", got)
+	}
+	c.Close()
+	a := d.nodes["a"]
+	if a.healthy {
+		t.Error("init failure did not make a unhealthy")
+	}
+	if v := a.exp.Get("LastErrorMessage"); v == nil || !strings.Contains(v.String(), errInit.Error()) {
+		t.Errorf("LastErrorMessage = %v", v)
+	}
+
+	mu.Lock()
+	failing["b"] = true
+	mu.Unlock()
+	if _, err := d.Open(""); !errors.Is(err, errInit) {
+		t.Errorf("got %v, want %v", err, errInit)
+	}
+}
+
+func TestAcquireLatency(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", errFakeUnreachable, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.SetNodeWeight("a", 2)
+	d.SetFanout(1)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	took := map[string]time.Duration{"a": 30 * time.Millisecond, "b": 10 * time.Millisecond}
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			now = now.Add(took[dsn])
+			return next(dsn)
+		}
+	})
+
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := d.nodes["b"].latency.value(); got != 10*time.Millisecond {
+		t.Errorf("dial latency of b = %s, want 10ms", got)
+	}
+	m := d.exp.Get("AcquireLatency").(*expvar.Map)
+	if v := m.Get("EWMAMillis"); v == nil || v.String() != "40" {
+		t.Errorf("EWMAMillis = %v, want 40 (failover to b included)", v)
+	}
+	if v := m.Get("<100ms"); v == nil || v.String() != "1" {
+		t.Errorf("<100ms = %v, want 1", v)
+	}
+
+	// a second, fast Open moves the average
+	up.node("a", nil, 0)
+	took["a"] = 0
+	d.setHealthy(d.nodes["a"], true)
+	c, err = d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if v := m.Get("EWMAMillis"); v == nil || v.String() != "32" {
+		t.Errorf("EWMAMillis = %v, want 32", v)
+	}
+	if v := m.Get("<1ms"); v == nil || v.String() != "1" {
+		t.Errorf("<1ms = %v, want 1", v)
+	}
+}
+
+// slowPingConn is a connection whose Ping takes a while on the fake clock of a test.
+type slowPingConn struct {
+	driver.Conn
+	ping func() error
+}
+
+func (c slowPingConn) Ping(ctx context.Context) error { return c.ping() }
+
+func TestSecondsSinceLastSuccess(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	d.AddNode("a", "a")
+	since := func() string {
+		return d.nodes["a"].exp.Get("SecondsSinceLastSuccess").String()
+	}
+
+	now = now.Add(5 * time.Second)
+	if got := since(); got != "5" {
+		t.Errorf("SecondsSinceLastSuccess = %s before the first dial, want 5 since being added", got)
+	}
+	up.node("a", nil, 0)
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := since(); got != "0" {
+		t.Errorf("SecondsSinceLastSuccess = %s right after a success, want 0", got)
+	}
+
+	// failing dials let it grow
+	up.node("a", errFakeUnreachable, 0)
+	for i := 0; i < 3; i++ {
+		now = now.Add(30 * time.Second)
+		d.Open("")
+	}
+	if got := since(); got != "90" {
+		t.Errorf("SecondsSinceLastSuccess = %s after failing for 90s, want 90", got)
+	}
+	now = now.Add(1500 * time.Millisecond)
+	if got := since(); got != "91.5" {
+		t.Errorf("SecondsSinceLastSuccess = %s, want 91.5", got)
+	}
+
+	up.node("a", nil, 0)
+	c, err = d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := since(); got != "0" {
+		t.Errorf("SecondsSinceLastSuccess = %s after the next success, want 0", got)
+	}
+}
+
+func TestHandshakeLatency(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	var pingErr error
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			now = now.Add(30 * time.Millisecond)
+			c, err := next(dsn)
+			return slowPingConn{c, func() error {
+				now = now.Add(10 * time.Millisecond)
+				return pingErr
+			}}, err
+		}
+	})
+	latency := func(name string) string {
+		return d.nodes["a"].exp.Get(name).String()
+	}
+
+	// without pinging, all of the dial counts as connecting
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := latency("ConnectLatency"); got != "30" {
+		t.Errorf("ConnectLatency = %s, want 30", got)
+	}
+	if got := latency("HandshakeLatency"); got != "0" {
+		t.Errorf("HandshakeLatency = %s before SetPingOnDial, want 0", got)
+	}
+
+	d.SetPingOnDial(true)
+	c, err = d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := latency("ConnectLatency"); got != "30" {
+		t.Errorf("ConnectLatency = %s, want 30", got)
+	}
+	if got := latency("HandshakeLatency"); got != "10" {
+		t.Errorf("HandshakeLatency = %s, want 10", got)
+	}
+
+	// a failing ping fails the dial, and the connection is not leaked
+	pingErr = errors.New("access denied")
+	if _, err := d.Open(""); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("got %v, want the error of the ping", err)
+	}
+	if got := latency("HandshakeLatency"); got != "10" {
+		t.Errorf("HandshakeLatency = %s after a failed ping, want 10", got)
+	}
+	if n := d.nodes["a"].live; n != 0 {
+		t.Errorf("%d live connections after a failed ping, want 0", n)
+	}
+}
+
+func TestForcedNode(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	up.node("c", errFakeUnreachable, 0)
+	d := newTestDriver(up, "a", "b", "c")
+	d.SetNodeWeight("a", 100)
+	d.SetReadWriteSplit(true) // bypassed as well
+	connector, _ := d.OpenConnector("")
+
+	c, err := connector.Connect(WithForcedNode(context.Background(), "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, ok := c.(wrapped); !ok || w.base().n.Name != "b" {
+		t.Errorf("forced connection is %T, want one to b", c)
+	}
+	c.Close()
+
+	_, err = connector.Connect(WithForcedNode(context.Background(), "c"))
+	if !errors.Is(err, errFakeUnreachable) {
+		t.Errorf("forcing an unreachable node: got %v", err)
+	}
+	if _, err := connector.Connect(WithForcedNode(context.Background(), "x")); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("forcing an unknown node: expected ErrUnknownNode, got %v", err)
+	}
+	waitDials(t, d) // for dials that would have been made in the background
+	for dsn, want := range map[string]int{"a": 0, "b": 1, "c": 1} {
+		if got := up.dialed(dsn); got != want {
+			t.Errorf("%s dialed %d times, want %d", dsn, got, want)
+		}
+	}
+}
+
+func TestNewDriverNameTaken(t *testing.T) {
+	// like some other code, or a second copy of this package, would
+	if expvar.Get("ClusterSql") == nil {
+		expvar.NewMap("ClusterSql")
+	}
+	d := NewDriver(newFakeDriver())
+	if name := d.ExpvarName(); name == "ClusterSql" || expvar.Get(name) != d.exp {
+		t.Errorf("driver published as %q", name)
+	}
+	if d2 := NewDriver(newFakeDriver()); d2.ExpvarName() == d.ExpvarName() {
+		t.Errorf("two drivers published as %q", d.ExpvarName())
+	}
+
+	if _, err := NewNamedDriver(newFakeDriver(), "ClusterSql"); !errors.Is(err, ErrExpvarNameTaken) {
+		t.Errorf("got %v, want ErrExpvarNameTaken", err)
+	}
+	name := "TestNewDriverNameTaken" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	d, err := NewNamedDriver(newFakeDriver(), name)
+	if err != nil || d.ExpvarName() != name {
+		t.Errorf("NewNamedDriver: %v, %v", d, err)
+	}
+	if name := NewPrivateDriver(newFakeDriver()).ExpvarName(); name != "" {
+		t.Errorf("private driver published as %q", name)
+	}
+}
+
+func TestNodeMeta(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	meta := map[string]string{"hardware": "r6i.4xlarge", "owner": "dba-team"}
+	d.AddNodeWithMeta("galera1", "galera1", meta)
+	d.AddNode("galera2", "galera2")
+	meta["owner"] = "someone else" // the node has a copy
+
+	want := map[string]string{"hardware": "r6i.4xlarge", "owner": "dba-team"}
+	for _, n := range d.DumpConfig().Nodes {
+		if n.Name == "galera1" && !reflect.DeepEqual(n.Meta, want) || n.Name == "galera2" && n.Meta != nil {
+			t.Errorf("%s: DumpConfig has metadata %v", n.Name, n.Meta)
+		}
+	}
+	var mu sync.Mutex
+	seen := map[string]map[string]string{}
+	d.SetDSNProvider(func(node NodeInfo) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[node.Name] = copyStrings(node.Meta)
+		if node.Meta != nil {
+			node.Meta["owner"] = "changed by the provider"
+		}
+		return node.DSN, nil
+	})
+	d.PingAll(context.Background())
+	if !reflect.DeepEqual(seen["galera1"], want) || seen["galera2"] != nil {
+		t.Errorf("NodeInfo has metadata %v", seen)
+	}
+	if got := d.DumpConfig().Nodes[0].Meta; !reflect.DeepEqual(got, want) {
+		t.Errorf("metadata changed to %v through NodeInfo", got)
+	}
+}
+
+func TestOpenAll(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b", "c") // c is unreachable
+	d.SetFanout(1)
+
+	conns, err := d.OpenAll(context.Background())
+	if len(conns) != 2 || conns["a"] == nil || conns["b"] == nil {
+		t.Errorf("got connections to %v, want a and b", conns)
+	}
+	var nodeErr *NodeError
+	if !errors.As(err, &nodeErr) || nodeErr.Node != "c" || !errors.Is(err, errFakeUnreachable) {
+		t.Errorf("got %v, want the error of c", err)
+	}
+	for name, c := range conns {
+		if got := c.(wrapped).base().n.Name; got != name {
+			t.Errorf("connection for %s goes to %s", name, got)
+		}
+		c.Close()
+	}
+	if d.totalConns != 0 {
+		t.Errorf("%d connections left after closing all", d.totalConns)
+	}
+
+	up.node("c", nil, 0)
+	conns, err = d.OpenAll(context.Background())
+	if err != nil || len(conns) != 3 {
+		t.Errorf("got %d connections, %v", len(conns), err)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func TestNestedDriver(t *testing.T) {
+	inner := NewPrivateDriver(newFakeDriver())
+	if _, err := NewNamedDriver(inner, "TestNestedDriver"); err != ErrNestedDriver {
+		t.Errorf("NewNamedDriver: got %v, want ErrNestedDriver", err)
+	}
+	if expvar.Get("TestNestedDriver") != nil {
+		t.Error("rejected driver was published")
+	}
+	if _, err := Open("", inner, nil); err != ErrNestedDriver {
+		t.Errorf("Open: got %v, want ErrNestedDriver", err)
+	}
+	for name, construct := range map[string]func(driver.Driver) *Driver{"NewDriver": NewDriver, "NewPrivateDriver": NewPrivateDriver} {
+		func() {
+			defer func() {
+				if r := recover(); r != ErrNestedDriver {
+					t.Errorf("%s: recovered %v, want ErrNestedDriver", name, r)
+				}
+			}()
+			construct(inner)
+		}()
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	up := newFakeDriver()
+	if got := NewDriver(up).Upstream(); got != up {
+		t.Errorf("Upstream() = %p, want %p", got, up)
+	}
+}
+
+func TestSelectionGuard(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	for _, n := range []struct{ name, region string }{{"eu1", "eu"}, {"eu2", "eu"}, {"us1", "us"}} {
+		up.node(n.name, nil, 0)
+		d.AddNode(n.name, n.name)
+		d.SetNodeLabels(n.name, map[string]string{"region": n.region})
+	}
+	type residencyKey struct{}
+	d.SetSelectionGuard(func(n NodeInfo, ctx context.Context) bool {
+		region, ok := ctx.Value(residencyKey{}).(string)
+		return !ok || n.Labels["region"] == region
+	})
+	connector, _ := d.OpenConnector("")
+	eu := context.WithValue(context.Background(), residencyKey{}, "eu")
+
+	for i := 0; i < 10; i++ {
+		c, err := connector.Connect(eu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; !strings.HasPrefix(got, "eu") {
+			t.Errorf("connection went to %s", got)
+		}
+		c.Close()
+	}
+	waitDials(t, d)
+	if n := up.dialed("us1"); n != 0 {
+		t.Errorf("us1 dialed %d times", n)
+	}
+
+	// failover stays within the allowed nodes
+	up.node("eu1", errFakeUnreachable, 0)
+	up.node("eu2", errFakeUnreachable, 0)
+	if _, err := connector.Connect(eu); err != errFakeUnreachable {
+		t.Errorf("got %v, want %v", err, errFakeUnreachable)
+	}
+	if n := up.dialed("us1"); n != 0 {
+		t.Errorf("us1 dialed %d times", n)
+	}
+
+	asia := context.WithValue(context.Background(), residencyKey{}, "asia")
+	if _, err := connector.Connect(asia); err != ErrNoEligibleNodes {
+		t.Errorf("got %v, want %v", err, ErrNoEligibleNodes)
+	}
+	c, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestLastSuccessfulNode(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	if name, at := d.LastSuccessfulNode(); name != "" || !at.IsZero() {
+		t.Errorf("LastSuccessfulNode() = %q, %s before any Open", name, at)
+	}
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	target := ""
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string { return []string{target} }))
+
+	for i, name := range []string{"a", "b", "b", "a"} {
+		now = now.Add(time.Second)
+		target = name
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if got, at := d.LastSuccessfulNode(); got != name || !at.Equal(now) {
+			t.Errorf("Open %d: LastSuccessfulNode() = %q, %s, want %q, %s", i, got, at, name, now)
+		}
+	}
+
+	// failures don't count
+	up.node("b", errFakeUnreachable, 0)
+	target = "b"
+	d.Open("")
+	if got, _ := d.LastSuccessfulNode(); got != "a" {
+		t.Errorf("LastSuccessfulNode() = %q after a failure, want a", got)
+	}
+}
+
+func TestPause(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	held, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Pause("upgrading to 8.0")
+	_, err = d.Open("")
+	if !errors.Is(err, ErrClusterPaused) || !strings.Contains(err.Error(), "upgrading to 8.0") {
+		t.Errorf("got %v, want ErrClusterPaused with the reason", err)
+	}
+	if n := up.dialed("a"); n != 1 {
+		t.Errorf("a dialed while paused")
+	}
+	if _, err := held.(driver.Execer).Exec("SELECT 1", nil); err != nil {
+		t.Errorf("open connection broken by Pause: %v", err)
+	}
+	// connections of split mode open lazily, and fail just the same
+	d.SetReadWriteSplit(true)
+	if _, err := d.Open(""); !errors.Is(err, ErrClusterPaused) {
+		t.Errorf("split mode: got %v, want ErrClusterPaused", err)
+	}
+	d.SetReadWriteSplit(false)
+	if v := d.exp.Get("PausedRejections"); v == nil || v.String() != "2" {
+		t.Errorf("PausedRejections = %v, want 2", v)
+	}
+
+	d.Resume()
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatalf("Open after Resume: %v", err)
+	}
+	c.Close()
+	held.Close()
+}
+
+func TestNodeDefaults(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "before")
+	d.SetNodeDefaults(NodeDefaults{Weight: 5, MaxConns: 10, DialTimeout: time.Second, Role: RoleReplica})
+	d.AddNode("plain", "plain")
+	d.AddNode("overridden", "overridden")
+	d.SetNodeWeight("overridden", 2)
+	d.SetNodeMaxConns("overridden", 3)
+	d.SetNodeRole("overridden", RolePrimary)
+	d.AddNodeWithTimeout("remote", "remote", time.Minute)
+
+	settings := map[string]NodeSettings{}
+	for _, s := range d.DumpConfig().Nodes {
+		settings[s.Name] = s
+	}
+	for name, want := range map[string][4]interface{}{
+		"before":     {1, 0, time.Duration(0), RoleAny},
+		"plain":      {5, 10, time.Second, RoleReplica},
+		"overridden": {2, 3, time.Second, RolePrimary},
+		"remote":     {5, 10, time.Minute, RoleReplica},
+	} {
+		s := settings[name]
+		if got := [4]interface{}{s.Weight, s.MaxConns, s.DialTimeout, s.Role}; got != want {
+			t.Errorf("%s: weight, max conns, dial timeout, role = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+//go:generate go run gen_conn.go
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// conn wraps a connection handed out by Open, keeping track of the node it belongs to.
+//
+// database/sql changes its behaviour depending on the optional interfaces (Pinger,
+// Execer, ...) a connection implements, so a conn is never handed out directly but
+// embedded in one of the types generated into conn_gen.go, which adds exactly the
+// optional interfaces of the upstream connection. The adapters doing so are below.
+// The exceptions are Validator, which every conn implements to enforce SetMaxConnAge, and
+// ExecerContext and QueryerContext, which fall back to the upstream Execer and Queryer.
+type conn struct {
+	driver.Conn
+	d      *Driver
+	n      *node
+	id     uint64 // unique per Driver, see LiveConnections
+	opened time.Time
+	used   time.Time // guarded by d.mu
+	idle   bool      // returned to the pool of database/sql and not used since, guarded by d.mu
+	once   sync.Once
+	bad    bool // the upstream connection reported driver.ErrBadConn or being invalid
+	inTx   bool // a transaction is running
+
+	abandoned bool      // a statement was abandoned, which closes the upstream connection, see abandon
+	closeOnce sync.Once // see closeUpstream
+	closeErr  error
+}
+
+// wrapped is implemented by all types returned by wrap.
+type wrapped interface {
+	base() *conn
+}
+
+// wrap wraps c, a connection to n. n.live must already have been incremented, and a connection slot of the cluster
+// taken with acquireTotal.
+func (d *Driver) wrap(c driver.Conn, n *node) driver.Conn {
+	wc := &conn{Conn: c, d: d, n: n, opened: d.now()}
+	wc.used = wc.opened
+	d.mu.Lock()
+	d.connSeq++
+	wc.id = d.connSeq
+	if n.conns == nil {
+		n.conns = map[*conn]bool{}
+	}
+	n.conns[wc] = true
+	d.mu.Unlock()
+	return expose(wc, interfaces(c))
+}
+
+func (c *conn) base() *conn {
+	return c
+}
+
+// check notes that the connection has been used and whether err tells that the upstream connection is broken, and
+// returns err, annotated with the node name if it is a node-level error.
+func (c *conn) check(err error) error {
+	c.d.mu.Lock()
+	c.used = c.d.now()
+	if c.idle {
+		c.idle = false
+		c.n.idle--
+	}
+	isNodeError, isNodeDown := c.d.isNodeError, c.d.isNodeDown
+	c.d.mu.Unlock()
+	switch err {
+	case nil, driver.ErrSkip:
+		return err
+	case driver.ErrBadConn:
+		// database/sql must see it as is to retry on another connection
+		c.bad = true
+		return err
+	}
+	if isNodeDown != nil && isNodeDown(err) {
+		c.bad = true
+		c.d.recordError(c.n, err)
+		c.d.setHealthy(c.n, false)
+	}
+	if isNodeError(err) {
+		return &NodeError{Node: c.n.Name, Err: err}
+	}
+	return err
+}
+
+// IsValid reports false once the connection is older than the maximum age for its node, if the upstream
+// connection says so or is known to be broken, or if the node has been evicted.
+//
+// database/sql asks whenever it returns the connection to its pool, so the connection counts as idle from then
+// on until it is used again, see NodeState.IdleConns.
+func (c *conn) IsValid() bool {
+	c.d.mu.Lock()
+	if !c.idle {
+		c.idle = true
+		c.n.idle++
+	}
+	c.d.mu.Unlock()
+	if c.bad {
+		return false
+	}
+	if v, ok := c.Conn.(driver.Validator); ok && !v.IsValid() {
+		c.bad = true
+		return false
+	}
+	c.d.mu.Lock()
+	age := c.d.maxConnAge
+	if c.n.maxConnAge > 0 {
+		age = c.n.maxConnAge
+	}
+	expired := age > 0 && c.d.now().Sub(c.opened) >= age || c.n.evicted
+	c.d.mu.Unlock()
+	return !expired
+}
+
+// ExecContext uses the fast path of the upstream connection (ExecContext or Exec) if there is one. Otherwise,
+// driver.ErrSkip makes database/sql prepare a statement instead.
+// Both are subject to the query timeout, see SetQueryTimeout.
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.bounded(ctx, func(ctx context.Context) (interface{}, error) {
+		return execContext(ctx, c.Conn, query, args)
+	})
+	if err = c.check(err); err != nil {
+		return nil, err
+	}
+	result, _ := res.(driver.Result)
+	return result, nil
+}
+
+// QueryContext is like ExecContext, for queries. Reads may be mirrored to a shadow node, see SetShadowNode, and
+// retried on another connection, see SetReadRetry.
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.bounded(ctx, func(ctx context.Context) (interface{}, error) {
+		return queryContext(ctx, c.Conn, query, args)
+	})
+	if err != nil && c.retryRead(query, err) {
+		return nil, c.check(driver.ErrBadConn)
+	}
+	if err = c.check(err); err != nil {
+		return nil, err
+	}
+	r, _ := rows.(driver.Rows)
+	if r == nil {
+		return nil, nil
+	}
+	return c.shadow(query, args, r), nil
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	return stmt, c.check(err)
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	tx, err := c.Conn.Begin()
+	return c.began(tx, c.check(err))
+}
+
+// began keeps track of tx, just begun on c, see conn.inTx.
+func (c *conn) began(tx driver.Tx, err error) (driver.Tx, error) {
+	if err != nil {
+		return nil, err
+	}
+	c.inTx = true
+	return connTx{tx, c}, nil
+}
+
+// retryRead reports whether query, which failed on c with err before returning any rows, should be retried on
+// another connection, see SetReadRetry. If so, the node of c is marked unhealthy.
+func (c *conn) retryRead(query string, err error) bool {
+	c.d.mu.Lock()
+	retry := c.d.readRetry && !c.inTx && c.d.isRead(query) && c.d.isNodeError(err)
+	c.d.mu.Unlock()
+	if !retry {
+		return false
+	}
+	c.d.recordError(c.n, err)
+	c.d.count(c.n, "ReadRetries")
+	c.d.setHealthy(c.n, false)
+	return true
+}
+
+// connTx is a transaction on a conn.
+type connTx struct {
+	driver.Tx
+	c *conn
+}
+
+func (t connTx) Commit() error {
+	t.c.inTx = false
+	return t.Tx.Commit()
+}
+
+func (t connTx) Rollback() error {
+	t.c.inTx = false
+	return t.Tx.Rollback()
+}
+
+// Close closes the upstream connection, unless a statement on it was abandoned, which does so once it returns. The
+// node's live connection count is only decremented once. With passive health checking, a clean close counts as a
+// successful interaction with the node.
+func (c *conn) Close() error {
+	var err error
+	if !c.abandoned {
+		err = c.closeUpstream()
+	}
+	c.once.Do(func() {
+		c.d.mu.Lock()
+		delete(c.n.conns, c)
+		c.n.live--
+		c.d.releaseTotal()
+		if c.idle {
+			c.n.idle--
+		}
+		c.n.exp.Add("ActiveConnections", -1)
+		c.d.exp.Add("ActiveConnectionsTotal", -1)
+		c.d.metrics.SetGauge("ActiveConnections", float64(c.n.live), c.n.metricLabels())
+		passive := c.d.passiveHealth
+		c.d.mu.Unlock()
+		if passive && err == nil && !c.bad {
+			c.d.setHealthy(c.n, true)
+		}
+	})
+	return err
+}
+
+// closeUpstream closes the upstream connection the first time it is called, and returns the error of doing so.
+func (c *conn) closeUpstream() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// ConnInfo describes a connection handed out by the Driver, see LiveConnections.
+type ConnInfo struct {
+	ID       uint64 // unique per Driver, in the order connections were opened
+	Node     string
+	Opened   time.Time
+	LastUsed time.Time // when a statement, transaction or ping last went through it
+}
+
+// LiveConnections lists all connections handed out by the Driver and not closed yet, ordered by ID. It is meant for
+// chasing connection leaks, together with the ActiveConnections gauges. Connections to nodes removed with DelNode
+// are not listed anymore.
+func (d *Driver) LiveConnections() []ConnInfo {
+	d.mu.Lock()
+	var res []ConnInfo
+	for _, n := range d.nodes {
+		if n == nil {
+			continue
+		}
+		for c := range n.conns {
+			res = append(res, ConnInfo{ID: c.id, Node: n.Name, Opened: c.opened, LastUsed: c.used})
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+type pinger struct{ c *conn }
+
+func (a pinger) Ping(ctx context.Context) error {
+	return a.c.check(a.c.Conn.(driver.Pinger).Ping(ctx))
+}
+
+type execer struct{ c *conn }
+
+func (a execer) Exec(query string, args []driver.Value) (driver.Result, error) {
+	res, err := a.c.Conn.(driver.Execer).Exec(query, args)
+	return res, a.c.check(err)
+}
+
+type queryer struct{ c *conn }
+
+func (a queryer) Query(query string, args []driver.Value) (driver.Rows, error) {
+	rows, err := a.c.Conn.(driver.Queryer).Query(query, args)
+	return rows, a.c.check(err)
+}
+
+type sessionResetter struct{ c *conn }
+
+func (a sessionResetter) ResetSession(ctx context.Context) error {
+	return a.c.check(a.c.Conn.(driver.SessionResetter).ResetSession(ctx))
+}
+
+type namedValueChecker struct{ c *conn }
+
+func (a namedValueChecker) CheckNamedValue(v *driver.NamedValue) error {
+	return a.c.Conn.(driver.NamedValueChecker).CheckNamedValue(v)
+}
+
+type connBeginTx struct{ c *conn }
+
+func (a connBeginTx) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := a.c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	return a.c.began(tx, a.c.check(err))
+}
+
+type connPrepareContext struct{ c *conn }
+
+func (a connPrepareContext) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := a.c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	return stmt, a.c.check(err)
+}
+
+// execContext runs query on c without preparing it, if c supports that.
+func execContext(ctx context.Context, c driver.Conn, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	e, ok := c.(driver.Execer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return e.Exec(query, values)
+}
+
+// queryContext is like execContext, for queries.
+func queryContext(ctx context.Context, c driver.Conn, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	q, ok := c.(driver.Queryer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return q.Query(query, values)
+}
+
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for i, v := range named {
+		if v.Name != "" {
+			return nil, errors.New("clustersql: upstream driver does not support the use of Named Parameters")
+		}
+		values[i] = v.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,1254 @@
+// Code generated by gen_conn.go; DO NOT EDIT.
+
+package clustersql
+
+import "database/sql/driver"
+
+// interfaces returns the mask of optional interfaces implemented by c.
+func interfaces(c driver.Conn) (mask uint) {
+	if _, ok := c.(driver.Pinger); ok {
+		mask |= 1 << 0
+	}
+	if _, ok := c.(driver.Execer); ok {
+		mask |= 1 << 1
+	}
+	if _, ok := c.(driver.Queryer); ok {
+		mask |= 1 << 2
+	}
+	if _, ok := c.(driver.SessionResetter); ok {
+		mask |= 1 << 3
+	}
+	if _, ok := c.(driver.NamedValueChecker); ok {
+		mask |= 1 << 4
+	}
+	if _, ok := c.(driver.ConnBeginTx); ok {
+		mask |= 1 << 5
+	}
+	if _, ok := c.(driver.ConnPrepareContext); ok {
+		mask |= 1 << 6
+	}
+	return mask
+}
+
+type conn0 struct {
+	*conn
+}
+
+type conn1 struct {
+	*conn
+	pinger
+}
+
+type conn2 struct {
+	*conn
+	execer
+}
+
+type conn3 struct {
+	*conn
+	pinger
+	execer
+}
+
+type conn4 struct {
+	*conn
+	queryer
+}
+
+type conn5 struct {
+	*conn
+	pinger
+	queryer
+}
+
+type conn6 struct {
+	*conn
+	execer
+	queryer
+}
+
+type conn7 struct {
+	*conn
+	pinger
+	execer
+	queryer
+}
+
+type conn8 struct {
+	*conn
+	sessionResetter
+}
+
+type conn9 struct {
+	*conn
+	pinger
+	sessionResetter
+}
+
+type conn10 struct {
+	*conn
+	execer
+	sessionResetter
+}
+
+type conn11 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+}
+
+type conn12 struct {
+	*conn
+	queryer
+	sessionResetter
+}
+
+type conn13 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+}
+
+type conn14 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+}
+
+type conn15 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+}
+
+type conn16 struct {
+	*conn
+	namedValueChecker
+}
+
+type conn17 struct {
+	*conn
+	pinger
+	namedValueChecker
+}
+
+type conn18 struct {
+	*conn
+	execer
+	namedValueChecker
+}
+
+type conn19 struct {
+	*conn
+	pinger
+	execer
+	namedValueChecker
+}
+
+type conn20 struct {
+	*conn
+	queryer
+	namedValueChecker
+}
+
+type conn21 struct {
+	*conn
+	pinger
+	queryer
+	namedValueChecker
+}
+
+type conn22 struct {
+	*conn
+	execer
+	queryer
+	namedValueChecker
+}
+
+type conn23 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	namedValueChecker
+}
+
+type conn24 struct {
+	*conn
+	sessionResetter
+	namedValueChecker
+}
+
+type conn25 struct {
+	*conn
+	pinger
+	sessionResetter
+	namedValueChecker
+}
+
+type conn26 struct {
+	*conn
+	execer
+	sessionResetter
+	namedValueChecker
+}
+
+type conn27 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+	namedValueChecker
+}
+
+type conn28 struct {
+	*conn
+	queryer
+	sessionResetter
+	namedValueChecker
+}
+
+type conn29 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+	namedValueChecker
+}
+
+type conn30 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+}
+
+type conn31 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+}
+
+type conn32 struct {
+	*conn
+	connBeginTx
+}
+
+type conn33 struct {
+	*conn
+	pinger
+	connBeginTx
+}
+
+type conn34 struct {
+	*conn
+	execer
+	connBeginTx
+}
+
+type conn35 struct {
+	*conn
+	pinger
+	execer
+	connBeginTx
+}
+
+type conn36 struct {
+	*conn
+	queryer
+	connBeginTx
+}
+
+type conn37 struct {
+	*conn
+	pinger
+	queryer
+	connBeginTx
+}
+
+type conn38 struct {
+	*conn
+	execer
+	queryer
+	connBeginTx
+}
+
+type conn39 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	connBeginTx
+}
+
+type conn40 struct {
+	*conn
+	sessionResetter
+	connBeginTx
+}
+
+type conn41 struct {
+	*conn
+	pinger
+	sessionResetter
+	connBeginTx
+}
+
+type conn42 struct {
+	*conn
+	execer
+	sessionResetter
+	connBeginTx
+}
+
+type conn43 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+	connBeginTx
+}
+
+type conn44 struct {
+	*conn
+	queryer
+	sessionResetter
+	connBeginTx
+}
+
+type conn45 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+	connBeginTx
+}
+
+type conn46 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+	connBeginTx
+}
+
+type conn47 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+	connBeginTx
+}
+
+type conn48 struct {
+	*conn
+	namedValueChecker
+	connBeginTx
+}
+
+type conn49 struct {
+	*conn
+	pinger
+	namedValueChecker
+	connBeginTx
+}
+
+type conn50 struct {
+	*conn
+	execer
+	namedValueChecker
+	connBeginTx
+}
+
+type conn51 struct {
+	*conn
+	pinger
+	execer
+	namedValueChecker
+	connBeginTx
+}
+
+type conn52 struct {
+	*conn
+	queryer
+	namedValueChecker
+	connBeginTx
+}
+
+type conn53 struct {
+	*conn
+	pinger
+	queryer
+	namedValueChecker
+	connBeginTx
+}
+
+type conn54 struct {
+	*conn
+	execer
+	queryer
+	namedValueChecker
+	connBeginTx
+}
+
+type conn55 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	namedValueChecker
+	connBeginTx
+}
+
+type conn56 struct {
+	*conn
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn57 struct {
+	*conn
+	pinger
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn58 struct {
+	*conn
+	execer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn59 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn60 struct {
+	*conn
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn61 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn62 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn63 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+}
+
+type conn64 struct {
+	*conn
+	connPrepareContext
+}
+
+type conn65 struct {
+	*conn
+	pinger
+	connPrepareContext
+}
+
+type conn66 struct {
+	*conn
+	execer
+	connPrepareContext
+}
+
+type conn67 struct {
+	*conn
+	pinger
+	execer
+	connPrepareContext
+}
+
+type conn68 struct {
+	*conn
+	queryer
+	connPrepareContext
+}
+
+type conn69 struct {
+	*conn
+	pinger
+	queryer
+	connPrepareContext
+}
+
+type conn70 struct {
+	*conn
+	execer
+	queryer
+	connPrepareContext
+}
+
+type conn71 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	connPrepareContext
+}
+
+type conn72 struct {
+	*conn
+	sessionResetter
+	connPrepareContext
+}
+
+type conn73 struct {
+	*conn
+	pinger
+	sessionResetter
+	connPrepareContext
+}
+
+type conn74 struct {
+	*conn
+	execer
+	sessionResetter
+	connPrepareContext
+}
+
+type conn75 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+	connPrepareContext
+}
+
+type conn76 struct {
+	*conn
+	queryer
+	sessionResetter
+	connPrepareContext
+}
+
+type conn77 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+	connPrepareContext
+}
+
+type conn78 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+	connPrepareContext
+}
+
+type conn79 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+	connPrepareContext
+}
+
+type conn80 struct {
+	*conn
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn81 struct {
+	*conn
+	pinger
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn82 struct {
+	*conn
+	execer
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn83 struct {
+	*conn
+	pinger
+	execer
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn84 struct {
+	*conn
+	queryer
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn85 struct {
+	*conn
+	pinger
+	queryer
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn86 struct {
+	*conn
+	execer
+	queryer
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn87 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn88 struct {
+	*conn
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn89 struct {
+	*conn
+	pinger
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn90 struct {
+	*conn
+	execer
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn91 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn92 struct {
+	*conn
+	queryer
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn93 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn94 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn95 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+	connPrepareContext
+}
+
+type conn96 struct {
+	*conn
+	connBeginTx
+	connPrepareContext
+}
+
+type conn97 struct {
+	*conn
+	pinger
+	connBeginTx
+	connPrepareContext
+}
+
+type conn98 struct {
+	*conn
+	execer
+	connBeginTx
+	connPrepareContext
+}
+
+type conn99 struct {
+	*conn
+	pinger
+	execer
+	connBeginTx
+	connPrepareContext
+}
+
+type conn100 struct {
+	*conn
+	queryer
+	connBeginTx
+	connPrepareContext
+}
+
+type conn101 struct {
+	*conn
+	pinger
+	queryer
+	connBeginTx
+	connPrepareContext
+}
+
+type conn102 struct {
+	*conn
+	execer
+	queryer
+	connBeginTx
+	connPrepareContext
+}
+
+type conn103 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	connBeginTx
+	connPrepareContext
+}
+
+type conn104 struct {
+	*conn
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn105 struct {
+	*conn
+	pinger
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn106 struct {
+	*conn
+	execer
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn107 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn108 struct {
+	*conn
+	queryer
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn109 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn110 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn111 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+	connBeginTx
+	connPrepareContext
+}
+
+type conn112 struct {
+	*conn
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn113 struct {
+	*conn
+	pinger
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn114 struct {
+	*conn
+	execer
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn115 struct {
+	*conn
+	pinger
+	execer
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn116 struct {
+	*conn
+	queryer
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn117 struct {
+	*conn
+	pinger
+	queryer
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn118 struct {
+	*conn
+	execer
+	queryer
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn119 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn120 struct {
+	*conn
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn121 struct {
+	*conn
+	pinger
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn122 struct {
+	*conn
+	execer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn123 struct {
+	*conn
+	pinger
+	execer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn124 struct {
+	*conn
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn125 struct {
+	*conn
+	pinger
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn126 struct {
+	*conn
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+type conn127 struct {
+	*conn
+	pinger
+	execer
+	queryer
+	sessionResetter
+	namedValueChecker
+	connBeginTx
+	connPrepareContext
+}
+
+// expose returns c as a type implementing exactly the optional interfaces in mask.
+func expose(c *conn, mask uint) driver.Conn {
+	switch mask {
+	case 0:
+		return &conn0{c}
+	case 1:
+		return &conn1{c, pinger{c}}
+	case 2:
+		return &conn2{c, execer{c}}
+	case 3:
+		return &conn3{c, pinger{c}, execer{c}}
+	case 4:
+		return &conn4{c, queryer{c}}
+	case 5:
+		return &conn5{c, pinger{c}, queryer{c}}
+	case 6:
+		return &conn6{c, execer{c}, queryer{c}}
+	case 7:
+		return &conn7{c, pinger{c}, execer{c}, queryer{c}}
+	case 8:
+		return &conn8{c, sessionResetter{c}}
+	case 9:
+		return &conn9{c, pinger{c}, sessionResetter{c}}
+	case 10:
+		return &conn10{c, execer{c}, sessionResetter{c}}
+	case 11:
+		return &conn11{c, pinger{c}, execer{c}, sessionResetter{c}}
+	case 12:
+		return &conn12{c, queryer{c}, sessionResetter{c}}
+	case 13:
+		return &conn13{c, pinger{c}, queryer{c}, sessionResetter{c}}
+	case 14:
+		return &conn14{c, execer{c}, queryer{c}, sessionResetter{c}}
+	case 15:
+		return &conn15{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}}
+	case 16:
+		return &conn16{c, namedValueChecker{c}}
+	case 17:
+		return &conn17{c, pinger{c}, namedValueChecker{c}}
+	case 18:
+		return &conn18{c, execer{c}, namedValueChecker{c}}
+	case 19:
+		return &conn19{c, pinger{c}, execer{c}, namedValueChecker{c}}
+	case 20:
+		return &conn20{c, queryer{c}, namedValueChecker{c}}
+	case 21:
+		return &conn21{c, pinger{c}, queryer{c}, namedValueChecker{c}}
+	case 22:
+		return &conn22{c, execer{c}, queryer{c}, namedValueChecker{c}}
+	case 23:
+		return &conn23{c, pinger{c}, execer{c}, queryer{c}, namedValueChecker{c}}
+	case 24:
+		return &conn24{c, sessionResetter{c}, namedValueChecker{c}}
+	case 25:
+		return &conn25{c, pinger{c}, sessionResetter{c}, namedValueChecker{c}}
+	case 26:
+		return &conn26{c, execer{c}, sessionResetter{c}, namedValueChecker{c}}
+	case 27:
+		return &conn27{c, pinger{c}, execer{c}, sessionResetter{c}, namedValueChecker{c}}
+	case 28:
+		return &conn28{c, queryer{c}, sessionResetter{c}, namedValueChecker{c}}
+	case 29:
+		return &conn29{c, pinger{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}}
+	case 30:
+		return &conn30{c, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}}
+	case 31:
+		return &conn31{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}}
+	case 32:
+		return &conn32{c, connBeginTx{c}}
+	case 33:
+		return &conn33{c, pinger{c}, connBeginTx{c}}
+	case 34:
+		return &conn34{c, execer{c}, connBeginTx{c}}
+	case 35:
+		return &conn35{c, pinger{c}, execer{c}, connBeginTx{c}}
+	case 36:
+		return &conn36{c, queryer{c}, connBeginTx{c}}
+	case 37:
+		return &conn37{c, pinger{c}, queryer{c}, connBeginTx{c}}
+	case 38:
+		return &conn38{c, execer{c}, queryer{c}, connBeginTx{c}}
+	case 39:
+		return &conn39{c, pinger{c}, execer{c}, queryer{c}, connBeginTx{c}}
+	case 40:
+		return &conn40{c, sessionResetter{c}, connBeginTx{c}}
+	case 41:
+		return &conn41{c, pinger{c}, sessionResetter{c}, connBeginTx{c}}
+	case 42:
+		return &conn42{c, execer{c}, sessionResetter{c}, connBeginTx{c}}
+	case 43:
+		return &conn43{c, pinger{c}, execer{c}, sessionResetter{c}, connBeginTx{c}}
+	case 44:
+		return &conn44{c, queryer{c}, sessionResetter{c}, connBeginTx{c}}
+	case 45:
+		return &conn45{c, pinger{c}, queryer{c}, sessionResetter{c}, connBeginTx{c}}
+	case 46:
+		return &conn46{c, execer{c}, queryer{c}, sessionResetter{c}, connBeginTx{c}}
+	case 47:
+		return &conn47{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}, connBeginTx{c}}
+	case 48:
+		return &conn48{c, namedValueChecker{c}, connBeginTx{c}}
+	case 49:
+		return &conn49{c, pinger{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 50:
+		return &conn50{c, execer{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 51:
+		return &conn51{c, pinger{c}, execer{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 52:
+		return &conn52{c, queryer{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 53:
+		return &conn53{c, pinger{c}, queryer{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 54:
+		return &conn54{c, execer{c}, queryer{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 55:
+		return &conn55{c, pinger{c}, execer{c}, queryer{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 56:
+		return &conn56{c, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 57:
+		return &conn57{c, pinger{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 58:
+		return &conn58{c, execer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 59:
+		return &conn59{c, pinger{c}, execer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 60:
+		return &conn60{c, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 61:
+		return &conn61{c, pinger{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 62:
+		return &conn62{c, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 63:
+		return &conn63{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}}
+	case 64:
+		return &conn64{c, connPrepareContext{c}}
+	case 65:
+		return &conn65{c, pinger{c}, connPrepareContext{c}}
+	case 66:
+		return &conn66{c, execer{c}, connPrepareContext{c}}
+	case 67:
+		return &conn67{c, pinger{c}, execer{c}, connPrepareContext{c}}
+	case 68:
+		return &conn68{c, queryer{c}, connPrepareContext{c}}
+	case 69:
+		return &conn69{c, pinger{c}, queryer{c}, connPrepareContext{c}}
+	case 70:
+		return &conn70{c, execer{c}, queryer{c}, connPrepareContext{c}}
+	case 71:
+		return &conn71{c, pinger{c}, execer{c}, queryer{c}, connPrepareContext{c}}
+	case 72:
+		return &conn72{c, sessionResetter{c}, connPrepareContext{c}}
+	case 73:
+		return &conn73{c, pinger{c}, sessionResetter{c}, connPrepareContext{c}}
+	case 74:
+		return &conn74{c, execer{c}, sessionResetter{c}, connPrepareContext{c}}
+	case 75:
+		return &conn75{c, pinger{c}, execer{c}, sessionResetter{c}, connPrepareContext{c}}
+	case 76:
+		return &conn76{c, queryer{c}, sessionResetter{c}, connPrepareContext{c}}
+	case 77:
+		return &conn77{c, pinger{c}, queryer{c}, sessionResetter{c}, connPrepareContext{c}}
+	case 78:
+		return &conn78{c, execer{c}, queryer{c}, sessionResetter{c}, connPrepareContext{c}}
+	case 79:
+		return &conn79{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}, connPrepareContext{c}}
+	case 80:
+		return &conn80{c, namedValueChecker{c}, connPrepareContext{c}}
+	case 81:
+		return &conn81{c, pinger{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 82:
+		return &conn82{c, execer{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 83:
+		return &conn83{c, pinger{c}, execer{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 84:
+		return &conn84{c, queryer{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 85:
+		return &conn85{c, pinger{c}, queryer{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 86:
+		return &conn86{c, execer{c}, queryer{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 87:
+		return &conn87{c, pinger{c}, execer{c}, queryer{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 88:
+		return &conn88{c, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 89:
+		return &conn89{c, pinger{c}, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 90:
+		return &conn90{c, execer{c}, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 91:
+		return &conn91{c, pinger{c}, execer{c}, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 92:
+		return &conn92{c, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 93:
+		return &conn93{c, pinger{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 94:
+		return &conn94{c, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 95:
+		return &conn95{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connPrepareContext{c}}
+	case 96:
+		return &conn96{c, connBeginTx{c}, connPrepareContext{c}}
+	case 97:
+		return &conn97{c, pinger{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 98:
+		return &conn98{c, execer{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 99:
+		return &conn99{c, pinger{c}, execer{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 100:
+		return &conn100{c, queryer{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 101:
+		return &conn101{c, pinger{c}, queryer{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 102:
+		return &conn102{c, execer{c}, queryer{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 103:
+		return &conn103{c, pinger{c}, execer{c}, queryer{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 104:
+		return &conn104{c, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 105:
+		return &conn105{c, pinger{c}, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 106:
+		return &conn106{c, execer{c}, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 107:
+		return &conn107{c, pinger{c}, execer{c}, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 108:
+		return &conn108{c, queryer{c}, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 109:
+		return &conn109{c, pinger{c}, queryer{c}, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 110:
+		return &conn110{c, execer{c}, queryer{c}, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 111:
+		return &conn111{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 112:
+		return &conn112{c, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 113:
+		return &conn113{c, pinger{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 114:
+		return &conn114{c, execer{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 115:
+		return &conn115{c, pinger{c}, execer{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 116:
+		return &conn116{c, queryer{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 117:
+		return &conn117{c, pinger{c}, queryer{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 118:
+		return &conn118{c, execer{c}, queryer{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 119:
+		return &conn119{c, pinger{c}, execer{c}, queryer{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 120:
+		return &conn120{c, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 121:
+		return &conn121{c, pinger{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 122:
+		return &conn122{c, execer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 123:
+		return &conn123{c, pinger{c}, execer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 124:
+		return &conn124{c, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 125:
+		return &conn125{c, pinger{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 126:
+		return &conn126{c, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	case 127:
+		return &conn127{c, pinger{c}, execer{c}, queryer{c}, sessionResetter{c}, namedValueChecker{c}, connBeginTx{c}, connPrepareContext{c}}
+	}
+	panic("clustersql: invalid interface mask")
+}
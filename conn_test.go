@@ -0,0 +1,271 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fullConn implements all optional interfaces known to the wrapper.
+type fullConn struct {
+	fakeConn
+	pinged int
+}
+
+func (c *fullConn) Ping(ctx context.Context) error {
+	c.pinged++
+	return nil
+}
+func (c *fullConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (c *fullConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+func (c *fullConn) ResetSession(ctx context.Context) error     { return nil }
+func (c *fullConn) CheckNamedValue(v *driver.NamedValue) error { return nil }
+func (c *fullConn) IsValid() bool                              { return true }
+func (c *fullConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Prepare(query)
+}
+func (c *fullConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Begin()
+}
+
+// pingQueryConn only implements Pinger and Queryer.
+type pingQueryConn struct{ fakeConn }
+
+func (c *pingQueryConn) Ping(ctx context.Context) error { return nil }
+func (c *pingQueryConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+// validatorConn only implements Validator.
+type validatorConn struct{ fakeConn }
+
+func (c *validatorConn) IsValid() bool { return false }
+
+func TestWrapPreservesInterfaces(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a")
+	n := d.nodes["a"]
+	for _, up := range []driver.Conn{&fakeConn{}, &fullConn{}, &pingQueryConn{}, &validatorConn{}} {
+		c := d.wrap(up, n)
+		if got, want := interfaces(c), interfaces(up); got != want {
+			t.Errorf("%T: wrapper implements interfaces %07b, upstream %07b", up, got, want)
+		}
+		c.Close()
+	}
+
+	full := &fullConn{}
+	c := d.wrap(full, n)
+	c.(driver.Pinger).Ping(context.Background())
+	if full.pinged != 1 {
+		t.Error("Ping not forwarded")
+	}
+	if res, err := c.(driver.Execer).Exec("", nil); err != nil || res != driver.RowsAffected(1) {
+		t.Errorf("Exec not forwarded: %v, %v", res, err)
+	}
+	if c.(driver.Validator).IsValid() != true || d.wrap(&validatorConn{}, n).(driver.Validator).IsValid() != false {
+		t.Error("IsValid not forwarded")
+	}
+	if v, ok := d.wrap(&fakeConn{}, n).(driver.Validator); !ok || !v.IsValid() {
+		t.Error("wrapper of a conn without IsValid is not valid")
+	}
+}
+
+func TestMaxConnAge(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := newTestDriver(newFakeDriver(), "a", "b")
+	d.now = func() time.Time { return now }
+	a := d.wrap(&fakeConn{}, d.nodes["a"]).(driver.Validator)
+	b := d.wrap(&fakeConn{}, d.nodes["b"]).(driver.Validator)
+
+	now = now.Add(time.Hour)
+	if !a.IsValid() || !b.IsValid() {
+		t.Error("connections aged out without a maximum age")
+	}
+
+	d.SetMaxConnAge(2 * time.Hour)
+	if !a.IsValid() {
+		t.Error("connection aged out before its time")
+	}
+	now = now.Add(time.Hour)
+	if a.IsValid() || b.IsValid() {
+		t.Error("connections did not age out")
+	}
+
+	// a node setting takes precedence
+	d.SetMaxConnAge(0)
+	if err := d.SetNodeMaxConnAge("b", 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsValid() {
+		t.Error("a aged out without a maximum age")
+	}
+	if b.IsValid() {
+		t.Error("b did not age out")
+	}
+	if err := d.SetNodeMaxConnAge("c", time.Minute); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("expected ErrUnknownNode, got %v", err)
+	}
+}
+
+func TestExposeAllCombinations(t *testing.T) {
+	c := &conn{Conn: &fullConn{}}
+	for mask := uint(0); mask < 1<<7; mask++ {
+		if got := interfaces(expose(c, mask)); got != mask {
+			t.Errorf("expose(%07b) implements %07b", mask, got)
+		}
+	}
+}
+
+// ctxConn only supports the context aware fast paths, and no prepared statements.
+type ctxConn struct {
+	fakeConn
+	execs, queries int
+}
+
+func (c *ctxConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.execs++
+	return driver.RowsAffected(len(args)), nil
+}
+
+func (c *ctxConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.queries++
+	return &fakeRows{values: []string{query}}, nil
+}
+
+// bareConn has no fast paths at all.
+type bareConn struct{ driver.Conn }
+
+func TestContextFastPaths(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a")
+	n := d.nodes["a"]
+	up := &ctxConn{}
+	c := d.wrap(up, n)
+
+	res, err := c.(driver.ExecerContext).ExecContext(context.Background(), "DELETE", []driver.NamedValue{{Ordinal: 1, Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := res.RowsAffected(); affected != 1 || up.execs != 1 {
+		t.Errorf("ExecContext not forwarded")
+	}
+	if _, err := c.(driver.QueryerContext).QueryContext(context.Background(), "SELECT", nil); err != nil || up.queries != 1 {
+		t.Errorf("QueryContext not forwarded: %v", err)
+	}
+
+	// database/sql uses them instead of preparing statements, which ctxConn does not support
+	d.SetDialMiddleware(func(func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(string) (driver.Conn, error) { return up, nil }
+	})
+	connector, _ := d.OpenConnector("")
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if _, err := db.Exec("DELETE FROM t WHERE id = ?", 1); err != nil {
+		t.Errorf("db.Exec: %v", err)
+	}
+	var got string
+	if err := db.QueryRow("SELECT 1").Scan(&got); err != nil || got != "SELECT 1" {
+		t.Errorf("db.QueryRow: %q, %v", got, err)
+	}
+
+	// the plain fast paths are used if there are no context aware ones
+	plain := d.wrap(&fakeConn{}, n)
+	if _, err := plain.(driver.ExecerContext).ExecContext(context.Background(), "DELETE", nil); err != nil {
+		t.Errorf("Exec not used: %v", err)
+	}
+	if _, err := plain.(driver.QueryerContext).QueryContext(context.Background(), "SELECT", []driver.NamedValue{{Name: "x"}}); err == nil {
+		t.Error("named parameters passed to Query")
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := plain.(driver.ExecerContext).ExecContext(canceled, "DELETE", nil); err != context.Canceled {
+		t.Errorf("got %v for a canceled context, want %v", err, context.Canceled)
+	}
+
+	// without any, database/sql falls back to preparing
+	bare := d.wrap(bareConn{&fakeConn{}}, n)
+	if _, err := bare.(driver.ExecerContext).ExecContext(context.Background(), "DELETE", nil); err != driver.ErrSkip {
+		t.Errorf("got %v, want driver.ErrSkip", err)
+	}
+	if _, err := bare.(driver.QueryerContext).QueryContext(context.Background(), "SELECT", nil); err != driver.ErrSkip {
+		t.Errorf("got %v, want driver.ErrSkip", err)
+	}
+}
+
+func TestLiveConnections(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	start := time.Unix(1000, 0)
+	d.now = func() time.Time { return start }
+	if got := d.LiveConnections(); len(got) != 0 {
+		t.Fatalf("live connections before Open: %v", got)
+	}
+	var conns []driver.Conn
+	var nodes []string
+	for _, name := range []string{"a", "b", "a"} {
+		name := name
+		c, err := d.openConn(context.Background(), func(n *node) bool { return n.Name == name })
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+		nodes = append(nodes, name)
+	}
+	d.now = func() time.Time { return start.Add(time.Minute) }
+	if _, err := conns[1].(driver.Execer).Exec("SELECT 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	live := d.LiveConnections()
+	if len(live) != 3 {
+		t.Fatalf("got %d live connections, want 3: %v", len(live), live)
+	}
+	for i, info := range live {
+		if info.Node != nodes[i] || !info.Opened.Equal(start) {
+			t.Errorf("connection %d: got %+v, want node %s opened at %v", i, info, nodes[i], start)
+		}
+		if i > 0 && info.ID <= live[i-1].ID {
+			t.Errorf("connections not ordered by ID: %v", live)
+		}
+	}
+	if !live[1].LastUsed.Equal(start.Add(time.Minute)) || !live[0].LastUsed.Equal(start) {
+		t.Errorf("LastUsed not tracked: %v", live)
+	}
+
+	conns[0].Close()
+	live = d.LiveConnections()
+	if len(live) != 2 || live[0].Node != "b" || live[1].Node != "a" {
+		t.Errorf("after Close: %v", live)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LabelApplier tags a newly opened upstream connection with labels, see
+// SetConnectionLabels.
+type LabelApplier func(ctx context.Context, conn driver.Conn, labels map[string]string) error
+
+// MySQLLabelApplier is the default LabelApplier. It sets a user variable per label, in
+// a single statement like
+//
+//	SET @app = 'billing', @instance = 'web-3'
+//
+// which DBAs can look up per connection in performance_schema.user_variables_by_thread.
+// Label names must consist of letters, digits, '_', '.' and '$' only. Connection
+// attributes, which show up in performance_schema.session_connect_attrs, can only be
+// set when connecting; with Go-MySQL, use its connectionAttributes DSN parameter.
+func MySQLLabelApplier(ctx context.Context, conn driver.Conn, labels map[string]string) error {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name == "" || strings.TrimLeft(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_.$") != "" {
+			return fmt.Errorf("clustersql: invalid connection label name %q", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	vars := make([]string, len(names))
+	for i, name := range names {
+		vars[i] = fmt.Sprintf("@%s = '%s'", name, mysqlEscaper.Replace(labels[name]))
+	}
+	return exec(ctx, conn, "SET "+strings.Join(vars, ", "))
+}
+
+// mysqlEscaper escapes strings to be quoted with single quotes in MySQL.
+var mysqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// exec runs query on conn, preparing it if conn can't run it right away.
+func exec(ctx context.Context, conn driver.Conn, query string) error {
+	_, err := execContext(ctx, conn, query, nil)
+	if err == driver.ErrSkip {
+		var stmt driver.Stmt
+		if stmt, err = conn.Prepare(query); err != nil {
+			return err
+		}
+		defer stmt.Close()
+		_, err = stmt.Exec(nil)
+	}
+	return err
+}
+
+// SetConnectionLabels makes every newly opened upstream connection be tagged with a copy
+// of labels, like the name and instance of the application, so DBAs can see who is
+// connecting. They are applied by the LabelApplier set with SetConnectionLabelApplier,
+// MySQLLabelApplier by default, before the hook set with SetConnInit runs. If applying
+// them fails, the connection is closed and counts as a failure to open the node, like a
+// failing hook. nil or an empty map turns it off.
+func (d *Driver) SetConnectionLabels(labels map[string]string) {
+	d.mu.Lock()
+	d.connLabels = copyStrings(labels)
+	d.mu.Unlock()
+}
+
+// SetConnectionLabelApplier replaces the function applying the labels set with
+// SetConnectionLabels, for backends other than MySQL. nil restores the default,
+// MySQLLabelApplier.
+func (d *Driver) SetConnectionLabelApplier(apply LabelApplier) {
+	d.mu.Lock()
+	d.labelApplier = apply
+	d.mu.Unlock()
+}
+
+// applyLabels applies the connection labels, if any, to conn.
+func (d *Driver) applyLabels(ctx context.Context, conn driver.Conn) error {
+	d.mu.Lock()
+	labels, apply := d.connLabels, d.labelApplier
+	d.mu.Unlock()
+	if len(labels) == 0 {
+		return nil
+	}
+	if apply == nil {
+		apply = MySQLLabelApplier
+	}
+	if err := apply(ctx, conn, labels); err != nil {
+		return fmt.Errorf("clustersql: connection labels: %w", err)
+	}
+	return nil
+}
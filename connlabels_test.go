@@ -0,0 +1,84 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestConnectionLabels(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	labels := map[string]string{"app": "billing", "instance": "o'brien"}
+	d.SetConnectionLabels(labels)
+	labels["app"] = "changed later"
+
+	for i := 0; i < 2; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	set := `SET @app = 'billing', @instance = 'o\'brien'`
+	if got, want := up.executed("a"), []string{set, set}; !reflect.DeepEqual(got, want) {
+		t.Errorf("executed %q, want %q", got, want)
+	}
+
+	var applied map[string]string
+	d.SetConnectionLabelApplier(func(ctx context.Context, conn driver.Conn, labels map[string]string) error {
+		applied = labels
+		return nil
+	})
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if want := map[string]string{"app": "billing", "instance": "o'brien"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied %v, want %v", applied, want)
+	}
+
+	errApply := errors.New("no such variable")
+	d.SetConnectionLabelApplier(func(ctx context.Context, conn driver.Conn, labels map[string]string) error {
+		return errApply
+	})
+	if _, err := d.Open(""); !errors.Is(err, errApply) {
+		t.Errorf("got %v, want the error of the applier", err)
+	}
+}
+
+func TestMySQLLabelApplierInvalidName(t *testing.T) {
+	conn := &fakeConn{dsn: "a"}
+	if err := MySQLLabelApplier(context.Background(), conn, map[string]string{"app = 1; DROP TABLE t; --": "x"}); err == nil {
+		t.Error("invalid label name accepted")
+	}
+}
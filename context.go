@@ -0,0 +1,97 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import "context"
+
+type ctxKey int
+
+const (
+	routingKeyCtx ctxKey = iota
+	balancerCtx
+	minReplicationPosCtx
+	readPreferenceCtx
+	readIntentCtx  // set by openFor for connections used for reads
+	writeIntentCtx // set by openFor for connections used for writes
+	forcedNodeCtx
+	consistentReadCtx
+	maxAttemptsCtx
+	openTraceCtx // set by openConn for the slow Open log, see SetSlowOpenLog
+)
+
+// WithRoutingKey returns a copy of ctx carrying key. Balancers with affinity, like
+// ConsistentHash, route connections opened with the same key to the same node.
+func WithRoutingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routingKeyCtx, key)
+}
+
+// RoutingKey returns the key set with WithRoutingKey, if any.
+func RoutingKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(routingKeyCtx).(string)
+	return key, ok
+}
+
+// WithBalancer returns a copy of ctx making connections opened with it use b instead
+// of the Balancer set on the Driver.
+func WithBalancer(ctx context.Context, b Balancer) context.Context {
+	return context.WithValue(ctx, balancerCtx, b)
+}
+
+// WithMinReplicationPos returns a copy of ctx requiring connections opened with it to
+// go to nodes that have applied at least pos, e.g. a GTID set. See SetReplicationGate.
+func WithMinReplicationPos(ctx context.Context, pos string) context.Context {
+	return context.WithValue(ctx, minReplicationPosCtx, pos)
+}
+
+// WithForcedNode returns a copy of ctx making connections opened with it go to the node
+// called name, and only there: there is no failover, and Balancer, canaries, shadows and
+// read/write split mode are bypassed. Opening fails if the node is not registered or
+// cannot be reached. This is an escape hatch for operators, e.g. to verify maintenance
+// on a single node; sql.DB.Conn gets a connection that sticks to it.
+func WithForcedNode(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, forcedNodeCtx, name)
+}
+
+// WithConsistentRead returns a copy of ctx making statements run with it in read/write
+// split mode go to the connection for writes, i.e. a primary, even if they are reads. This
+// is for reads that must not see a replica lagging behind.
+func WithConsistentRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistentReadCtx, true)
+}
+
+// WithMaxAttempts returns a copy of ctx making Open give up on a connection opened with
+// it after n nodes failed to open, even if more nodes remain, bounding the time spent on
+// failover in big clusters. Retries (see SetRetry) count against the same n. n <= 0
+// means no limit, which is the default.
+func WithMaxAttempts(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxAttemptsCtx, n)
+}
+
+// maxAttempts returns the limit set with WithMaxAttempts, or 0.
+func maxAttempts(ctx context.Context) int {
+	n, _ := ctx.Value(maxAttemptsCtx).(int)
+	return n
+}
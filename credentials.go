@@ -0,0 +1,105 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CredentialRewriter returns dsn changed to log in as user with password, see
+// RotateCredentials.
+type CredentialRewriter func(dsn, user, password string) (string, error)
+
+// MySQLCredentialRewriter is the CredentialRewriter for Go-MySQL style DSNs
+// ([user[:password]@][net[(addr)]]/dbname[?params]). It is used by RotateCredentials
+// unless SetCredentialRewriter is called.
+func MySQLCredentialRewriter(dsn, user, password string) (string, error) {
+	if strings.IndexByte(user, ':') >= 0 {
+		return "", fmt.Errorf("clustersql: user %q contains ':'", user)
+	}
+	userinfo := user
+	if password != "" {
+		userinfo += ":" + password
+	}
+	if userinfo != "" {
+		userinfo += "@"
+	}
+	return userinfo + dsn[userinfoEnd(dsn)+1:], nil
+}
+
+// credentials are the user and password set by RotateCredentials.
+type credentials struct {
+	user, password string
+}
+
+// SetCredentialRewriter sets the CredentialRewriter used by RotateCredentials.
+func (d *Driver) SetCredentialRewriter(r CredentialRewriter) {
+	d.mu.Lock()
+	d.credentialRewriter = r
+	d.mu.Unlock()
+}
+
+// RotateCredentials changes the user and password in the DSN of every node, through the
+// CredentialRewriter. Either all DSNs are changed or, if rewriting one of them fails,
+// none. Connections opened from then on use the new credentials; open connections are
+// not affected and keep working until they are closed. Nodes stay registered as they
+// are, including their expvar counters. Nodes added by discovery later on get the new
+// credentials as well, see SetDiscovery.
+func (d *Driver) RotateCredentials(user, password string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := &credentials{user, password}
+	dsns := map[*node]string{}
+	for name, n := range d.nodes {
+		if n == nil {
+			continue
+		}
+		dsn, err := d.rewriteCredentials(n.DSN, c)
+		if err != nil {
+			return fmt.Errorf("clustersql: node %q: %w", name, err)
+		}
+		dsns[n] = dsn
+	}
+	for n, dsn := range dsns {
+		n.DSN = dsn
+	}
+	d.credentials = c
+	return nil
+}
+
+// rewriteCredentials returns dsn changed to log in with c, through the CredentialRewriter,
+// or dsn as is if c is nil. The caller must hold d.mu.
+func (d *Driver) rewriteCredentials(dsn string, c *credentials) (string, error) {
+	if c == nil {
+		return dsn, nil
+	}
+	rewrite := d.credentialRewriter
+	if rewrite == nil {
+		rewrite = MySQLCredentialRewriter
+	}
+	return rewrite(dsn, c.user, c.password)
+}
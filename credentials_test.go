@@ -0,0 +1,114 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"testing"
+)
+
+func TestRotateCredentials(t *testing.T) {
+	up := newFakeDriver()
+	old := map[string]string{
+		"galera1": "user:old@tcp(dbhost1:3306)/db",
+		"galera2": "user:o@ld@tcp(dbhost2:3306)/db?parseTime=true",
+	}
+	d := newTestDriver(up)
+	for name, dsn := range old {
+		up.node(dsn, nil, 0)
+		d.AddNode(name, dsn)
+	}
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := d.nodes[c.(wrapped).base().n.Name].exp
+
+	if err := d.RotateCredentials("us:er", "new"); err == nil {
+		t.Error("expected an error for a user containing ':'")
+	}
+	for name, dsn := range old {
+		if got := d.nodes[name].DSN; got != dsn {
+			t.Errorf("%s: DSN = %q after a failed rotation, want %q", name, got, dsn)
+		}
+	}
+
+	if err := d.RotateCredentials("admin", "n3w@pass"); err != nil {
+		t.Fatal(err)
+	}
+	rotated := map[string]string{
+		"galera1": "admin:n3w@pass@tcp(dbhost1:3306)/db",
+		"galera2": "admin:n3w@pass@tcp(dbhost2:3306)/db?parseTime=true",
+	}
+	for name, want := range rotated {
+		if got := d.nodes[name].DSN; got != want {
+			t.Errorf("%s: DSN = %q, want %q", name, got, want)
+		}
+		up.node(want, nil, 0)
+	}
+
+	// the open connection keeps working and counting where it did
+	if _, err := c.(driver.Queryer).Query("SELECT 1", nil); err != nil {
+		t.Errorf("query on the old connection: %v", err)
+	}
+	c.Close()
+	if got := d.nodes[c.(wrapped).base().n.Name].exp; got != exp {
+		t.Error("the expvar map of the node was replaced")
+	}
+	if got := exp.Get("Connections").(*expvar.Int).Value(); got != 1 {
+		t.Errorf("Connections = %d, want 1 to be kept", got)
+	}
+
+	// new connections log in with the new credentials only
+	before := map[string]int{}
+	for name, dsn := range old {
+		before[name] = up.dialed(dsn)
+	}
+	c, err = d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	dialed := 0
+	for name, dsn := range old {
+		if up.dialed(dsn) != before[name] {
+			t.Errorf("%s: dialed with the old credentials", name)
+		}
+		dialed += up.dialed(rotated[name])
+	}
+	if dialed == 0 {
+		t.Error("not dialed with the new credentials")
+	}
+
+	d.SetCredentialRewriter(func(dsn, user, password string) (string, error) {
+		return "", errors.New("no")
+	})
+	if err := d.RotateCredentials("admin", "newer"); err == nil {
+		t.Error("expected the error of the rewriter")
+	}
+}
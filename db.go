@@ -0,0 +1,116 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+)
+
+// Option configures the Driver of a ClusterDB, see Open. Any setter of Driver can be
+// used, like
+//
+//	func(d *clustersql.Driver) error { return d.SetShadowNode("galera3", 0.01) }
+//
+// An error makes Open fail with it.
+type Option func(d *Driver) error
+
+// ClusterDB is a sql.DB backed by a cluster, along with its Driver, see Open.
+type ClusterDB struct {
+	*sql.DB
+	Driver *Driver
+}
+
+// Open sets up a Driver using upstream, with nodes and opts applied in this order, and
+// returns a sql.DB using it, without the need to register it with database/sql. The
+// variables of the driver are published in expvar as name, see NewNamedDriver; "" keeps
+// them private, see NewPrivateDriver. As with sql.Open, no connection is opened yet. If an
+// option fails, the Driver is closed and its error returned.
+func Open(name string, upstream driver.Driver, nodes []NodeConfig, opts ...Option) (*ClusterDB, error) {
+	if err := checkNesting(upstream); err != nil {
+		return nil, err
+	}
+	var d *Driver
+	if name != "" {
+		var err error
+		if d, err = NewNamedDriver(upstream, name); err != nil {
+			return nil, err
+		}
+	} else {
+		d = NewPrivateDriver(upstream)
+	}
+	for _, n := range nodes {
+		d.AddNode(n.Name, n.DSN)
+	}
+	for _, opt := range opts {
+		if err := opt(d); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return &ClusterDB{DB: sql.OpenDB(connector{d}), Driver: d}, nil
+}
+
+// Healthy reports whether the cluster can take connections, i.e. its State is not Down.
+func (db *ClusterDB) Healthy() bool {
+	return db.Driver.State() != Down
+}
+
+// ClusterStats takes a snapshot of the statistics of the Driver, like SetSnapshotHook
+// does. Unlike sql.DB.Stats, which it doesn't replace, it is about the nodes.
+func (db *ClusterDB) ClusterStats() ClusterStats {
+	return db.Driver.stats()
+}
+
+// NodeStatus returns the health and counters of the registered nodes, by name.
+func (db *ClusterDB) NodeStatus() map[string]NodeStats {
+	return db.Driver.stats().Nodes
+}
+
+// StatusHandler returns an http.Handler serving the health of the cluster as JSON, like
+//
+//	{"State":"degraded","Total":3,"Healthy":2,"Unhealthy":1,"Nodes":{"galera1":true,...}}
+//
+// with status 200, or 503 if the cluster is down, for use as a readiness probe.
+func (db *ClusterDB) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := db.Driver.summarizeHealth()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if h.state() == Down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
+
+// Close closes the sql.DB, then the Driver, see Driver.Close.
+func (db *ClusterDB) Close() error {
+	err := db.DB.Close()
+	db.Driver.Close()
+	return err
+}
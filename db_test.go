@@ -0,0 +1,100 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOpenClusterDB(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	name := "TestOpen" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	db, err := Open(name, up, []NodeConfig{{"a", "a"}, {"b", "b"}}, func(d *Driver) error {
+		d.SetFanout(1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if expvar.Get(name) == nil || db.Driver.DumpConfig().Fanout != 1 {
+		t.Error("name or options not applied")
+	}
+	if _, err := Open(name, up, nil); !errors.Is(err, ErrExpvarNameTaken) {
+		t.Errorf("got %v, want ErrExpvarNameTaken", err)
+	}
+	shadow := func(d *Driver) error { return d.SetShadowNode("c", 1) }
+	if _, err := Open("", up, []NodeConfig{{"a", "a"}}, shadow); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("failing option: got %v, want ErrUnknownNode", err)
+	}
+
+	var dsn string
+	if err := db.QueryRow("SELECT @@hostname").Scan(&dsn); err != nil || dsn != "a" {
+		t.Errorf("query: %q, %v", dsn, err)
+	}
+
+	db.Driver.PingAll(context.Background())
+	if !db.Healthy() {
+		t.Error("degraded cluster reported unhealthy")
+	}
+	status := db.NodeStatus()
+	if !status["a"].Healthy || status["b"].Healthy || status["a"].Counters["Connections"] < 1 {
+		t.Errorf("NodeStatus = %+v", status)
+	}
+	if stats := db.ClusterStats(); stats.State != Degraded || stats.OpenBreakers != 1 {
+		t.Errorf("ClusterStats = %+v", stats)
+	}
+
+	serve := func() (int, healthSummary) {
+		rec := httptest.NewRecorder()
+		db.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		var h healthSummary
+		if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, h
+	}
+	if code, h := serve(); code != http.StatusOK || h.State != "degraded" || h.Healthy != 1 || h.Nodes["b"] {
+		t.Errorf("status %d: %+v", code, h)
+	}
+	up.node("a", errFakeUnreachable, 0)
+	db.Driver.PingAll(context.Background())
+	if db.Healthy() {
+		t.Error("cluster down, but reported healthy")
+	}
+	if code, h := serve(); code != http.StatusServiceUnavailable || h.State != "down" {
+		t.Errorf("status %d: %+v", code, h)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import "time"
+
+// NodeDefaults are the settings nodes start out with, see SetNodeDefaults. Zero values
+// leave the usual defaults in place.
+type NodeDefaults struct {
+	Weight      int           // see SetNodeWeight; 0 means 1
+	MaxConns    int           // see SetNodeMaxConns
+	DialTimeout time.Duration // overrides SetDialTimeout, like AddNodeWithTimeout
+	Role        Role          // see SetNodeRole
+}
+
+// SetNodeDefaults sets the defaults for the nodes added afterwards, with AddNode or any
+// of its variants, to save configuring each node of a homogeneous cluster alike. What a
+// variant sets explicitly, like the timeout of AddNodeWithTimeout, takes precedence, and
+// the per-node setters override the defaults as usual. Nodes already registered are not
+// affected.
+func (d *Driver) SetNodeDefaults(defaults NodeDefaults) {
+	d.mu.Lock()
+	d.nodeDefaults = defaults
+	d.mu.Unlock()
+}
+
+// apply sets up n with the defaults, where n has no setting of its own.
+func (defaults NodeDefaults) apply(n *node) {
+	n.weight = 1
+	if defaults.Weight > 0 {
+		n.weight = defaults.Weight
+	}
+	if n.maxConns == 0 {
+		n.maxConns = defaults.MaxConns
+	}
+	if n.dialTimeout == 0 {
+		n.dialTimeout = defaults.DialTimeout
+	}
+	if n.role == RoleAny {
+		n.role = defaults.Role
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"sort"
+	"time"
+)
+
+// dialStrategy tells dial how to open a connection to one of a list of nodes.
+type dialStrategy struct {
+	fanout int // how many nodes are dialed at the same time, at least 1
+	// failFast makes the first node be dialed alone, the others only once it failed
+	// without a final outcome, see SetFailFast.
+	failFast bool
+
+	// reserve is called before dialing a node, which is skipped if it returns false.
+	reserve func(n *node) bool
+	// dial opens a connection to n. It runs in a goroutine of its own.
+	dial func(ctx context.Context, n *node) (driver.Conn, error)
+	// result is called with the outcome of every dial as it arrives. It returns the
+	// outcome to go on with, and whether it is final; if not, the next node is dialed.
+	result func(n *node, conn driver.Conn, err error) (driver.Conn, error, bool)
+	// discard is called for the outcome of dials still in progress when dial returns.
+	discard func(n *node, conn driver.Conn)
+
+	// window is how long to wait for more connections after the first one, to pick the
+	// best of them, see SetSelectWindow. 0 goes with the first one.
+	window time.Duration
+	// pick returns the index of the connection to go on with among those in nodes.
+	pick func(nodes []*node) int
+	// release is called for the connections not picked.
+	release func(n *node, conn driver.Conn)
+}
+
+// dial coordinates the parallel dials of Open: it dials nodes in order, s.fanout at a
+// time, starting the next one whenever a dial ends without a final outcome. It returns
+// the first final outcome, along with its node. If there is none, it returns the error
+// of the last dial, or ErrNodesAtLimit if no node could be reserved. If ctx is done
+// before, its error is returned right away. If the first final outcome is a connection
+// and s.window is set, it waits up to that long for the dials in progress to succeed as
+// well, without starting new ones, and returns the connection s.pick picks among them,
+// releasing the others.
+//
+// The outcomes are passed on a channel with room for one per node, so no dial ever waits
+// for dial to pick up its outcome. Those still in progress when dial returns are
+// discarded in a goroutine of their own. A single node is dialed right away instead if
+// ctx can't be done, as there is nothing to coordinate and nothing to wait for but the
+// dial, sparing single-node clusters the goroutine and the channel.
+func dial(ctx context.Context, nodes []*node, s dialStrategy) (driver.Conn, *node, error) {
+	if len(nodes) == 1 && ctx.Done() == nil {
+		n := nodes[0]
+		if !s.reserve(n) {
+			return nil, nil, ErrNodesAtLimit
+		}
+		conn, err := s.dial(ctx, n)
+		conn, err, final := s.result(n, conn, err)
+		if final {
+			return conn, n, err
+		}
+		return nil, nil, err
+	}
+	type outcome struct {
+		conn driver.Conn
+		err  error
+		n    *node
+	}
+	cc := make(chan outcome, len(nodes))
+	next, pending := 0, 0
+	defer func() {
+		if pending == 0 {
+			return
+		}
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				o := <-cc
+				s.discard(o.n, o.conn)
+			}
+		}(pending)
+	}()
+	// start dials the next node that can be reserved, if any
+	start := func() bool {
+		for next < len(nodes) {
+			n := nodes[next]
+			next++
+			if !s.reserve(n) {
+				continue
+			}
+			pending++
+			go func(n *node) {
+				conn, err := s.dial(ctx, n)
+				cc <- outcome{conn, err, n}
+			}(n)
+			return true
+		}
+		return false
+	}
+	first := s.fanout
+	if s.failFast {
+		first = 1
+	}
+	for pending < first && start() {
+	}
+	err := ErrNodesAtLimit
+	for pending > 0 {
+		var o outcome
+		select {
+		case o = <-cc:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		pending--
+		conn, oerr, final := s.result(o.n, o.conn, o.err)
+		if final && oerr == nil && s.window > 0 && pending > 0 {
+			conns, nodes := []driver.Conn{conn}, []*node{o.n}
+			timer := time.NewTimer(s.window)
+		collect:
+			for pending > 0 {
+				select {
+				case o = <-cc:
+				case <-timer.C:
+					break collect
+				case <-ctx.Done():
+					break collect
+				}
+				pending--
+				if conn, err, final := s.result(o.n, o.conn, o.err); final && err == nil {
+					conns, nodes = append(conns, conn), append(nodes, o.n)
+				}
+			}
+			timer.Stop()
+			best := s.pick(nodes)
+			for i, conn := range conns {
+				if i != best {
+					s.release(nodes[i], conn)
+				}
+			}
+			return conns[best], nodes[best], nil
+		}
+		if final {
+			return conn, o.n, oerr
+		}
+		err = oerr
+		for pending < s.fanout && start() {
+		}
+	}
+	return nil, nil, err
+}
+
+// dialTiers dials nodes tier by tier, all nodes of a tier in parallel, see Tiered.
+// Within a tier, the order of nodes is kept.
+func dialTiers(ctx context.Context, nodes []*node, s dialStrategy) (driver.Conn, *node, error) {
+	tiers := map[int][]*node{}
+	var order []int
+	for _, n := range nodes {
+		if _, ok := tiers[n.tier]; !ok {
+			order = append(order, n.tier)
+		}
+		tiers[n.tier] = append(tiers[n.tier], n)
+	}
+	sort.Ints(order)
+	err := ErrNodesAtLimit
+	for _, tier := range order {
+		s.fanout = len(tiers[tier])
+		conn, n, terr := dial(ctx, tiers[tier], s)
+		if n != nil || ctx.Err() != nil {
+			return conn, n, terr
+		}
+		if terr != ErrNodesAtLimit {
+			err = terr
+		}
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,406 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialScript is a dialStrategy for tests: every node answers with a connection or its
+// error, once its gate is closed if it has one, and every outcome is final unless it is
+// an error.
+type dialScript struct {
+	mu        sync.Mutex
+	gates     map[string]chan struct{}
+	errs      map[string]error
+	dialed    []string
+	results   []string
+	discarded []string
+}
+
+func (s *dialScript) strategy(fanout int) dialStrategy {
+	return dialStrategy{
+		fanout:  fanout,
+		reserve: func(n *node) bool { return n.maxConns >= 0 },
+		dial: func(ctx context.Context, n *node) (driver.Conn, error) {
+			s.mu.Lock()
+			s.dialed = append(s.dialed, n.Name)
+			gate, err := s.gates[n.Name], s.errs[n.Name]
+			s.mu.Unlock()
+			if gate != nil {
+				<-gate
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &fakeConn{dsn: n.Name}, nil
+		},
+		result: func(n *node, conn driver.Conn, err error) (driver.Conn, error, bool) {
+			s.mu.Lock()
+			s.results = append(s.results, n.Name)
+			s.mu.Unlock()
+			return conn, err, err == nil
+		},
+		discard: func(n *node, conn driver.Conn) {
+			s.mu.Lock()
+			s.discarded = append(s.discarded, n.Name)
+			s.mu.Unlock()
+		},
+	}
+}
+
+// gatedScript returns a dialScript holding back the named nodes until their gates are closed.
+func gatedScript(names ...string) *dialScript {
+	s := &dialScript{gates: map[string]chan struct{}{}, errs: map[string]error{}}
+	for _, name := range names {
+		s.gates[name] = make(chan struct{})
+	}
+	return s
+}
+
+// wait waits up to a second for the list picked from s to have count entries, and
+// returns a copy of it.
+func (s *dialScript) wait(list *[]string, count int) []string {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		got := append([]string(nil), *list...)
+		s.mu.Unlock()
+		if len(got) >= count || time.Now().After(deadline) {
+			return got
+		}
+	}
+}
+
+// waitDiscarded waits up to a second for count outcomes to be discarded, and returns
+// the nodes they came from.
+func (s *dialScript) waitDiscarded(count int) []string {
+	return s.wait(&s.discarded, count)
+}
+
+// dialOutcome is what dial returned.
+type dialOutcome struct {
+	conn driver.Conn
+	n    *node
+	err  error
+}
+
+// dialAsync runs dial in the background, returning the channel its outcome is sent to.
+func dialAsync(ctx context.Context, nodes []*node, s dialStrategy) chan dialOutcome {
+	done := make(chan dialOutcome, 1)
+	go func() {
+		conn, n, err := dial(ctx, nodes, s)
+		done <- dialOutcome{conn, n, err}
+	}()
+	return done
+}
+
+func dialNodes(names ...string) []*node {
+	nodes := make([]*node, len(names))
+	for i, name := range names {
+		nodes[i] = &node{Name: name}
+	}
+	return nodes
+}
+
+func TestDialFirstSuccess(t *testing.T) {
+	s := gatedScript("slow", "fast", "unused")
+	s.errs["broken"] = errFakeUnreachable
+	done := dialAsync(context.Background(), dialNodes("slow", "broken", "fast", "unused"), s.strategy(3))
+	// broken failing starts the last one
+	if dialed := s.wait(&s.dialed, 4); len(dialed) != 4 {
+		t.Fatalf("dialed %v", dialed)
+	}
+	close(s.gates["fast"])
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.n.Name != "fast" || res.conn.(*fakeConn).dsn != "fast" {
+		t.Errorf("got %s, want fast", res.n.Name)
+	}
+	// the others lose, in the order they answer
+	close(s.gates["unused"])
+	s.waitDiscarded(1)
+	close(s.gates["slow"])
+	if discarded := s.waitDiscarded(2); !reflect.DeepEqual(discarded, []string{"unused", "slow"}) {
+		t.Errorf("discarded %v", discarded)
+	}
+}
+
+func TestDialAllFail(t *testing.T) {
+	errLast := errors.New("last")
+	s := gatedScript("b")
+	s.errs["a"], s.errs["b"] = errFakeUnreachable, errLast
+	done := dialAsync(context.Background(), dialNodes("a", "b"), s.strategy(2))
+	s.wait(&s.results, 1)
+	close(s.gates["b"])
+	if res := <-done; res.err != errLast {
+		t.Errorf("got %v, want the error of the last dial", res.err)
+	}
+	if len(s.discarded) != 0 {
+		t.Errorf("discarded %v", s.discarded)
+	}
+
+	// nodes that can't be reserved are skipped
+	s = &dialScript{errs: map[string]error{"a": errFakeUnreachable}}
+	nodes := dialNodes("full", "a")
+	nodes[0].maxConns = -1
+	if _, _, err := dial(context.Background(), nodes[:1], s.strategy(1)); err != ErrNodesAtLimit {
+		t.Errorf("got %v, want ErrNodesAtLimit", err)
+	}
+	if _, _, err := dial(context.Background(), nodes, s.strategy(1)); err != errFakeUnreachable || len(s.dialed) != 1 {
+		t.Errorf("got %v dialing %v", err, s.dialed)
+	}
+}
+
+func TestDialCancel(t *testing.T) {
+	s := gatedScript("a", "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := dialAsync(ctx, dialNodes("a", "b"), s.strategy(2))
+	s.wait(&s.dialed, 2)
+	cancel()
+	// dial returns while both nodes are still held back
+	if res := <-done; res.err != context.Canceled {
+		t.Errorf("got %v, want the context's error", res.err)
+	}
+	close(s.gates["a"])
+	close(s.gates["b"])
+	// the dials in progress are cleaned up
+	if discarded := s.waitDiscarded(2); len(discarded) != 2 {
+		t.Errorf("discarded %v, want both", discarded)
+	}
+}
+
+// BenchmarkOpenConcurrent opens connections to a cluster of eight nodes from many goroutines
+// at once; every Open dials all nodes and discards all connections but the first.
+func BenchmarkOpenConcurrent(b *testing.B) {
+	f := newFakeDriver()
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, name := range names {
+		f.node(name, nil, 0)
+	}
+	d := newTestDriver(f, names...)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c, err := d.Open("")
+			if err != nil {
+				b.Fatal(err)
+			}
+			c.Close()
+		}
+	})
+}
+
+func TestSelectWindow(t *testing.T) {
+	for _, window := range []time.Duration{0, time.Minute} {
+		window := window
+		up := newFakeDriver()
+		up.node("busy", nil, 0)
+		up.node("spare", nil, 0)
+		d := newTestDriver(up)
+		d.AddNodeWithCapacity("busy", "busy", 10)
+		d.AddNodeWithCapacity("spare", "spare", 10)
+		d.nodes["busy"].live = 8
+		d.SetSelectWindow(window)
+		// without window, spare answers only once busy won
+		release := make(chan struct{})
+		d.SetDialMiddleware(func(next func(dsn string) (driver.Conn, error)) func(dsn string) (driver.Conn, error) {
+			return func(dsn string) (driver.Conn, error) {
+				if dsn == "spare" && window == 0 {
+					<-release
+				}
+				return next(dsn)
+			}
+		})
+
+		start := time.Now()
+		c, err := connector{d}.Connect(context.Background())
+		close(release)
+		if err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		got := c.(wrapped).base().n.Name
+		c.Close()
+		if window == 0 {
+			if got != "busy" {
+				t.Errorf("without window: got %s, want the first to answer, busy", got)
+			}
+			continue
+		}
+		if got != "spare" {
+			t.Errorf("with window: got %s, want the one with more spare capacity, spare", got)
+		}
+		if elapsed >= window {
+			t.Errorf("with window: took %v, want less than the window as all dials answered", elapsed)
+		}
+		busy := d.nodes["busy"]
+		if v := busy.exp.Get("OutScored"); v == nil || v.String() != "1" {
+			t.Errorf("busy: OutScored = %v, want 1", v)
+		}
+		d.mu.Lock()
+		live := busy.live
+		d.mu.Unlock()
+		if live != 8 {
+			t.Errorf("busy: %d live connections, want 8", live)
+		}
+		if name, _ := d.LastSuccessfulNode(); name != "spare" {
+			t.Errorf("LastSuccessfulNode = %s, want spare", name)
+		}
+	}
+}
+
+// closingConn is a connection whose Close is done by close.
+type closingConn struct {
+	driver.Conn
+	close func() error
+}
+
+func (c closingConn) Close() error {
+	return c.close()
+}
+
+func TestCloseLoser(t *testing.T) {
+	errClose := errors.New("close failed")
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	for _, blocking := range []bool{true, false} {
+		blocking := blocking
+		up := newFakeDriver()
+		up.node("winner", nil, 0)
+		up.node("loser", nil, 0)
+		d := newTestDriver(up, "winner", "loser")
+		d.loserCloseTimeout = time.Minute
+		if blocking {
+			d.loserCloseTimeout = 10 * time.Millisecond
+		}
+		// the loser answers only once the winner was handed out
+		lost := make(chan struct{})
+		d.SetDialMiddleware(func(next func(dsn string) (driver.Conn, error)) func(dsn string) (driver.Conn, error) {
+			return func(dsn string) (driver.Conn, error) {
+				if dsn == "loser" {
+					<-lost
+				}
+				c, err := next(dsn)
+				if err != nil || dsn != "loser" {
+					return c, err
+				}
+				return closingConn{c, func() error {
+					if blocking {
+						<-unblock
+					}
+					return errClose
+				}}, nil
+			}
+		})
+
+		c, err := connector{d}.Connect(context.Background())
+		close(lost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != "winner" {
+			t.Fatalf("got %s, want winner", got)
+		}
+		c.Close()
+
+		counter, other := "CloseErrors", "CloseTimeouts"
+		if blocking {
+			counter, other = other, counter
+		}
+		loser := d.nodes["loser"]
+		deadline := time.Now().Add(5 * time.Second)
+		for loser.exp.Get(counter) == nil && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if v := loser.exp.Get(counter); v == nil || v.String() != "1" {
+			t.Errorf("blocking %t: %s = %v, want 1", blocking, counter, v)
+		}
+		if v := loser.exp.Get(other); v != nil && v.String() != "0" {
+			t.Errorf("blocking %t: %s = %v, want none", blocking, other, v)
+		}
+	}
+}
+
+// BenchmarkOpenSingleNode compares opening connections to a single node through the fast
+// path of dial, taken with a context that can't be done, and through the general one.
+func BenchmarkOpenSingleNode(b *testing.B) {
+	f := newFakeDriver()
+	f.node("a", nil, 0)
+	d := newTestDriver(f, "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, bm := range []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"fast", context.Background()},
+		{"general", ctx},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c, err := connector{d}.Connect(bm.ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				c.Close()
+			}
+		})
+	}
+}
+
+func TestSingleNodeRejected(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	d.SetReplicationGate(func(ctx context.Context, conn driver.Conn, minPos string) (bool, error) {
+		return false, nil
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := connector{d}.Connect(WithMinReplicationPos(context.Background(), "x"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrReplicationBehind {
+			t.Errorf("got %v, want ErrReplicationBehind", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect hangs")
+	}
+}
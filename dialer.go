@@ -0,0 +1,101 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrNoDialRegistrar is returned by SetNodeDialer if no DialRegistrar has been set.
+var ErrNoDialRegistrar = errors.New("clustersql: no dial registrar set")
+
+// DialFunc opens a network connection, like the DialContext method of net.Dialer.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialRegistrar makes dial known to the upstream driver under key and returns dsn
+// changed to refer to it. As upstream drivers own dialing, they usually keep custom dial
+// functions in a registry of their own, see MySQLDialRegistrar for the Go-MySQL driver.
+type DialRegistrar func(dsn, key string, dial DialFunc) (string, error)
+
+// MySQLDialRegistrar returns a DialRegistrar for Go-MySQL style DSNs. register must
+// call mysql.RegisterDialContext, which can't be passed directly as its signature uses a
+// named type:
+//
+//	clustersql.MySQLDialRegistrar(func(network string, dial func(context.Context, string) (net.Conn, error)) {
+//		mysql.RegisterDialContext(network, dial)
+//	})
+//
+// The key replaces the network of the DSN, like tcp in user:password@tcp(host:3306)/db;
+// the dial function is called with the network replaced.
+func MySQLDialRegistrar(register func(network string, dial func(ctx context.Context, addr string) (net.Conn, error))) DialRegistrar {
+	return func(dsn, key string, dial DialFunc) (string, error) {
+		dsn, network := setDSNNet(dsn, key)
+		register(key, func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		})
+		return dsn, nil
+	}
+}
+
+// SetDialRegistrar sets the DialRegistrar used by SetNodeDialer.
+func (d *Driver) SetDialRegistrar(r DialRegistrar) {
+	d.mu.Lock()
+	d.dialRegistrar = r
+	d.mu.Unlock()
+}
+
+// SetNodeDialer has the named Node connect using dial, registered with the upstream driver
+// through the DialRegistrar under a key unique to d and the node, like
+// "clustersql-<n>-<name>", see SetNodeTLS. This allows e.g. going
+// through a SOCKS proxy or binding to a specific source address, per node. Calling it again
+// replaces the dial function, which keeps being called with the original network.
+func (d *Driver) SetNodeDialer(name string, dial DialFunc) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	if d.dialRegistrar == nil {
+		return ErrNoDialRegistrar
+	}
+	key, dsn := d.registryKey(name), n.DSN
+	if n.network != "" {
+		// registered before: the registrar would take the key for the network to dial
+		dsn, _ = setDSNNet(dsn, n.network)
+	}
+	registered, err := d.dialRegistrar(dsn, key, dial)
+	if err != nil {
+		return err
+	}
+	if _, network := setDSNNet(registered, key); network == key && n.network == "" {
+		_, n.network = setDSNNet(n.DSN, key)
+	}
+	n.DSN = registered
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSetNodeDialer(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	d.AddNode("galera1", "user:pass@tcp(dbhost1:3306)/db")
+	d.AddNode("galera2", "user:p@ss/word@/db?parseTime=true")
+	d.AddNode("galera3", "unix(/var/run/mysqld.sock)/db")
+
+	dialed := map[string][]string{}
+	dialer := func(name string) DialFunc {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed[name] = append(dialed[name], network+" "+addr)
+			return nil, errors.New("stub")
+		}
+	}
+	if err := d.SetNodeDialer("galera1", dialer("galera1")); err != ErrNoDialRegistrar {
+		t.Errorf("expected ErrNoDialRegistrar, got %v", err)
+	}
+
+	registered := map[string]func(ctx context.Context, addr string) (net.Conn, error){}
+	d.SetDialRegistrar(MySQLDialRegistrar(func(network string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+		registered[network] = dial
+	}))
+	for _, name := range []string{"galera1", "galera2", "galera3"} {
+		if err := d.SetNodeDialer(name, dialer(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"galera1": "user:pass@" + d.registryKey("galera1") + "(dbhost1:3306)/db",
+		"galera2": "user:p@ss/word@" + d.registryKey("galera2") + "(127.0.0.1:3306)/db?parseTime=true",
+		"galera3": d.registryKey("galera3") + "(/var/run/mysqld.sock)/db",
+	} {
+		if got := d.nodes[name].DSN; got != want {
+			t.Errorf("%s: DSN = %q, want %q", name, got, want)
+		}
+	}
+	for name, addr := range map[string]string{
+		"galera1": "dbhost1:3306",
+		"galera2": "127.0.0.1:3306",
+		"galera3": "/var/run/mysqld.sock",
+	} {
+		dial := registered[d.registryKey(name)]
+		if dial == nil {
+			t.Fatalf("no dial function registered for %s", name)
+		}
+		dialed = map[string][]string{}
+		dial(context.Background(), addr)
+		want := "tcp " + addr
+		if name == "galera3" {
+			want = "unix " + addr
+		}
+		if len(dialed) != 1 || len(dialed[name]) != 1 || dialed[name][0] != want {
+			t.Errorf("%s: dialed %v, want %q through its own dialer", name, dialed, want)
+		}
+	}
+
+	// registering again keeps the original network
+	if err := d.SetNodeDialer("galera3", dialer("galera3")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.nodes["galera3"].DSN, d.registryKey("galera3")+"(/var/run/mysqld.sock)/db"; got != want {
+		t.Errorf("galera3: DSN = %q after registering again, want %q", got, want)
+	}
+	dialed = map[string][]string{}
+	registered[d.registryKey("galera3")](context.Background(), "/var/run/mysqld.sock")
+	if got := dialed["galera3"]; len(got) != 1 || got[0] != "unix /var/run/mysqld.sock" {
+		t.Errorf("galera3: dialed %v after registering again, want the unix network", got)
+	}
+
+	if err := d.SetNodeDialer("nope", dialer("nope")); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("expected ErrUnknownNode, got %v", err)
+	}
+}
+
+func TestSetNodeDialerTwoDrivers(t *testing.T) {
+	// the registry of the upstream driver is shared by all Drivers in the process
+	registered := map[string]func(ctx context.Context, addr string) (net.Conn, error){}
+	register := MySQLDialRegistrar(func(network string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+		registered[network] = dial
+	})
+	var dialed []string
+	var drivers []*Driver
+	for _, proxy := range []string{"one", "two"} {
+		proxy := proxy
+		d := NewPrivateDriver(newFakeDriver())
+		d.AddNode("galera1", "user:pass@tcp(dbhost1:3306)/db")
+		d.SetDialRegistrar(register)
+		err := d.SetNodeDialer("galera1", func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, proxy)
+			return nil, errors.New("stub")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		drivers = append(drivers, d)
+	}
+	if len(registered) != 2 {
+		t.Fatalf("%d dial functions registered, want 2", len(registered))
+	}
+	for i, proxy := range []string{"one", "two"} {
+		d := drivers[i]
+		key := d.registryKey("galera1")
+		if dsn := d.nodes["galera1"].DSN; !strings.Contains(dsn, "@"+key+"(") {
+			t.Errorf("driver %d: DSN %q does not refer to %q", i, dsn, key)
+		}
+		dialed = nil
+		registered[key](context.Background(), "dbhost1:3306")
+		if len(dialed) != 1 || dialed[0] != proxy {
+			t.Errorf("driver %d: dialed through %v, want %q", i, dialed, proxy)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// errNoMembers is counted as a discovery error, see SetDiscovery.
+var errNoMembers = errors.New("clustersql: discovery found no members")
+
+// discovery returns the current members of the cluster, see SetDiscovery and SetSRVDiscovery.
+type discovery func(ctx context.Context) ([]NodeConfig, error)
+
+// SetDiscovery makes the Driver learn the members of the cluster from the registered
+// node seedNode, every interval in the background, starting right away: query is run on
+// the seed, and parse turns its rows into the list of members, e.g. from Galera's
+// wsrep_incoming_addresses. Members not registered yet are added with AddNode; nodes
+// added by discovery that are no longer members are removed with DelNode, which lets
+// their connections finish. A member whose DSN changed is removed and added again;
+// changes made to the DSN of a node here, like by RotateCredentials or SetNodeTLS, do
+// not count, and members are added with the credentials of RotateCredentials, if called.
+// Nodes added otherwise, like the seed, are left alone, and so are members pointing to
+// the same host:port as another node.
+//
+// Failures, including an empty list of members, leave the nodes as they are. They are
+// counted as DiscoveryErrors in the expvar map of the driver, and the last one is
+// published as LastDiscoveryError. An interval of 0 stops discovery. SetDiscovery
+// replaces discovery set up with SetSRVDiscovery, and vice versa.
+func (d *Driver) SetDiscovery(seedNode string, query string, parse func(rows driver.Rows) ([]NodeConfig, error), interval time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if interval > 0 && d.nodes[seedNode] == nil {
+		d.startDiscovery(nil, 0)
+		return unknownNode(seedNode)
+	}
+	d.startDiscovery(d.seedDiscovery(seedNode, query, parse), interval)
+	return nil
+}
+
+// seedDiscovery returns the discovery of SetDiscovery.
+func (d *Driver) seedDiscovery(seedNode string, query string, parse func(rows driver.Rows) ([]NodeConfig, error)) discovery {
+	return func(ctx context.Context) (members []NodeConfig, err error) {
+		d.mu.Lock()
+		seed := d.nodes[seedNode]
+		d.mu.Unlock()
+		if seed == nil {
+			return nil, unknownNode(seedNode)
+		}
+		err = d.queryNode(ctx, seed, query, nil, func(rows driver.Rows) (err error) {
+			members, err = parse(rows)
+			return err
+		})
+		return members, err
+	}
+}
+
+// SRVTarget is a target of a DNS SRV record, see SetSRVDiscovery.
+type SRVTarget struct {
+	Host string // without the trailing dot
+	Port uint16
+}
+
+// SetSRVDiscovery is like SetDiscovery, but learns the members of the cluster from the
+// DNS SRV records of service, like _mysql._tcp.db.example.com, looked up with resolver
+// (net.DefaultResolver if nil). Every target becomes a node named host:port, with the DSN
+// rendered from dsnTemplate, a text/template executed with an SRVTarget, like
+// "user:password@tcp({{.Host}}:{{.Port}})/db". An invalid template is returned as error.
+func (d *Driver) SetSRVDiscovery(service string, resolver *net.Resolver, dsnTemplate string, interval time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if interval <= 0 {
+		d.startDiscovery(nil, 0)
+		return nil
+	}
+	tmpl, err := template.New("dsn").Parse(dsnTemplate)
+	if err != nil {
+		d.startDiscovery(nil, 0)
+		return err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	d.startDiscovery(srvDiscovery(service, resolver, tmpl), interval)
+	return nil
+}
+
+// srvDiscovery returns the discovery of SetSRVDiscovery.
+func srvDiscovery(service string, resolver *net.Resolver, tmpl *template.Template) discovery {
+	return func(ctx context.Context) ([]NodeConfig, error) {
+		_, records, err := resolver.LookupSRV(ctx, "", "", service)
+		if err != nil {
+			return nil, err
+		}
+		var members []NodeConfig
+		for _, r := range records {
+			target := SRVTarget{Host: strings.TrimSuffix(r.Target, "."), Port: r.Port}
+			var dsn strings.Builder
+			if err := tmpl.Execute(&dsn, target); err != nil {
+				return nil, err
+			}
+			name := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+			members = append(members, NodeConfig{Name: name, DSN: dsn.String()})
+		}
+		return members, nil
+	}
+}
+
+// startDiscovery stops discovery, if running, and starts running disc every interval,
+// unless interval is 0 or the Driver is closed. d.mu must be held.
+func (d *Driver) startDiscovery(disc discovery, interval time.Duration) {
+	if d.stopDiscovery != nil {
+		close(d.stopDiscovery)
+		d.stopDiscovery = nil
+	}
+	if interval <= 0 || d.closed {
+		return
+	}
+	stop := make(chan struct{})
+	d.stopDiscovery = stop
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			d.discover(ctx, disc)
+			cancel()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// discover updates the nodes to the members of the cluster as found by disc.
+func (d *Driver) discover(ctx context.Context, disc discovery) error {
+	members, err := disc(ctx)
+	if err == nil && len(members) == 0 {
+		err = errNoMembers
+	}
+	if err != nil {
+		return d.discoveryFailed(err)
+	}
+
+	current := map[string]string{}
+	for _, m := range members {
+		current[m.Name] = m.DSN
+	}
+	d.mu.Lock()
+	var gone []string
+	var added []NodeConfig
+	for name, dsn := range d.discovered {
+		if n := d.nodes[name]; n == nil || current[name] != dsn {
+			gone = append(gone, name)
+		}
+	}
+	for _, m := range members {
+		dsn, ok := d.discovered[m.Name]
+		if n := d.nodes[m.Name]; n == nil || ok && dsn != m.DSN {
+			if !d.duplicate(m, gone, added) {
+				added = append(added, m)
+			}
+		}
+	}
+	dsns := map[string]string{}
+	for _, m := range added {
+		if dsns[m.Name], err = d.rewriteCredentials(m.DSN, d.credentials); err != nil {
+			d.mu.Unlock()
+			return d.discoveryFailed(fmt.Errorf("clustersql: member %q: %w", m.Name, err))
+		}
+	}
+	d.mu.Unlock()
+	for _, name := range gone {
+		d.DelNode(name)
+		d.mu.Lock()
+		delete(d.discovered, name)
+		d.mu.Unlock()
+	}
+	for _, m := range added {
+		d.AddNode(m.Name, dsns[m.Name])
+		d.mu.Lock()
+		if d.discovered == nil {
+			d.discovered = map[string]string{}
+		}
+		d.discovered[m.Name] = m.DSN
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// discoveryFailed counts the failed discovery, records err in expvar and returns it.
+func (d *Driver) discoveryFailed(err error) error {
+	d.count(nil, "DiscoveryErrors")
+	Err := new(expvar.String)
+	Err.Set(err.Error())
+	d.exp.Set("LastDiscoveryError", Err)
+	return err
+}
+
+// duplicate reports whether the address of the member m is already served by
+// another node, either one that stays registered or one about to be added, so
+// that a node registered by hand is not dialed twice under its discovered name.
+// The caller must hold d.mu.
+func (d *Driver) duplicate(m NodeConfig, gone []string, added []NodeConfig) bool {
+nodes:
+	for name, n := range d.nodes {
+		if n == nil || name == m.Name || !sameAddr(n.DSN, m.DSN) {
+			continue
+		}
+		for _, g := range gone {
+			if g == name {
+				continue nodes
+			}
+		}
+		return true
+	}
+	for _, a := range added {
+		if sameAddr(a.DSN, m.DSN) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// membersConn answers every query with one row per member, as "name=dsn".
+type membersConn struct {
+	fakeConn
+	members func() []string
+}
+
+func (c *membersConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{values: c.members()}, nil
+}
+
+func parseMembers(rows driver.Rows) ([]NodeConfig, error) {
+	var members []NodeConfig
+	dest := make([]driver.Value, 1)
+	for {
+		if err := rows.Next(dest); err == io.EOF {
+			return members, nil
+		} else if err != nil {
+			return nil, err
+		}
+		name, dsn, ok := strings.Cut(dest[0].(string), "=")
+		if !ok {
+			return nil, errors.New("bad member " + dest[0].(string))
+		}
+		members = append(members, NodeConfig{Name: name, DSN: dsn})
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "seed")
+	defer d.Close()
+	var mu sync.Mutex
+	members := []string{"seed=seed", "b=b"}
+	setMembers := func(m ...string) {
+		mu.Lock()
+		members = m
+		mu.Unlock()
+	}
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "seed" {
+				return &membersConn{members: func() []string {
+					mu.Lock()
+					defer mu.Unlock()
+					return append([]string(nil), members...)
+				}}, nil
+			}
+			return next(dsn)
+		}
+	})
+	nodes := func() []string {
+		var names []string
+		for _, n := range d.registered() {
+			names = append(names, n.Name+"="+n.DSN)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if err := d.SetDiscovery("nope", "SHOW STATUS", parseMembers, time.Hour); err == nil {
+		t.Error("SetDiscovery accepted an unknown seed")
+	}
+	// the first round runs right away
+	if err := d.SetDiscovery("seed", "SHOW STATUS LIKE 'wsrep_incoming_addresses'", parseMembers, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); len(nodes()) < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	d.SetDiscovery("", "", nil, 0)
+	if got, want := nodes(), []string{"b=b", "seed=seed"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("nodes %v, want %v", got, want)
+	}
+
+	disc := d.seedDiscovery("seed", "SHOW STATUS", parseMembers)
+	d.AddNode("static", "static")
+	d.AddNode("x", "u@tcp(db1:3306)/x")
+	for _, step := range []struct {
+		members []string
+		want    []string
+	}{
+		// a joins, b leaves, the static node stays
+		{[]string{"seed=seed", "c=c"}, []string{"c=c", "seed=seed", "static=static", "x=u@tcp(db1:3306)/x"}},
+		// c moves
+		{[]string{"c=c2"}, []string{"c=c2", "seed=seed", "static=static", "x=u@tcp(db1:3306)/x"}},
+		// the static node isn't replaced
+		{[]string{"c=c2", "static=other"}, []string{"c=c2", "seed=seed", "static=static", "x=u@tcp(db1:3306)/x"}},
+		// nor duplicated under another name
+		{[]string{"c=c2", "db1=tcp(DB1:3306)/"}, []string{"c=c2", "seed=seed", "static=static", "x=u@tcp(db1:3306)/x"}},
+		// members sharing an address are added once
+		{[]string{"c=c2", "d=tcp(d:3306)/", "e=u@tcp(d:3306)/"}, []string{"c=c2", "d=tcp(d:3306)/", "seed=seed", "static=static", "x=u@tcp(db1:3306)/x"}},
+	} {
+		setMembers(step.members...)
+		if err := d.discover(context.Background(), disc); err != nil {
+			t.Fatal(err)
+		}
+		if got := nodes(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("members %v: nodes %v, want %v", step.members, got, step.want)
+		}
+	}
+
+	// failures leave the nodes alone
+	setMembers()
+	if err := d.discover(context.Background(), disc); err != errNoMembers {
+		t.Errorf("got %v, want errNoMembers", err)
+	}
+	setMembers("garbage")
+	if err := d.discover(context.Background(), disc); err == nil {
+		t.Error("parse error ignored")
+	}
+	if got, want := nodes(), []string{"c=c2", "d=tcp(d:3306)/", "seed=seed", "static=static", "x=u@tcp(db1:3306)/x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes %v after failures, want %v", got, want)
+	}
+	if got := d.exp.Get("DiscoveryErrors").String(); got != "2" {
+		t.Errorf("DiscoveryErrors = %s, want 2", got)
+	}
+}
+
+func TestDiscoveryRewrittenDSN(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "seed")
+	defer d.Close()
+	members := []string{"b=b"}
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if strings.HasSuffix(dsn, "seed") { // rotated credentials included
+				return &membersConn{members: func() []string { return members }}, nil
+			}
+			return next(dsn)
+		}
+	})
+	d.SetTLSRegistrar(func(dsn, key string, config *tls.Config) (string, error) {
+		return dsn + "?tls=" + key, nil
+	})
+	d.SetCredentialRewriter(func(dsn, user, password string) (string, error) {
+		return user + "@" + dsn, nil
+	})
+	disc := d.seedDiscovery("seed", "SHOW STATUS", parseMembers)
+	if err := d.discover(context.Background(), disc); err != nil {
+		t.Fatal(err)
+	}
+	b := d.nodes["b"]
+	if err := d.SetNodeTLS("b", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RotateCredentials("u", "p"); err != nil {
+		t.Fatal(err)
+	}
+
+	members = []string{"b=b", "c=c"}
+	if err := d.discover(context.Background(), disc); err != nil {
+		t.Fatal(err)
+	}
+	if d.nodes["b"] != b {
+		t.Error("b was removed and added again")
+	}
+	if got, want := b.DSN, "u@b?tls="+d.registryKey("b"); got != want {
+		t.Errorf("DSN of b %q, want %q", got, want)
+	}
+	if got, want := d.nodes["c"].DSN, "u@c"; got != want {
+		t.Errorf("DSN of c %q, want %q", got, want)
+	}
+
+	// a member that really moves is still replaced
+	members = []string{"b=b2", "c=c"}
+	if err := d.discover(context.Background(), disc); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.nodes["b"].DSN, "u@b2"; got != want {
+		t.Errorf("DSN of moved b %q, want %q", got, want)
+	}
+}
+
+// srvResolver returns a resolver answering every query with SRV records for the targets,
+// given as host:port, returned by targets at the time.
+func srvResolver(targets func() []string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveSRV(server, targets())
+			return client, nil
+		},
+	}
+}
+
+// serveSRV answers a single DNS query read from conn, which is framed like over TCP, with
+// SRV records for targets.
+func serveSRV(conn net.Conn, targets []string) {
+	defer conn.Close()
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return
+	}
+	query := make([]byte, int(size[0])<<8|int(size[1]))
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return
+	}
+	// the question follows the 12 byte header: a name, then type and class
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	msg := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, byte(len(targets)), 0, 0, 0, 0}, query[12:end]...)
+	for _, target := range targets {
+		host, port, _ := net.SplitHostPort(target)
+		p, _ := strconv.Atoi(port)
+		rdata := []byte{0, 0, 0, 0, byte(p >> 8), byte(p)} // priority, weight, port
+		for _, label := range strings.Split(host, ".") {
+			rdata = append(append(rdata, byte(len(label))), label...)
+		}
+		rdata = append(rdata, 0)
+		// the name points to the question, type SRV, class IN, TTL 60s
+		msg = append(msg, 0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 60, byte(len(rdata)>>8), byte(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	conn.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	defer d.Close()
+	var mu sync.Mutex
+	targets := []string{"db1.example.com:3306", "db2.example.com:3307"}
+	setTargets := func(hosts ...string) {
+		mu.Lock()
+		targets = hosts
+		mu.Unlock()
+	}
+	resolver := srvResolver(func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return targets
+	})
+	nodes := func() []string {
+		var names []string
+		for _, n := range d.registered() {
+			names = append(names, n.Name+"="+n.DSN)
+		}
+		sort.Strings(names)
+		return names
+	}
+	const dsn = "user:pass@tcp({{.Host}}:{{.Port}})/db"
+
+	if err := d.SetSRVDiscovery("_mysql._tcp.example.com", resolver, "{{.Nope", time.Hour); err == nil {
+		t.Error("SetSRVDiscovery accepted an invalid template")
+	}
+	// the first round runs right away
+	if err := d.SetSRVDiscovery("_mysql._tcp.example.com", resolver, dsn, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"db1.example.com:3306=user:pass@tcp(db1.example.com:3306)/db",
+		"db2.example.com:3307=user:pass@tcp(db2.example.com:3307)/db",
+	}
+	for deadline := time.Now().Add(time.Second); len(nodes()) < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	d.SetSRVDiscovery("", nil, "", 0)
+	if got := nodes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("nodes %v, want %v", got, want)
+	}
+
+	tmpl := template.Must(template.New("dsn").Parse(dsn))
+	disc := srvDiscovery("_mysql._tcp.example.com", resolver, tmpl)
+	setTargets("db2.example.com:3307", "db3.example.com:3306")
+	if err := d.discover(context.Background(), disc); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"db2.example.com:3307=user:pass@tcp(db2.example.com:3307)/db",
+		"db3.example.com:3306=user:pass@tcp(db3.example.com:3306)/db",
+	}
+	if got := nodes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes %v after targets changed, want %v", got, want)
+	}
+
+	// losing all targets is taken as a failure
+	setTargets()
+	if err := d.discover(context.Background(), disc); err == nil {
+		t.Error("no targets accepted")
+	}
+	if got := nodes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes %v after a failure, want %v", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactDSN(t *testing.T) {
+	for _, tc := range []struct{ dsn, want string }{
+		{"user:pass@tcp(dbhost1:3306)/db", "user:xxxxx@tcp(dbhost1:3306)/db"},
+		{"user:pass@tcp([2001:db8::1]:3306)/db", "user:xxxxx@tcp([2001:db8::1]:3306)/db"},
+		{"user:pa:s@s@tcp([2001:db8::1]:3306)/db?tls=true", "user:xxxxx@tcp([2001:db8::1]:3306)/db?tls=true"},
+		{"user@tcp([2001:db8::1]:3306)/db", "user@tcp([2001:db8::1]:3306)/db"},
+		{"tcp([::1]:3306)/db", "tcp([::1]:3306)/db"},
+		{"user:pass@unix(/tmp/mysql.sock)/db", "user:xxxxx@unix(/tmp/mysql.sock)/db"},
+		{"postgres://user:pass@[2001:db8::1]:5432/db", "postgres://user:xxxxx@[2001:db8::1]:5432/db"},
+	} {
+		if got := redactDSN(tc.dsn); got != tc.want {
+			t.Errorf("redactDSN(%q) = %q, want %q", tc.dsn, got, tc.want)
+		}
+	}
+}
+
+func TestDSNAddr(t *testing.T) {
+	for _, tc := range []struct{ dsn, want string }{
+		{"user:pass@tcp(dbhost1:3306)/db", "dbhost1:3306"},
+		{"user:pass@tcp(DBHost1:3306)/db", "dbhost1:3306"},
+		{"user:pass@tcp([2001:db8::1]:3306)/db", "[2001:db8::1]:3306"},
+		{"user:p@ss@tcp([2001:0db8:0::1]:3306)/db", "[2001:db8::1]:3306"},
+		{"tcp([::1])/db", "[::1]"},
+		{"postgres://user:pass@[2001:db8::1]:5432/db", "[2001:db8::1]:5432"},
+	} {
+		if got, ok := dsnAddr(tc.dsn); !ok || got != tc.want {
+			t.Errorf("dsnAddr(%q) = %q, %t, want %q", tc.dsn, got, ok, tc.want)
+		}
+	}
+	if got, ok := dsnAddr("user:pass@/db"); ok {
+		t.Errorf("dsnAddr without address returned %q", got)
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	if !sameAddr("a:x@tcp([2001:db8::1]:3306)/db1", "b:y@tcp([2001:0db8::0001]:3306)/db2") {
+		t.Error("equivalent IPv6 literals not detected as duplicates")
+	}
+	if sameAddr("a:x@tcp([2001:db8::1]:3306)/db", "a:x@tcp([2001:db8::1]:3307)/db") {
+		t.Error("different ports detected as duplicates")
+	}
+	if sameAddr("a:x@tcp([2001:db8::1]:3306)/db", "a:x@tcp([2001:db8::2]:3306)/db") {
+		t.Error("different hosts detected as duplicates")
+	}
+}
+
+func TestAddNodeSameAddr(t *testing.T) {
+	d := newTestDriver(newFakeDriver())
+	defer d.Close()
+	l := &captureLogger{}
+	d.SetLogger(l)
+	d.AddNode("a", "a:x@tcp([2001:db8::1]:3306)/db1")
+	d.AddNode("other", "a:x@tcp([2001:db8::2]:3306)/db1")
+	if lines := l.logged(); len(lines) != 0 {
+		t.Errorf("logged %q for a distinct address", lines)
+	}
+	d.AddNode("dup", "b:y@tcp([2001:0db8::0001]:3306)/db2")
+	lines := l.logged()
+	if len(lines) != 1 || !strings.Contains(lines[0], "node dup points to the same address as node a") {
+		t.Errorf("logged %q, want the duplicate address", lines)
+	}
+}
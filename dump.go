@@ -0,0 +1,176 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DriverConfig is the effective configuration of a Driver, see DumpConfig. It is meant
+// to be marshalled, e.g. to JSON, for support tickets; durations are in nanoseconds.
+type DriverConfig struct {
+	Balancer             string // the type of the Balancer, like "clustersql.Weighted"
+	Fanout               int
+	WarmFanout           bool
+	SelectWindow         time.Duration
+	RetryAttempts        int
+	RetryBackoff         time.Duration
+	RetryMaxBackoff      time.Duration
+	HealthCheckInterval  time.Duration
+	PassiveHealth        bool
+	PingOnDial           bool
+	ReadWriteSplit       bool
+	StrictRouting        bool
+	ReadOnlyTxToReplicas bool
+	ReadOnlyFallback     bool
+	LazyConnections      bool
+	DialRateLimit        int // per second
+	SlowStart            time.Duration
+	FailbackDebounce     time.Duration
+	LocalZone            string
+	AdaptiveWeighting    bool
+	SlowDialThreshold    time.Duration
+	QueryTimeout         time.Duration
+	DialTimeout          time.Duration
+	SlowOpenLog          time.Duration
+	MaxConnAge           time.Duration
+	MaxTotalConns        int
+	MaxPendingOpens      int
+	MaxErrorNodes        int
+	FailFast             bool
+	KeepStatsOnReAdd     bool
+	ConnectionLabels     map[string]string
+	NodeDefaults         NodeDefaults
+	MetricsSink          string // the type of the MetricsSink
+	// Hooks lists the optional callbacks that are set, named after their setter
+	// without "Set", like "DSNProvider".
+	Hooks []string
+	Nodes []NodeSettings // ordered by name
+}
+
+// NodeSettings is the configuration of a node registered with a Driver.
+type NodeSettings struct {
+	Name        string
+	DSN         string // with the password redacted in DumpConfig
+	Weight      int
+	Capacity    int
+	Tier        int
+	MaxConns    int
+	MaxConnAge  time.Duration
+	DialTimeout time.Duration // see AddNodeWithTimeout
+	Role        Role
+	Labels      map[string]string
+	Meta        map[string]string // see AddNodeWithMeta
+	Canary      float64           // see AddCanaryNode
+	Shadow      float64           // see SetShadowNode
+}
+
+// DumpConfig returns the effective configuration of the Driver and its nodes, with the
+// passwords in DSNs redacted.
+func (d *Driver) DumpConfig() DriverConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := DriverConfig{
+		Balancer:             fmt.Sprintf("%T", d.balancer),
+		Fanout:               d.fanout,
+		WarmFanout:           d.warmFanout,
+		SelectWindow:         d.selectWindow,
+		RetryAttempts:        d.retry.attempts,
+		RetryBackoff:         d.retry.backoff,
+		RetryMaxBackoff:      d.retry.maxBackoff,
+		HealthCheckInterval:  d.healthInterval,
+		PassiveHealth:        d.passiveHealth,
+		PingOnDial:           d.pingOnDial,
+		ReadWriteSplit:       d.split,
+		StrictRouting:        d.strict,
+		ReadOnlyTxToReplicas: d.readOnlyTxToReplicas,
+		ReadOnlyFallback:     d.readOnlyFallback,
+		LazyConnections:      d.lazy,
+		SlowStart:            d.slowStart,
+		FailbackDebounce:     d.failbackDebounce,
+		LocalZone:            d.localZone,
+		AdaptiveWeighting:    d.adaptive,
+		SlowDialThreshold:    d.slowDialThreshold,
+		QueryTimeout:         d.queryTimeout,
+		DialTimeout:          d.dialTimeout,
+		SlowOpenLog:          d.slowOpen,
+		MaxConnAge:           d.maxConnAge,
+		MaxTotalConns:        d.maxTotalConns,
+		MaxPendingOpens:      d.maxPendingOpens,
+		MaxErrorNodes:        d.maxErrorNodes,
+		FailFast:             d.failFast,
+		KeepStatsOnReAdd:     d.keepStats,
+		ConnectionLabels:     copyStrings(d.connLabels),
+		NodeDefaults:         d.nodeDefaults,
+		MetricsSink:          fmt.Sprintf("%T", d.metrics),
+	}
+	if d.dialInterval > 0 {
+		c.DialRateLimit = int(time.Second / d.dialInterval)
+	}
+	for _, hook := range []struct {
+		name string
+		set  bool
+	}{
+		{"DSNProvider", d.dsnProvider != nil},
+		{"SelectionGuard", d.selectionGuard != nil},
+		{"ConnInit", d.connInit != nil},
+		{"ConnectionLabelApplier", d.labelApplier != nil},
+		{"ReplicationGate", d.replicationGate != nil},
+		{"WritableCheck", d.isReadOnly != nil},
+		{"PrimaryResolver", d.primaryResolver != nil},
+		{"ShadowDivergence", d.shadowReport != nil},
+		{"SnapshotHook", d.stopSnapshots != nil},
+		{"LoadProbe", d.loadProbe != nil},
+	} {
+		if hook.set {
+			c.Hooks = append(c.Hooks, hook.name)
+		}
+	}
+	for _, n := range d.nodes {
+		if n == nil {
+			continue
+		}
+		c.Nodes = append(c.Nodes, NodeSettings{
+			Name:        n.Name,
+			DSN:         redactDSN(n.DSN),
+			Weight:      n.weight,
+			Capacity:    n.capacity,
+			Tier:        n.tier,
+			MaxConns:    n.maxConns,
+			MaxConnAge:  n.maxConnAge,
+			DialTimeout: n.dialTimeout,
+			Role:        n.role,
+			Labels:      n.copyLabels(),
+			Meta:        copyStrings(n.meta),
+			Canary:      n.canary,
+			Shadow:      n.shadow,
+		})
+	}
+	sort.Slice(c.Nodes, func(i, j int) bool { return c.Nodes[i].Name < c.Nodes[j].Name })
+	return c
+}
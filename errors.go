@@ -0,0 +1,194 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// NodeError annotates an error of a connection with the node it happened on. Err can
+// be matched with errors.Is and errors.As through it.
+type NodeError struct {
+	Node string
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("clustersql: node %q: %v", e.Node, e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// IsNodeError is the default failure classifier. It considers network errors and
+// connections ending unexpectedly to be node-level errors, as opposed to errors about
+// the statement itself, like syntax errors or constraint violations, or the context
+// being done.
+func IsNodeError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// context.DeadlineExceeded is a net.Error, too
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// SetNodeErrorClassifier replaces the function deciding whether an error returned by
+// a connection is a node-level error. Those are wrapped in a NodeError, so logs show
+// where they happened; all other errors are returned as they are. Passing nil restores
+// the default, IsNodeError.
+//
+// driver.ErrBadConn is never wrapped, as database/sql relies on seeing it.
+func (d *Driver) SetNodeErrorClassifier(isNodeError func(err error) bool) {
+	if isNodeError == nil {
+		isNodeError = IsNodeError
+	}
+	d.mu.Lock()
+	d.isNodeError = isNodeError
+	d.mu.Unlock()
+}
+
+// IsFatalError is the default classifier of fatal errors, see SetFatalErrorClassifier.
+// It considers authentication failures fatal, recognizing MySQL's "Error 1045" (access
+// denied) in the message of the error.
+func IsFatalError(err error) bool {
+	return strings.Contains(err.Error(), "Error 1045")
+}
+
+// SetFatalErrorClassifier replaces the function deciding whether an error opening a
+// connection to a node is fatal, i.e. other nodes would fail the same way, like
+// authentication failures with credentials shared by all nodes. Open returns a fatal
+// error right away, without trying further nodes or retrying (see SetRetry), and
+// without marking the node unhealthy. Fatal errors are recorded for the node like other
+// errors, and counted as FatalErrors in its expvar map as well. Passing nil restores
+// the default, IsFatalError.
+func (d *Driver) SetFatalErrorClassifier(isFatal func(err error) bool) {
+	if isFatal == nil {
+		isFatal = IsFatalError
+	}
+	d.mu.Lock()
+	d.isFatal = isFatal
+	d.mu.Unlock()
+}
+
+// SetFailFast turns fail-fast mode on or off. In this mode, Open dials the first node in
+// the order of the Balancer alone, and only goes on to dial the others, in parallel as
+// usual, if it fails with an error that is not fatal (see SetFatalErrorClassifier). A
+// fatal error ends Open either way; what the mode changes is whether the other nodes
+// have been contacted by then. So if the nodes share a configuration that doesn't work,
+// like wrong credentials, Open fails without a single failed login on the others, which
+// may count towards blocking the client. This costs the latency of one failed dial
+// whenever the first node is unreachable.
+func (d *Driver) SetFailFast(enabled bool) {
+	d.mu.Lock()
+	d.failFast = enabled
+	d.mu.Unlock()
+}
+
+// fatal reports whether err, returned opening a connection, is fatal.
+func (d *Driver) fatal(err error) bool {
+	d.mu.Lock()
+	isFatal := d.isFatal
+	d.mu.Unlock()
+	return err != nil && isFatal(err)
+}
+
+// OpenError is returned by Open if no node could be opened and SetMaxErrorNodes is set.
+// It lists the errors of all nodes that failed, as *NodeError, which can be matched with
+// errors.Is and errors.As through it, and the nodes that were not even dialed, with the
+// reason and the state of the node, so that one line tells the posture of the whole
+// cluster, like
+//
+//	clustersql: 1 nodes failed: clustersql: node "a": connection refused; node "b": skipped
+//	(quarantined: disk replacement); node "c": skipped (left out by the balancer:
+//	unhealthy after 3 consecutive failures)
+//
+// Nodes the connection was not eligible for in the first place, like canaries, are not
+// listed as skipped.
+type OpenError struct {
+	Errs    []error
+	Skipped []RouteExclusion
+	Max     int // the number of errors, and of nodes skipped, shown in the message
+}
+
+func (e *OpenError) Error() string {
+	failed := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		failed[i] = err.Error()
+	}
+	skipped := make([]string, len(e.Skipped))
+	for i, s := range e.Skipped {
+		skipped[i] = s.String()
+	}
+	msgs := append(shorten(failed, e.Max), shorten(skipped, e.Max)...)
+	return fmt.Sprintf("clustersql: %d nodes failed: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// shorten returns the first max of msgs, followed by the number of the others.
+func shorten(msgs []string, max int) []string {
+	if len(msgs) <= max {
+		return msgs
+	}
+	return append(msgs[:max:max], fmt.Sprintf("... and %d more", len(msgs)-max))
+}
+
+func (e *OpenError) Unwrap() []error {
+	return e.Errs
+}
+
+// SetMaxErrorNodes makes Open, if no node could be opened, return an OpenError with the
+// errors of all nodes that failed and the nodes skipped, instead of the error of the last
+// one. Its message shows the errors of at most n nodes, and at most n nodes skipped, each
+// followed by the number of the others, so logs stay readable during an outage of a large
+// cluster; the last error of every node is published in its expvar map as usual. 0, the
+// default, turns this off.
+func (d *Driver) SetMaxErrorNodes(n int) {
+	d.mu.Lock()
+	d.maxErrorNodes = n
+	d.mu.Unlock()
+}
+
+// openError returns the error for Open failing with err, after errs of the failed nodes. trace
+// tells the nodes skipped, if not nil.
+func (d *Driver) openError(err error, errs []error, trace *RouteTrace) error {
+	d.mu.Lock()
+	max := d.maxErrorNodes
+	d.mu.Unlock()
+	if max <= 0 {
+		return err
+	}
+	e := &OpenError{Errs: errs, Max: max}
+	if trace != nil {
+		e.Skipped = trace.skipped()
+	}
+	return e
+}
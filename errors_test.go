@@ -0,0 +1,241 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// errConn fails every Exec with err.
+type errConn struct {
+	fakeConn
+	err error
+}
+
+func (c *errConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return nil, c.err
+}
+
+func TestNodeError(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "galera2")
+	errSyntax := errors.New("Error 1064: You have an error in your SQL syntax")
+	errNet := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	exec := func(err error) error {
+		c := d.wrap(&errConn{err: err}, d.nodes["galera2"])
+		defer c.Close()
+		_, err = c.(driver.ExecerContext).ExecContext(context.Background(), "UPDATE t SET x = 1", nil)
+		return err
+	}
+
+	err := exec(errNet)
+	if want := `clustersql: node "galera2": read tcp: connection reset by peer`; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	if !errors.Is(err, errNet) {
+		t.Error("errors.Is does not find the original error")
+	}
+	var nodeErr *NodeError
+	if !errors.As(err, &nodeErr) || nodeErr.Node != "galera2" {
+		t.Errorf("not a NodeError: %#v", err)
+	}
+	if err := exec(io.ErrUnexpectedEOF); !errors.As(err, &nodeErr) {
+		t.Errorf("unexpected EOF not annotated: %v", err)
+	}
+
+	for _, err := range []error{errSyntax, driver.ErrBadConn, driver.ErrSkip, context.DeadlineExceeded, context.Canceled} {
+		if got := exec(err); got != err {
+			t.Errorf("%v came back as %v", err, got)
+		}
+	}
+
+	d.SetNodeErrorClassifier(func(error) bool { return true })
+	if err := exec(errSyntax); !errors.As(err, &nodeErr) || !errors.Is(err, errSyntax) {
+		t.Errorf("custom classifier ignored: %v", err)
+	}
+	d.SetNodeErrorClassifier(nil)
+	if err := exec(errSyntax); err != errSyntax {
+		t.Errorf("default classifier not restored: %v", err)
+	}
+}
+
+func TestFatalErrors(t *testing.T) {
+	errAuth := errors.New("Error 1045 (28000): Access denied for user 'app'@'10.0.0.1' (using password: YES)")
+	up := newFakeDriver()
+	d := newTestDriver(up, "a", "b", "c")
+	for _, dsn := range []string{"a", "b", "c"} {
+		up.node(dsn, errAuth, 0)
+	}
+	d.SetFanout(1)
+	d.SetRetry(3, time.Second, 0)
+
+	start := time.Now()
+	if _, err := d.Open(""); err != errAuth {
+		t.Errorf("got %v, want the authentication failure", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Open took %v, it was retried", elapsed)
+	}
+	dials := 0
+	for _, name := range []string{"a", "b", "c"} {
+		dials += up.dialed(name)
+		if n := d.nodes[name]; !n.healthy || n.failures != 0 {
+			t.Errorf("%s marked unhealthy by an authentication failure", name)
+		}
+	}
+	if dials != 1 {
+		t.Errorf("%d nodes dialed, want 1", dials)
+	}
+	if v := d.exp.Get("Retries"); v != nil {
+		t.Errorf("Retries = %v", v)
+	}
+
+	// a custom classifier makes Open try every node
+	d.SetFatalErrorClassifier(func(error) bool { return false })
+	d.SetRetry(0, 0, 0)
+	if _, err := d.Open(""); err != errAuth {
+		t.Errorf("got %v, want the authentication failure", err)
+	}
+	if dials := up.dialed("a") + up.dialed("b") + up.dialed("c"); dials != 4 {
+		t.Errorf("%d dials, want 4", dials)
+	}
+	d.SetFatalErrorClassifier(nil)
+	if !d.fatal(errAuth) || d.fatal(errFakeUnreachable) {
+		t.Error("default classifier not restored")
+	}
+}
+
+func TestMaxErrorNodes(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	for i := 0; i < 10; i++ {
+		name := "n" + strconv.Itoa(i)
+		d.AddNode(name, name) // unknown to the fake, so unreachable
+	}
+
+	// by default, the error of the last node is returned
+	_, err := d.Open("")
+	if !errors.Is(err, errFakeUnreachable) || strings.Contains(err.Error(), "nodes failed") {
+		t.Errorf("got %v, want the error of a single node", err)
+	}
+
+	d.SetMaxErrorNodes(3)
+	_, err = d.Open("")
+	var openErr *OpenError
+	if !errors.As(err, &openErr) || len(openErr.Errs) != 10 {
+		t.Fatalf("got %v, want an OpenError with the errors of all 10 nodes", err)
+	}
+	msg := err.Error()
+	if n := strings.Count(msg, "clustersql: node "); n != 3 {
+		t.Errorf("%d node errors in %q, want 3", n, msg)
+	}
+	if !strings.HasPrefix(msg, "clustersql: 10 nodes failed: ") || !strings.HasSuffix(msg, "; ... and 7 more") {
+		t.Errorf("unexpected message %q", msg)
+	}
+	var nodeErr *NodeError
+	if !errors.Is(err, errFakeUnreachable) || !errors.As(err, &nodeErr) {
+		t.Errorf("node errors not wrapped by %v", err)
+	}
+
+	d.SetMaxErrorNodes(20)
+	if _, err = d.Open(""); strings.Contains(err.Error(), "more") || strings.Count(err.Error(), "clustersql: node ") != 10 {
+		t.Errorf("all errors fit, got %q", err)
+	}
+}
+
+func TestOpenErrorSkipped(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a", "b", "c", "d", "e") // all unreachable
+	d.SetMaxErrorNodes(10)
+	d.QuarantineNode("b", "disk replacement")
+	d.checkNode(context.Background(), d.nodes["c"], 0)
+	d.SetNodeMaxConns("d", 1)
+	d.mu.Lock()
+	d.nodes["d"].live = 1
+	d.mu.Unlock()
+	d.SetSelectionGuard(func(node NodeInfo, ctx context.Context) bool { return node.Name != "e" })
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string {
+		var healthy []NodeState
+		for _, n := range nodes {
+			if n.Healthy {
+				healthy = append(healthy, n)
+			}
+		}
+		return Weighted{}.Order(ctx, healthy)
+	}))
+
+	_, err := d.Open("")
+	want := fmt.Sprintf(`clustersql: 1 nodes failed: clustersql: node "a": %v; `+
+		`node "b": skipped (quarantined: disk replacement); `+
+		`node "c": skipped (left out by the balancer: unhealthy after 1 consecutive failures); `+
+		`node "d": skipped (at its connection limit); `+
+		`node "e": skipped (rejected by the selection guard)`, errFakeUnreachable)
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	errAuth := errors.New("Error 1045 (28000): Access denied for user 'app'@'10.0.0.1' (using password: YES)")
+	up := newFakeDriver()
+	up.node("a", errAuth, 0)
+	up.node("b", nil, 0)
+	up.node("c", nil, 0)
+	d := newTestDriver(up, "a", "b", "c")
+	d.SetFailFast(true)
+
+	if _, err := d.Open(""); err != errAuth {
+		t.Errorf("got %v, want the authentication failure", err)
+	}
+	if dials := up.dialed("b") + up.dialed("c"); dials != 0 {
+		t.Errorf("%d dials of the other nodes, want none", dials)
+	}
+
+	// transient errors fail over to all other nodes at once
+	up.node("b", nil, 20*time.Millisecond)
+	d.DelNode("a")
+	d.AddNode("a", "unreachable")
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	deadline := time.Now().Add(time.Second) // the loser may not have started yet
+	for up.dialed("b")+up.dialed("c") < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if dials := up.dialed("b") + up.dialed("c"); dials != 2 {
+		t.Errorf("%d dials of the other nodes, want 2", dials)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFakeUnreachable = errors.New("fake: connection refused")
+
+// fakeDriver is an upstream driver for unit tests. Every DSN it knows about is a
+// node; Open on any other DSN fails like an unreachable host.
+type fakeDriver struct {
+	mu      sync.Mutex
+	nodes   map[string]*fakeNode
+	dials   map[string]int
+	queries map[string][]string
+}
+
+// fakeNode describes how the fake driver behaves when a DSN is opened.
+type fakeNode struct {
+	err   error
+	delay time.Duration
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{nodes: map[string]*fakeNode{}, dials: map[string]int{}, queries: map[string][]string{}}
+}
+
+// node registers (or replaces) the behaviour for dsn.
+func (f *fakeDriver) node(dsn string, err error, delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[dsn] = &fakeNode{err, delay}
+}
+
+// dialed returns how often dsn has been opened.
+func (f *fakeDriver) dialed(dsn string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials[dsn]
+}
+
+// executed returns the statements run on connections to dsn.
+func (f *fakeDriver) executed(dsn string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.queries[dsn]...)
+}
+
+func (f *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	f.mu.Lock()
+	f.dials[dsn]++
+	n, ok := f.nodes[dsn]
+	f.mu.Unlock()
+	if !ok {
+		return nil, errFakeUnreachable
+	}
+	time.Sleep(n.delay)
+	if n.err != nil {
+		return nil, n.err
+	}
+	return &fakeConn{dsn: dsn, d: f}, nil
+}
+
+// fakeConn implements Execer and Queryer. Queries return a single row with a single
+// column, the DSN of the connection. Once closed, it returns driver.ErrBadConn.
+type fakeConn struct {
+	mu     sync.Mutex
+	dsn    string
+	d      *fakeDriver
+	closed bool
+}
+
+func (c *fakeConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if c.isClosed() {
+		return nil, driver.ErrBadConn
+	}
+	c.record(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	if c.isClosed() {
+		return nil, driver.ErrBadConn
+	}
+	c.record(query)
+	return &fakeRows{values: []string{c.dsn}}, nil
+}
+
+func (c *fakeConn) record(query string) {
+	if c.d != nil {
+		c.d.mu.Lock()
+		c.d.queries[c.dsn] = append(c.d.queries[c.dsn], query)
+		c.d.mu.Unlock()
+	}
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake: prepare not supported")
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.record("BEGIN")
+	return fakeTx{c}, nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+type fakeTx struct {
+	c *fakeConn
+}
+
+func (tx fakeTx) Commit() error {
+	tx.c.record("COMMIT")
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.c.record("ROLLBACK")
+	return nil
+}
+
+// fakeRows returns one row per value, in a single column.
+type fakeRows struct {
+	values []string
+}
+
+func (r *fakeRows) Columns() []string { return []string{"value"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+// newTestDriver returns a Driver on top of up which does not publish to the global expvar namespace.
+func newTestDriver(up driver.Driver, dsns ...string) *Driver {
+	d := newDriver(up, new(expvar.Map).Init())
+	for _, dsn := range dsns {
+		d.AddNode(dsn, dsn)
+	}
+	return d
+}
+
+// waitDials waits up to 5 seconds for the dials of d in progress, the losing ones of
+// earlier Opens included, to be done.
+func waitDials(t *testing.T, d *Driver) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dialing := 0
+		d.mu.Lock()
+		for _, n := range d.nodes {
+			if n != nil {
+				dialing += n.dialing
+			}
+		}
+		d.mu.Unlock()
+		if dialing == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dials still in progress", dialing)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
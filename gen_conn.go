@@ -0,0 +1,95 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build ignore
+
+// gen_conn generates conn_gen.go, which declares one wrapper type for every
+// combination of optional interfaces an upstream connection may implement.
+// Run it with "go generate".
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+)
+
+// optional lists the optional driver interfaces, along with the adapter in conn.go
+// forwarding its methods. The index is the bit used in the interface mask.
+var optional = []struct{ iface, adapter string }{
+	{"Pinger", "pinger"},
+	{"Execer", "execer"},
+	{"Queryer", "queryer"},
+	{"SessionResetter", "sessionResetter"},
+	{"NamedValueChecker", "namedValueChecker"},
+	{"ConnBeginTx", "connBeginTx"},
+	{"ConnPrepareContext", "connPrepareContext"},
+}
+
+func main() {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by gen_conn.go; DO NOT EDIT.\n\npackage clustersql\n\nimport \"database/sql/driver\"\n\n")
+
+	b.WriteString("// interfaces returns the mask of optional interfaces implemented by c.\n")
+	b.WriteString("func interfaces(c driver.Conn) (mask uint) {\n")
+	for i, o := range optional {
+		fmt.Fprintf(&b, "if _, ok := c.(driver.%s); ok {\nmask |= 1 << %d\n}\n", o.iface, i)
+	}
+	b.WriteString("return mask\n}\n\n")
+
+	combinations := 1 << uint(len(optional))
+	for m := 0; m < combinations; m++ {
+		fmt.Fprintf(&b, "type conn%d struct {\n*conn\n", m)
+		for i, o := range optional {
+			if m&(1<<uint(i)) != 0 {
+				fmt.Fprintf(&b, "%s\n", o.adapter)
+			}
+		}
+		b.WriteString("}\n\n")
+	}
+
+	b.WriteString("// expose returns c as a type implementing exactly the optional interfaces in mask.\n")
+	b.WriteString("func expose(c *conn, mask uint) driver.Conn {\nswitch mask {\n")
+	for m := 0; m < combinations; m++ {
+		fmt.Fprintf(&b, "case %d:\nreturn &conn%d{c", m, m)
+		for i, o := range optional {
+			if m&(1<<uint(i)) != 0 {
+				fmt.Fprintf(&b, ", %s{c}", o.adapter)
+			}
+		}
+		b.WriteString("}\n")
+	}
+	b.WriteString("}\npanic(\"clustersql: invalid interface mask\")\n}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("conn_gen.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SetHealthCheck makes the Driver probe every node each interval in the background,
+// by opening (and pinging, if supported) a connection which is closed right away.
+// Probes time out after interval. Failing probes mark the node unhealthy and are
+// counted in its expvar map like failed Opens (Errors, LastError, LastErrorMessage),
+// and additionally as HealthCheckErrors. An interval of 0 stops health checking.
+func (d *Driver) SetHealthCheck(interval time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopHealth != nil {
+		close(d.stopHealth)
+		d.stopHealth = nil
+	}
+	d.healthInterval = interval
+	if interval <= 0 || d.closed {
+		return
+	}
+	stop := make(chan struct{})
+	d.stopHealth = stop
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.checkHealth(context.Background(), interval)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// SetPassiveHealth turns passive health checking on or off. With it, every clean
+// close of a connection (one that never reported driver.ErrBadConn or being invalid)
+// counts as a successful interaction with its node, marking it healthy and adding to
+// its ConsecutiveSuccesses. This allows for less aggressive active health checks.
+func (d *Driver) SetPassiveHealth(enabled bool) {
+	d.mu.Lock()
+	d.passiveHealth = enabled
+	d.mu.Unlock()
+}
+
+// Close stops all background activity of the Driver and waits for it to finish. It
+// stops, in this order:
+//
+//  1. discovery, so that the set of nodes no longer changes,
+//  2. health checking, so that the health of the nodes no longer changes,
+//  3. load probing (see SetLoadProbe), so that the weights of the nodes no longer change,
+//  4. snapshots (see SetSnapshotHook), so that a snapshot in progress sees the final state,
+//  5. mirroring reads to shadow nodes (see SetShadowNode).
+//
+// It then cancels shadow queries in progress and waits for all of them. Afterwards, the
+// setters above have no effect anymore. Connections are not affected. Close may be called
+// more than once.
+func (d *Driver) Close() error {
+	d.SetDiscovery("", "", nil, 0)
+	d.SetHealthCheck(0)
+	d.mu.Lock()
+	d.stopLoadProbe()
+	d.mu.Unlock()
+	d.SetSnapshotHook(0, nil)
+	d.mu.Lock()
+	d.closed = true // nothing is added to d.wg from now on
+	d.mu.Unlock()
+	d.stop()
+	d.wg.Wait()
+	return nil
+}
+
+// PingAll probes every node like the health check does, updating its health, and
+// returns the outcome per node name. Probes give up when ctx expires.
+func (d *Driver) PingAll(ctx context.Context) map[string]error {
+	if err := ctx.Err(); err != nil {
+		res := map[string]error{}
+		for _, n := range d.registered() {
+			res[n.Name] = err
+		}
+		return res
+	}
+	return d.checkHealth(ctx, 0)
+}
+
+// ClusterState summarizes the health of all nodes, see State.
+type ClusterState int
+
+const (
+	// Healthy means all nodes are healthy.
+	Healthy ClusterState = iota
+	// Degraded means some, but not all nodes are healthy.
+	Degraded
+	// Down means no node is healthy, or there are no nodes.
+	Down
+)
+
+func (s ClusterState) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Down:
+		return "down"
+	}
+	return fmt.Sprintf("ClusterState(%d)", int(s))
+}
+
+// State rolls the current health of the nodes, not counting canaries and shadows, up into a
+// ClusterState. Nothing is dialed; health is as last seen by Open and the health checks.
+func (d *Driver) State() ClusterState {
+	return d.summarizeHealth().state()
+}
+
+// healthSummary is the health of a cluster, as published in expvar.
+type healthSummary struct {
+	State     string
+	Total     int
+	Healthy   int
+	Unhealthy int
+	Nodes     map[string]bool // health by node name
+}
+
+func (h healthSummary) state() ClusterState {
+	switch {
+	case h.Healthy == 0:
+		return Down
+	case h.Healthy < h.Total:
+		return Degraded
+	}
+	return Healthy
+}
+
+// summarizeHealth summarizes the health of all nodes except canaries and shadows. It is published
+// as HealthSummary in the expvar map of the driver. The number of unhealthy nodes, whose
+// breaker is open so to speak, is published there as OpenBreakers, too, and is reported to the
+// MetricsSink as a gauge whenever the health of a node changes.
+func (d *Driver) summarizeHealth() healthSummary {
+	h := healthSummary{Nodes: map[string]bool{}}
+	d.mu.Lock()
+	for name, n := range d.nodes {
+		if n != nil && n.inRotation() {
+			h.Nodes[name] = n.healthy
+			h.Total++
+			if n.healthy {
+				h.Healthy++
+			}
+		}
+	}
+	d.mu.Unlock()
+	h.Unhealthy = h.Total - h.Healthy
+	h.State = h.state().String()
+	return h
+}
+
+// readyPollInterval is the pause between two rounds of probes in WaitReady.
+var readyPollInterval = 100 * time.Millisecond
+
+// WaitReady probes all nodes until at least minHealthy of them pass, or ctx expires,
+// in which case an error wrapping ctx.Err() is returned. It is meant for readiness
+// gates and init containers.
+func (d *Driver) WaitReady(ctx context.Context, minHealthy int) error {
+	healthy, total := 0, 0
+	for ctx.Err() == nil {
+		res := d.PingAll(ctx)
+		passed := 0
+		for _, err := range res {
+			if err == nil {
+				passed++
+			}
+		}
+		if passed >= minHealthy {
+			return nil
+		}
+		deadline, ok := ctx.Deadline()
+		if (ctx.Err() != nil || ok && !time.Now().Before(deadline)) && total > 0 {
+			break // the probes were cut short, report the last round that wasn't
+		}
+		healthy, total = passed, len(res)
+		select {
+		case <-ctx.Done():
+		case <-time.After(readyPollInterval):
+		}
+	}
+	err := ctx.Err()
+	if err == nil {
+		err = context.DeadlineExceeded // passed, but the timer of ctx didn't fire yet
+	}
+	return fmt.Errorf("clustersql: %d of %d nodes healthy, %d required: %w", healthy, total, minHealthy, err)
+}
+
+// WaitNodeHealthy waits until the node called name is marked healthy, or ctx expires, in
+// which case an error wrapping ctx.Err() is returned. Unlike WaitReady, it does not probe
+// the node itself but relies on the health as last seen by Open and the health checks, see
+// SetHealthCheck. It fails with ErrUnknownNode if the node is not registered, also if it
+// is removed while waiting.
+func (d *Driver) WaitNodeHealthy(ctx context.Context, name string) error {
+	for {
+		d.mu.Lock()
+		n := d.nodes[name]
+		healthy := n != nil && n.healthy
+		d.mu.Unlock()
+		if n == nil {
+			return unknownNode(name)
+		}
+		if healthy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("clustersql: node %q not healthy: %w", name, ctx.Err())
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// checkHealth asks the primary resolver, if any, for the current primary, then probes
+// all nodes in parallel and waits for the results. Probes give up after timeout (if
+// positive), or when ctx is done.
+func (d *Driver) checkHealth(ctx context.Context, timeout time.Duration) map[string]error {
+	rctx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		rctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	d.resolvePrimary(rctx)
+	cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	res := map[string]error{}
+	for _, n := range d.registered() {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			err := d.checkNode(ctx, n, timeout)
+			mu.Lock()
+			res[n.Name] = err
+			mu.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	return res
+}
+
+// checkNode probes n, updating its health, unless ctx is done before the probe ends.
+func (d *Driver) checkNode(ctx context.Context, n *node, timeout time.Duration) error {
+	dsn, dial, err := d.target(n)
+	if err == nil {
+		err = probe(ctx, dial, dsn, timeout)
+	}
+	if ctx.Err() != nil && err == ctx.Err() {
+		// not the node's fault
+		return err
+	}
+	Time := new(expvar.String)
+	Time.Set(time.Now().String())
+	n.exp.Set("LastHealthCheck", Time)
+	if err != nil {
+		d.recordError(n, err)
+		d.count(n, "HealthCheckErrors")
+	}
+	d.setHealthy(n, err == nil)
+	return err
+}
+
+// registered returns all nodes currently registered.
+func (d *Driver) registered() []*node {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nodes := make([]*node, 0, len(d.nodes))
+	for _, n := range d.nodes {
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
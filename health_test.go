@@ -0,0 +1,429 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckErrors(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a", "b")
+
+	d.checkHealth(context.Background(), time.Second)
+
+	b := d.nodes["b"]
+	if b.healthy {
+		t.Error("b still healthy after failed health check")
+	}
+	for key, want := range map[string]string{"Errors": "1", "HealthCheckErrors": "1", "LastErrorMessage": `"` + errFakeUnreachable.Error() + `"`} {
+		if v := b.exp.Get(key); v == nil || v.String() != want {
+			t.Errorf("b: %s = %v, want %s", key, v, want)
+		}
+	}
+	if b.exp.Get("LastError") == nil || b.exp.Get("LastHealthCheck") == nil {
+		t.Error("b: timestamps not set")
+	}
+	if v := b.exp.Get("Connections"); v != nil {
+		t.Errorf("b: health check counted as connection: %v", v)
+	}
+
+	a := d.nodes["a"]
+	if !a.healthy || a.exp.Get("Errors") != nil || a.exp.Get("Connections") != nil {
+		t.Errorf("a: unexpected state after successful health check: %v", a.exp)
+	}
+}
+
+func TestHealthCheckLoop(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "a")
+	// the resolver is consulted by the loop itself, at the start of every round
+	rounds := make(chan struct{}, 1)
+	var closed int32
+	d.SetPrimaryResolver(func(ctx context.Context) (string, error) {
+		if atomic.LoadInt32(&closed) != 0 {
+			t.Error("health checks still running after Close")
+		}
+		select {
+		case rounds <- struct{}{}:
+		default:
+		}
+		return "a", nil
+	})
+	d.SetHealthCheck(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-rounds:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d health checks run", i)
+		}
+	}
+	// Close waits for the loop, so no round may start afterwards
+	d.Close()
+	atomic.StoreInt32(&closed, 1)
+}
+
+func TestWaitReady(t *testing.T) {
+	defer func(d time.Duration) { readyPollInterval = d }(readyPollInterval)
+	readyPollInterval = 5 * time.Millisecond
+
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a", "b", "c")
+	var bDials int32
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "b" && atomic.AddInt32(&bDials, 1) == 2 {
+				up.node("b", nil, 0) // reachable from the second round on
+			}
+			return next(dsn)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := d.WaitReady(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&bDials); n != 2 {
+		t.Errorf("b dialed %d times, want 2", n)
+	}
+	if !d.nodes["b"].healthy {
+		t.Error("b not marked healthy")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := d.WaitReady(ctx, 3)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "2 of 3 nodes healthy") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestWaitReadyCancel(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "b" {
+				close(started)
+				<-release // b never answers
+			}
+			return next(dsn)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.WaitReady(ctx, 2) }()
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitReady still probing after cancel")
+	}
+}
+
+func TestWaitNodeHealthy(t *testing.T) {
+	defer func(d time.Duration) { readyPollInterval = d }(readyPollInterval)
+	readyPollInterval = 5 * time.Millisecond
+
+	up := newFakeDriver()
+	d := newTestDriver(up, "a", "b")
+	d.PingAll(context.Background()) // both unreachable
+	d.SetHealthCheck(10 * time.Millisecond)
+	defer d.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		up.node("a", nil, 0)
+	}()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := d.WaitNodeHealthy(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("WaitNodeHealthy returned after %s, before a became reachable", waited)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := d.WaitNodeHealthy(ctx, "b")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if err := d.WaitNodeHealthy(context.Background(), "x"); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("expected ErrUnknownNode, got %v", err)
+	}
+}
+
+func TestOpenBreakers(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "a", "b", "c")
+	d.AddCanaryNode("canary", "canary", 0.1)
+	sink := &captureSink{}
+	d.SetMetricsSink(sink)
+	check := func(want int) {
+		t.Helper()
+		if v := d.exp.Get("OpenBreakers").String(); v != strconv.Itoa(want) {
+			t.Errorf("OpenBreakers = %s, want %d", v, want)
+		}
+		if got := d.stats().OpenBreakers; got != want {
+			t.Errorf("ClusterStats.OpenBreakers = %d, want %d", got, want)
+		}
+	}
+
+	check(0)
+	d.setHealthy(d.nodes["a"], false)
+	d.setHealthy(d.nodes["b"], false)
+	d.setHealthy(d.nodes["b"], false)
+	d.setHealthy(d.nodes["canary"], false)
+	check(2)
+	d.setHealthy(d.nodes["a"], true)
+	check(1)
+	var gauges []string
+	for _, call := range sink.take() {
+		if strings.HasPrefix(call, "gauge OpenBreakers") {
+			gauges = append(gauges, call)
+		}
+	}
+	if want := []string{"gauge OpenBreakers =1", "gauge OpenBreakers =2", "gauge OpenBreakers =2", "gauge OpenBreakers =1"}; !reflect.DeepEqual(gauges, want) {
+		t.Errorf("gauges reported: %q, want %q", gauges, want)
+	}
+}
+
+func TestCloseLifecycle(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("shadow", nil, 0)
+	d := newTestDriver(up, "seed", "a", "shadow")
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "seed" {
+				return &membersConn{members: func() []string { return []string{"a=a", "b=b"} }}, nil
+			}
+			return next(dsn)
+		}
+	})
+	var snapshots, divergences int64
+	if err := d.SetDiscovery("seed", "SHOW STATUS", parseMembers, 5*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	d.SetHealthCheck(5 * time.Millisecond)
+	d.SetSnapshotHook(5*time.Millisecond, func(ClusterStats) { atomic.AddInt64(&snapshots, 1) })
+	d.SetShadowNode("shadow", 1)
+	d.SetShadowDivergence(func(ShadowDivergence) { atomic.AddInt64(&divergences, 1) })
+	db := sql.OpenDB(connector{d})
+	defer db.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var value string
+				db.QueryRow("SELECT value").Scan(&value)
+			}
+		}()
+	}
+	checked := func() bool { return d.nodes["a"].exp.Get("LastHealthCheck") != nil }
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&snapshots) == 0 || atomic.LoadInt64(&divergences) == 0 || !checked(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d snapshots, %d divergences and health checked %v after 5s, want some", atomic.LoadInt64(&snapshots), atomic.LoadInt64(&divergences), checked())
+		}
+	}
+	d.Close() // while queries are running
+	close(stop)
+	wg.Wait()
+
+	// nothing runs or starts anymore
+	d.SetHealthCheck(5 * time.Millisecond)
+	d.SetSnapshotHook(5*time.Millisecond, func(ClusterStats) { atomic.AddInt64(&snapshots, 1) })
+	if err := d.SetDiscovery("seed", "SHOW STATUS", parseMembers, 5*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	started := d.stopHealth != nil || d.stopSnapshots != nil || d.stopDiscovery != nil
+	d.mu.Unlock()
+	if started {
+		t.Error("background work started after Close")
+	}
+	d.Close()
+	var value string
+	if err := db.QueryRow("SELECT value").Scan(&value); err != nil {
+		t.Errorf("connections broken by Close: %v", err)
+	}
+	db.Close()
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > baseline; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, %d before", runtime.NumGoroutine(), baseline)
+		}
+	}
+}
+
+// badConn reports every query as failing with driver.ErrBadConn.
+type badConn struct{ fakeConn }
+
+func (c *badConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrBadConn
+}
+
+func TestPassiveHealth(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	a := d.nodes["a"]
+	d.setHealthy(a, false)
+	d.setHealthy(a, false)
+
+	use := func() {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := c.(driver.Queryer).Query("SELECT 1", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.Close()
+	}
+
+	use()
+	if a.successes != 1 {
+		t.Fatalf("expected the dial to count as one success, got %d", a.successes)
+	}
+	d.SetPassiveHealth(true)
+	use()
+	use()
+	if !a.healthy || a.successes != 5 || a.failures != 0 {
+		t.Errorf("passive health not improving: healthy %t, %d successes, %d failures", a.healthy, a.successes, a.failures)
+	}
+	if v := a.exp.Get("ConsecutiveSuccesses"); v == nil || v.String() != "5" {
+		t.Errorf("ConsecutiveSuccesses = %v, want 5", v)
+	}
+
+	// a connection closed after reporting a bad connection does not count
+	bad := d.wrap(&badConn{}, a)
+	if _, err := bad.(driver.Queryer).Query("SELECT 1", nil); err != driver.ErrBadConn {
+		t.Fatal(err)
+	}
+	bad.Close()
+	if a.successes != 5 {
+		t.Errorf("close of a bad connection counted as success")
+	}
+}
+
+func TestState(t *testing.T) {
+	d := newTestDriver(newFakeDriver())
+	if s := d.State(); s != Down {
+		t.Errorf("without nodes: %s, want %s", s, Down)
+	}
+	d.AddNode("a", "a")
+	d.AddNode("b", "b")
+	for _, test := range []struct {
+		a, b bool
+		want ClusterState
+	}{
+		{true, true, Healthy},
+		{true, false, Degraded},
+		{false, true, Degraded},
+		{false, false, Down},
+	} {
+		d.setHealthy(d.nodes["a"], test.a)
+		d.setHealthy(d.nodes["b"], test.b)
+		if s := d.State(); s != test.want {
+			t.Errorf("a healthy %v, b healthy %v: %s, want %s", test.a, test.b, s, test.want)
+		}
+	}
+	// deleted nodes don't count
+	d.DelNode("b")
+	if s := d.State(); s != Down {
+		t.Errorf("after deleting b: %s, want %s", s, Down)
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a", "b")
+	d.AddCanaryNode("canary", "canary", 0.1)
+	summary := func() (h healthSummary) {
+		if err := json.Unmarshal([]byte(d.exp.Get("HealthSummary").String()), &h); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	for _, test := range []struct {
+		a, b bool
+		want healthSummary
+	}{
+		{true, true, healthSummary{"healthy", 2, 2, 0, map[string]bool{"a": true, "b": true}}},
+		{false, true, healthSummary{"degraded", 2, 1, 1, map[string]bool{"a": false, "b": true}}},
+		{false, false, healthSummary{"down", 2, 0, 2, map[string]bool{"a": false, "b": false}}},
+	} {
+		d.setHealthy(d.nodes["a"], test.a)
+		d.setHealthy(d.nodes["b"], test.b)
+		if got := summary(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got %+v, want %+v", got, test.want)
+		}
+		if got := d.State().String(); got != test.want.State {
+			t.Errorf("State() = %s, summary says %s", got, test.want.State)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import "context"
+
+// ZoneLabel is the label holding the zone (e.g. availability zone) of a node, see
+// SetLocalZone.
+const ZoneLabel = "zone"
+
+// ReadPreferenceLabel is the label holding the read preference of a node, which orders
+// the nodes for reads in read/write split mode: nodes labelled ReadPrefer come first,
+// then unlabelled ones, then those labelled ReadSecondary. Nodes labelled ReadNever get
+// no reads at all, not even as fallback. A read preference requested with
+// WithReadPreference goes before all of them. Healthy nodes still go before unhealthy
+// ones, and the local zone (see SetLocalZone) first.
+const ReadPreferenceLabel = "read-preference"
+
+// Values of ReadPreferenceLabel.
+const (
+	ReadPrefer    = "prefer"
+	ReadSecondary = "secondary"
+	ReadNever     = "never-read"
+)
+
+// WithReadPreference returns a copy of ctx making reads on connections opened with it
+// prefer nodes whose ReadPreferenceLabel is pref, e.g. replicas set aside for a
+// workload. Other nodes are still used if those fail.
+func WithReadPreference(ctx context.Context, pref string) context.Context {
+	return context.WithValue(ctx, readPreferenceCtx, pref)
+}
+
+// readRanks is the number of different results of readRank.
+const readRanks = 4
+
+// readRank orders n for reads, lower ranks first, given the requested read preference.
+// d.mu must be held.
+func (n *node) readRank(requested string) int {
+	pref := n.labels[ReadPreferenceLabel]
+	switch {
+	case requested != "" && pref == requested:
+		return 0
+	case pref == ReadPrefer:
+		return 1
+	case pref == ReadSecondary:
+		return 3
+	}
+	return 2
+}
+
+// readable reports whether n may get reads at all. d.mu must be held.
+func (n *node) readable() bool {
+	return n.labels[ReadPreferenceLabel] != ReadNever
+}
+
+// SetNodeLabels replaces the labels of a named Node. Labels are free-form key/value
+// pairs describing a node, like its zone (see ZoneLabel) or region. They are handed to
+// the Balancer and other callbacks, but apart from ZoneLabel and ReadPreferenceLabel
+// have no meaning of their own.
+func (d *Driver) SetNodeLabels(name string, labels map[string]string) error {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	n.labels = copied
+	return nil
+}
+
+// SetLocalZone makes Open dial healthy nodes whose ZoneLabel is zone first, and only
+// go on to the other nodes when those fail. Within each group, the order of the
+// Balancer is kept. "" turns this off.
+func (d *Driver) SetLocalZone(zone string) {
+	d.mu.Lock()
+	d.localZone = zone
+	d.mu.Unlock()
+}
+
+// copyLabels returns a copy of the labels of n, nil if it has none. d.mu must be held.
+func (n *node) copyLabels() map[string]string {
+	return copyStrings(n.labels)
+}
+
+// copyStrings returns a copy of m, nil if it is empty.
+func copyStrings(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
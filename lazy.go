@@ -0,0 +1,148 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// SetLazyConnections turns lazy connections on or off. With them, Open returns right away
+// with a connection that is not bound to a node yet; the node is selected and dialed when
+// the connection is first used, with the context of that use, and the connection sticks
+// to it from then on. Connections the pool opens but never uses cost nothing.
+//
+// If dialing fails on first use, driver.ErrBadConn is returned, so that database/sql
+// retries with another connection; the errors are recorded for the nodes as usual.
+// Fatal errors (see SetFatalErrorClassifier) are returned as they are.
+// Connections in read/write split mode (see SetReadWriteSplit) are lazy anyway, and
+// those forced to a node (see WithForcedNode) never are.
+func (d *Driver) SetLazyConnections(enabled bool) {
+	d.mu.Lock()
+	d.lazy = enabled
+	d.mu.Unlock()
+}
+
+// lazyConn is the connection handed out with SetLazyConnections. Like any driver.Conn,
+// it is not used concurrently.
+type lazyConn struct {
+	d    *Driver
+	conn driver.Conn // nil until first used
+}
+
+// get returns the upstream connection, opening it if needed.
+func (l *lazyConn) get(ctx context.Context) (driver.Conn, error) {
+	if l.conn != nil {
+		return l.conn, nil
+	}
+	c, err := l.d.openConn(ctx, nil)
+	if err != nil {
+		if ctx.Err() != nil || l.d.fatal(err) {
+			// retrying with another connection would not help
+			return nil, err
+		}
+		return nil, driver.ErrBadConn
+	}
+	l.conn = c
+	return c, nil
+}
+
+func (l *lazyConn) Prepare(query string) (driver.Stmt, error) {
+	return l.PrepareContext(context.Background(), query)
+}
+
+func (l *lazyConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := c.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Prepare(query)
+}
+
+func (l *lazyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return execContext(ctx, c, query, args)
+}
+
+func (l *lazyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return queryContext(ctx, c, query, args)
+}
+
+func (l *lazyConn) Begin() (driver.Tx, error) {
+	return l.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (l *lazyConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return beginTx(ctx, c, opts)
+}
+
+func (l *lazyConn) Ping(ctx context.Context) error {
+	c, err := l.get(ctx)
+	if err != nil {
+		return err
+	}
+	if p, ok := c.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (l *lazyConn) ResetSession(ctx context.Context) error {
+	if r, ok := l.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (l *lazyConn) IsValid() bool {
+	if v, ok := l.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (l *lazyConn) Close() error {
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
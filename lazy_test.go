@@ -0,0 +1,97 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+func TestLazyConnections(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	d.SetLazyConnections(true)
+	ctx := context.Background()
+
+	c, err := connector{d}.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n := up.dialed("a"); n != 0 {
+		t.Fatalf("dialed %d times before first use, want 0", n)
+	}
+	if !c.(driver.Validator).IsValid() {
+		t.Error("unused lazy connection is not valid")
+	}
+	for i := 0; i < 2; i++ {
+		rows, err := c.(driver.QueryerContext).QueryContext(ctx, "SELECT 1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+	if n := up.dialed("a"); n != 1 {
+		t.Errorf("dialed %d times after use, want 1", n)
+	}
+	if got := up.executed("a"); len(got) != 2 {
+		t.Errorf("executed %q on a, want 2 statements", got)
+	}
+}
+
+func TestLazyConnectionsFailure(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "unreachable")
+	d.SetLazyConnections(true)
+	ctx := context.Background()
+
+	c, err := connector{d}.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect = %v, want success", err)
+	}
+	defer c.Close()
+	if _, err := c.(driver.ExecerContext).ExecContext(ctx, "DELETE FROM t", nil); err != driver.ErrBadConn {
+		t.Errorf("ExecContext = %v, want driver.ErrBadConn", err)
+	}
+	if n := up.dialed("unreachable"); n == 0 {
+		t.Error("first use did not dial")
+	}
+
+	// fatal errors are not retried
+	errAuth := errors.New("Error 1045 (28000): Access denied for user 'app'@'10.0.0.1' (using password: YES)")
+	up.node("unreachable", errAuth, 0)
+	c2, err := connector{d}.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect = %v, want success", err)
+	}
+	defer c2.Close()
+	if _, err := c2.(driver.ExecerContext).ExecContext(ctx, "DELETE FROM t", nil); !errors.Is(err, errAuth) {
+		t.Errorf("ExecContext = %v, want the fatal error", err)
+	}
+}
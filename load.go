@@ -0,0 +1,141 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// LoadProbe measures the load of a node on conn, a connection of its own to the node,
+// see SetLoadProbe. The scale is up to the probe, e.g. MySQL's Threads_running; 0 means
+// idle.
+type LoadProbe func(ctx context.Context, conn driver.Conn) (float64, error)
+
+// SetLoadProbe makes the Driver sample the load of every node each interval in the
+// background with probe, on a connection of its own which is closed right away, and
+// prefer less loaded nodes: the effective weight of a node (see SetNodeWeight) is
+// divided by 1 plus its latest load, so an idle node keeps its weight. Nodes not
+// sampled yet keep theirs, too. Probes time out after interval. Failing probes are
+// counted as LoadProbeErrors in the expvar map of the node, which keeps its latest
+// load; they don't affect its health. The latest load is published as Load there, and
+// handed to the Balancer as NodeState.Load. A nil probe or an interval of 0 stops load
+// probing, and the loads sampled so far no longer count. Close stops it, too, but the
+// loads sampled so far still count.
+func (d *Driver) SetLoadProbe(probe LoadProbe, interval time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopLoadProbe()
+	d.loadProbe = nil
+	if probe == nil || interval <= 0 || d.closed {
+		return
+	}
+	d.loadProbe = probe
+	stop := make(chan struct{})
+	d.stopLoad = stop
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.probeLoads(probe, interval)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopLoadProbe stops sampling the loads of the nodes, if it's going on. d.mu must be held.
+func (d *Driver) stopLoadProbe() {
+	if d.stopLoad != nil {
+		close(d.stopLoad)
+		d.stopLoad = nil
+	}
+}
+
+// probeLoads samples the load of all nodes in parallel with probe and waits for the results.
+func (d *Driver) probeLoads(probe LoadProbe, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, n := range d.registered() {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			load, err := d.probeLoad(n, probe, timeout)
+			if err != nil {
+				d.count(n, "LoadProbeErrors")
+				return
+			}
+			d.mu.Lock()
+			n.load, n.loaded = load, true
+			d.mu.Unlock()
+		}(n)
+	}
+	wg.Wait()
+}
+
+// probeLoad samples the load of n with probe, giving up after timeout.
+func (d *Driver) probeLoad(n *node, probe LoadProbe, timeout time.Duration) (float64, error) {
+	dsn, dial, err := d.target(n)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := openTimeout(context.Background(), dial, dsn, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	return probe(ctx, conn)
+}
+
+// loadFactor is what the weight of n is multiplied with for its load, see SetLoadProbe.
+// d.mu must be held.
+func (d *Driver) loadFactor(n *node) float64 {
+	if d.loadProbe == nil || !n.loaded || n.load <= 0 {
+		return 1
+	}
+	return 1 / (1 + n.load)
+}
+
+// publishLoad publishes the latest load of n in its expvar map, null if not sampled.
+func (d *Driver) publishLoad(n *node) {
+	n.exp.Set("Load", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if !n.loaded {
+			return nil
+		}
+		return n.load
+	}))
+}
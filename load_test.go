@@ -0,0 +1,89 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoadProbe(t *testing.T) {
+	up := newFakeDriver()
+	up.node("heavy", nil, 0)
+	up.node("light", nil, 0)
+	up.node("broken", nil, 0)
+	d := newTestDriver(up, "heavy", "light", "broken")
+	d.SetFanout(1)
+	loads := map[string]float64{"heavy": 9, "light": 1}
+	d.SetLoadProbe(func(ctx context.Context, conn driver.Conn) (float64, error) {
+		load, ok := loads[conn.(*fakeConn).dsn]
+		if !ok {
+			return 0, errors.New("no load")
+		}
+		return load, nil
+	}, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.nodes["heavy"].exp.Get("Load").String() == "null" || d.nodes["light"].exp.Get("Load").String() == "null" ||
+		d.nodes["broken"].exp.Get("LoadProbeErrors") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("loads not sampled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.Close()
+	for name, want := range map[string]string{"heavy": "9", "light": "1", "broken": "null"} {
+		if got := d.nodes[name].exp.Get("Load").String(); got != want {
+			t.Errorf("%s: Load = %s, want %s", name, got, want)
+		}
+	}
+	for name, want := range map[string]string{"heavy": "0.1", "light": "0.5", "broken": "1"} {
+		if got := d.nodes[name].exp.Get("EffectiveWeight").String(); got != want {
+			t.Errorf("%s: EffectiveWeight = %s, want %s", name, got, want)
+		}
+	}
+
+	// the broken node has the highest weight, as its load is unknown
+	d.DelNode("broken")
+	for i := 0; i < 10; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != "light" {
+			t.Errorf("Open %d went to %s, want light", i, got)
+		}
+		c.Close()
+	}
+
+	d.SetLoadProbe(nil, 0)
+	if got := d.nodes["heavy"].exp.Get("EffectiveWeight").String(); got != "1" {
+		t.Errorf("heavy: EffectiveWeight = %s after turning load probing off, want 1", got)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import "time"
+
+// MetricsSink receives the metrics the Driver publishes in expvar, at the same points, so
+// they can be forwarded to any monitoring system. Names are the ones used in expvar;
+// metrics of a node carry its name as the label "node", those of the driver no labels.
+// Totals over all nodes, like ActiveConnectionsTotal, are left to the backend to aggregate.
+//
+// Implementations must be safe for concurrent use, and must neither block nor call back
+// into the Driver.
+type MetricsSink interface {
+	// IncCounter adds 1 to a counter, like Connections or Errors.
+	IncCounter(name string, labels map[string]string)
+	// ObserveLatency records a duration, like AcquireLatency.
+	ObserveLatency(name string, d time.Duration, labels map[string]string)
+	// SetGauge sets a value describing current state, like ActiveConnections.
+	SetGauge(name string, value float64, labels map[string]string)
+}
+
+// NopMetrics is a MetricsSink discarding everything. It is the default.
+type NopMetrics struct{}
+
+func (NopMetrics) IncCounter(name string, labels map[string]string)                      {}
+func (NopMetrics) ObserveLatency(name string, d time.Duration, labels map[string]string) {}
+func (NopMetrics) SetGauge(name string, value float64, labels map[string]string)         {}
+
+// SetMetricsSink makes the Driver report its metrics to sink, in addition to expvar. nil
+// restores the default, NopMetrics.
+func (d *Driver) SetMetricsSink(sink MetricsSink) {
+	if sink == nil {
+		sink = NopMetrics{}
+	}
+	d.mu.Lock()
+	d.metrics = sink
+	d.mu.Unlock()
+}
+
+// sink returns the MetricsSink. d.mu must not be held.
+func (d *Driver) sink() MetricsSink {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.metrics
+}
+
+// count adds 1 to the counter name of n, or of the driver if n is nil, in expvar and the
+// MetricsSink. d.mu must not be held.
+func (d *Driver) count(n *node, name string) {
+	if n == nil {
+		d.exp.Add(name, 1)
+		d.sink().IncCounter(name, nil)
+		return
+	}
+	n.exp.Add(name, 1)
+	d.sink().IncCounter(name, n.metricLabels())
+}
+
+// metricLabels returns the labels of the metrics of n.
+func (n *node) metricLabels() map[string]string {
+	return map[string]string{"node": n.Name}
+}
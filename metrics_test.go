@@ -0,0 +1,120 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureSink records the metric calls it gets, as "kind name node=value".
+type captureSink struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *captureSink) record(call string) {
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+}
+
+func (s *captureSink) IncCounter(name string, labels map[string]string) {
+	s.record("inc " + name + " " + labels["node"])
+}
+
+func (s *captureSink) ObserveLatency(name string, d time.Duration, labels map[string]string) {
+	s.record("observe " + name + " " + labels["node"])
+}
+
+func (s *captureSink) SetGauge(name string, value float64, labels map[string]string) {
+	s.record("gauge " + name + " " + labels["node"] + "=" + strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (s *captureSink) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := s.calls
+	s.calls = nil
+	return calls
+}
+
+func TestMetricsSink(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	d.AddNode("down", "down")
+	sink := &captureSink{}
+	d.SetMetricsSink(sink)
+
+	// a connection to a
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string { return []string{"a"} }))
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"gauge ActiveConnections a=1",
+		"gauge ConsecutiveSuccesses a=1",
+		"gauge ConsecutiveFailures a=0",
+		"inc Connections a",
+		"inc SuccessAfter_0Failures ",
+		"observe AcquireLatency ",
+	}
+	if got := sink.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Open: got calls\n%q\nwant\n%q", got, want)
+	}
+
+	// a failure
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string { return []string{"down"} }))
+	if _, err := d.Open(""); err == nil {
+		t.Fatal("opened down")
+	}
+	want = []string{
+		"gauge ConsecutiveSuccesses down=0",
+		"gauge ConsecutiveFailures down=1",
+		"gauge OpenBreakers =1",
+		"inc Errors down",
+	}
+	if got := sink.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("failed Open: got calls\n%q\nwant\n%q", got, want)
+	}
+
+	c.Close()
+	want = []string{"gauge ActiveConnections a=0"}
+	if got := sink.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Close: got calls\n%q\nwant\n%q", got, want)
+	}
+
+	d.SetMetricsSink(nil)
+	if _, ok := d.metrics.(NopMetrics); !ok {
+		t.Errorf("SetMetricsSink(nil) set %T", d.metrics)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MySQLErrorClass is how a MySQL error is handled once UseMySQLClassifier is called,
+// see ClassifyMySQLError.
+type MySQLErrorClass int
+
+const (
+	// MySQLOther is any error not listed below. It is left to the default classifiers,
+	// IsNodeError and IsFatalError.
+	MySQLOther MySQLErrorClass = iota
+	// MySQLFatal is 1045 (access denied) and 1049 (unknown database): other nodes would
+	// fail the same way, so Open gives up right away, see SetFatalErrorClassifier.
+	MySQLFatal
+	// MySQLOverloaded is 1040 (too many connections): the node is marked unhealthy when
+	// dialed and Open goes on to the next one, so the node gets a break.
+	MySQLOverloaded
+	// MySQLRetryable is 1213 (deadlock): the statement failed, but running it again may
+	// succeed. The node is fine, so the error is returned as it is.
+	MySQLRetryable
+	// MySQLNodeDown is 2006 (server has gone away) and 2013 (lost connection), as well as
+	// Go-MySQL's "invalid connection": the connection is broken. It is reported invalid
+	// (see driver.Validator), so database/sql discards it, and the node is marked
+	// unhealthy.
+	MySQLNodeDown
+)
+
+// mysqlErrorClasses are the classes of the MySQL error numbers recognized.
+var mysqlErrorClasses = map[int]MySQLErrorClass{
+	1045: MySQLFatal,
+	1049: MySQLFatal,
+	1040: MySQLOverloaded,
+	1213: MySQLRetryable,
+	2006: MySQLNodeDown,
+	2013: MySQLNodeDown,
+}
+
+// ClassifyMySQLError returns the class of err, going by the error number in its message
+// as formatted by Go-MySQL, like "Error 1045 (28000): Access denied".
+func ClassifyMySQLError(err error) MySQLErrorClass {
+	if err == nil {
+		return MySQLOther
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "invalid connection") {
+		return MySQLNodeDown
+	}
+	i := strings.Index(msg, "Error ")
+	if i < 0 {
+		return MySQLOther
+	}
+	number := msg[i+len("Error "):]
+	if end := strings.IndexFunc(number, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+		number = number[:end]
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return MySQLOther
+	}
+	return mysqlErrorClasses[n]
+}
+
+// UseMySQLClassifier sets up error handling for Go-MySQL as described for the classes of
+// ClassifyMySQLError, replacing the node error and fatal error classifiers (see
+// SetNodeErrorClassifier and SetFatalErrorClassifier). Errors of class MySQLNodeDown
+// are not turned into driver.ErrBadConn, as the statement may have been run already;
+// see SetReadRetry for reads.
+func (d *Driver) UseMySQLClassifier() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.isNodeError = func(err error) bool {
+		switch ClassifyMySQLError(err) {
+		case MySQLOverloaded, MySQLNodeDown:
+			return true
+		case MySQLFatal, MySQLRetryable:
+			return false
+		}
+		return IsNodeError(err)
+	}
+	d.isFatal = func(err error) bool {
+		return ClassifyMySQLError(err) == MySQLFatal
+	}
+	d.isNodeDown = func(err error) bool {
+		return ClassifyMySQLError(err) == MySQLNodeDown
+	}
+}
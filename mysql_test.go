@@ -0,0 +1,140 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+)
+
+var (
+	errMySQLAuth      = errors.New("Error 1045 (28000): Access denied for user 'app'@'10.0.0.1' (using password: YES)")
+	errMySQLUnknownDB = errors.New("Error 1049 (42000): Unknown database 'app'")
+	errMySQLTooMany   = errors.New("Error 1040: Too many connections")
+	errMySQLDeadlock  = errors.New("Error 1213 (40001): Deadlock found when trying to get lock; try restarting transaction")
+	errMySQLGoneAway  = errors.New("Error 2006: MySQL server has gone away")
+	errMySQLLost      = errors.New("Error 2013: Lost connection to MySQL server during query")
+)
+
+func TestClassifyMySQLError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want MySQLErrorClass
+	}{
+		{errMySQLAuth, MySQLFatal},
+		{errMySQLUnknownDB, MySQLFatal},
+		{errMySQLTooMany, MySQLOverloaded},
+		{errMySQLDeadlock, MySQLRetryable},
+		{errMySQLGoneAway, MySQLNodeDown},
+		{errMySQLLost, MySQLNodeDown},
+		{errors.New("invalid connection"), MySQLNodeDown},
+		{&NodeError{Node: "a", Err: errMySQLLost}, MySQLNodeDown},
+		{errors.New("Error 1064 (42000): You have an error in your SQL syntax"), MySQLOther},
+		{errors.New("Error: no number"), MySQLOther},
+		{io.EOF, MySQLOther},
+		{nil, MySQLOther},
+	} {
+		if got := ClassifyMySQLError(test.err); got != test.want {
+			t.Errorf("%v: got class %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestMySQLClassifierOpen(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up, "a", "b")
+	up.node("b", nil, 0)
+	d.SetFanout(1)
+	d.UseMySQLClassifier()
+
+	// access denied ends Open, leaving the node healthy
+	up.node("a", errMySQLAuth, 0)
+	d.SetNodeWeight("b", 0)
+	if _, err := d.Open(""); err != errMySQLAuth {
+		t.Errorf("got %v, want the authentication failure", err)
+	}
+	if a := d.nodes["a"]; !a.healthy || up.dialed("b") != 0 {
+		t.Error("access denied was not fatal")
+	}
+
+	// too many connections goes on to the next node, giving the overloaded one a break
+	up.node("a", errMySQLTooMany, 0)
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if a := d.nodes["a"]; a.healthy || up.dialed("b") != 1 {
+		t.Errorf("overloaded node: healthy %v, b dialed %d times", a.healthy, up.dialed("b"))
+	}
+}
+
+func TestMySQLClassifierConn(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a")
+	d.UseMySQLClassifier()
+	exec := func(err error) (driver.Conn, error) {
+		c := d.wrap(&errConn{err: err}, d.nodes["a"])
+		_, err = c.(driver.ExecerContext).ExecContext(context.Background(), "UPDATE t SET x = 1", nil)
+		return c, err
+	}
+
+	// a deadlock is about the statement, not the node
+	c, err := exec(errMySQLDeadlock)
+	var nodeErr *NodeError
+	if err != errMySQLDeadlock {
+		t.Errorf("got %v, want the deadlock as it is", err)
+	}
+	if !c.(driver.Validator).IsValid() || !d.nodes["a"].healthy {
+		t.Error("a deadlock broke the connection or the node")
+	}
+	c.Close()
+
+	for _, down := range []error{errMySQLGoneAway, errMySQLLost} {
+		d.setHealthy(d.nodes["a"], true)
+		c, err = exec(down)
+		if !errors.As(err, &nodeErr) || err == driver.ErrBadConn {
+			t.Errorf("got %v, want a NodeError", err)
+		}
+		if c.(driver.Validator).IsValid() {
+			t.Errorf("%v: connection still valid", down)
+		}
+		if d.nodes["a"].healthy {
+			t.Errorf("%v: node still healthy", down)
+		}
+		c.Close()
+	}
+
+	// without the classifier, the connection and node are left alone
+	d = newTestDriver(newFakeDriver(), "a")
+	c, _ = exec(errMySQLLost)
+	if !c.(driver.Validator).IsValid() || !d.nodes["a"].healthy {
+		t.Error("default classifiers broke the connection or the node")
+	}
+	c.Close()
+}
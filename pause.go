@@ -0,0 +1,64 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClusterPaused is returned (wrapped, along with the reason) by Open while the Driver
+// is paused, see Pause.
+var ErrClusterPaused = errors.New("clustersql: cluster paused")
+
+// Pause makes Open fail right away with an error wrapping ErrClusterPaused and reason,
+// e.g. for a maintenance window, so that the application can shed load gracefully.
+// Connections already open keep working, and the configuration is kept. Rejected Opens
+// are counted as PausedRejections in the expvar map of the driver.
+func (d *Driver) Pause(reason string) {
+	d.mu.Lock()
+	d.paused, d.pauseReason = true, reason
+	d.mu.Unlock()
+}
+
+// Resume ends a Pause.
+func (d *Driver) Resume() {
+	d.mu.Lock()
+	d.paused, d.pauseReason = false, ""
+	d.mu.Unlock()
+}
+
+// checkPaused returns the error for Open if the Driver is paused.
+func (d *Driver) checkPaused() error {
+	d.mu.Lock()
+	paused, reason := d.paused, d.pauseReason
+	d.mu.Unlock()
+	if !paused {
+		return nil
+	}
+	d.count(nil, "PausedRejections")
+	return fmt.Errorf("%w: %s", ErrClusterPaused, reason)
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import "context"
+
+// SetPrimaryResolver makes the Driver learn the current primary of an asynchronously
+// replicated cluster, whose primary may change (e.g. by orchestrator or MHA), from
+// resolver. The node it names gets RolePrimary, any former primary becomes a replica.
+//
+// resolver is consulted whenever a connection for writes is opened in read/write split
+// mode, and in every round of health checks (see SetHealthCheck). Connections of split
+// mode move their writes to a new primary when next used outside of a transaction.
+// Errors of resolver, and names of unknown nodes, leave the roles as they are; they are
+// counted as PrimaryResolverErrors in the expvar map of the driver. nil turns it off.
+func (d *Driver) SetPrimaryResolver(resolver func(ctx context.Context) (nodeName string, err error)) {
+	d.mu.Lock()
+	d.primaryResolver = resolver
+	d.mu.Unlock()
+}
+
+// resolvePrimary asks the primary resolver, if any, for the current primary and updates
+// the roles accordingly.
+func (d *Driver) resolvePrimary(ctx context.Context) error {
+	d.mu.Lock()
+	resolver := d.primaryResolver
+	d.mu.Unlock()
+	if resolver == nil {
+		return nil
+	}
+	name, err := resolver(ctx)
+	if err == nil {
+		d.mu.Lock()
+		if primary := d.nodes[name]; primary == nil {
+			err = unknownNode(name)
+		} else {
+			for _, n := range d.nodes {
+				if n == primary {
+					n.role = RolePrimary
+				} else if n != nil && n.role == RolePrimary {
+					n.role = RoleReplica
+				}
+			}
+		}
+		d.mu.Unlock()
+	}
+	if err != nil {
+		d.count(nil, "PrimaryResolverErrors")
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import "expvar"
+
+// QuarantineNode takes the named node out of rotation until ClearQuarantine is called,
+// e.g. when its data is suspected to be corrupt. Unlike an unhealthy node, which is
+// still dialed when the others fail and becomes healthy again as soon as it answers, a
+// quarantined node is not used for connections, canaries or shadow reads at all, and
+// stays unhealthy whatever health checks find. Connections already open to it are not
+// affected. reason is published as QuarantineReason in the expvar map of the node, next
+// to Quarantined.
+func (d *Driver) QuarantineNode(name, reason string) error {
+	d.mu.Lock()
+	n := d.nodes[name]
+	if n == nil {
+		d.mu.Unlock()
+		return unknownNode(name)
+	}
+	n.quarantined, n.quarantineReason = true, reason
+	d.mu.Unlock()
+	d.count(n, "Quarantines")
+	d.setHealthy(n, false)
+	return nil
+}
+
+// ClearQuarantine puts the named node, taken out with QuarantineNode, back into rotation.
+// It starts out unhealthy, until it is dialed or health checked successfully.
+func (d *Driver) ClearQuarantine(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	n.quarantined, n.quarantineReason = false, ""
+	return nil
+}
+
+// publishQuarantine publishes the quarantine status of n in its expvar map.
+func (d *Driver) publishQuarantine(n *node) {
+	n.exp.Set("Quarantined", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return n.quarantined
+	}))
+	n.exp.Set("QuarantineReason", expvar.Func(func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return n.quarantineReason
+	}))
+}
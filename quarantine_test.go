@@ -0,0 +1,89 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+
+	if err := d.QuarantineNode("a", "checksum mismatch"); err != nil {
+		t.Fatal(err)
+	}
+	exp := d.nodes["a"].exp
+	if exp.Get("Quarantined").String() != "true" || exp.Get("QuarantineReason").String() != `"checksum mismatch"` {
+		t.Errorf("published %s, %s", exp.Get("Quarantined"), exp.Get("QuarantineReason"))
+	}
+
+	// health checks pass, but a stays out
+	if res := d.PingAll(context.Background()); res["a"] != nil {
+		t.Fatalf("health check of a: %v", res["a"])
+	}
+	if d.nodes["a"].healthy {
+		t.Error("quarantined node marked healthy by a health check")
+	}
+	if got := d.PreviewSelection(); len(got) != 1 || got[0] != "b" {
+		t.Errorf("selection %v, want only b", got)
+	}
+	up.node("b", errFakeUnreachable, 0)
+	for i := 0; i < 10; i++ {
+		if _, err := d.Open(""); err == nil {
+			t.Fatal("opened a connection with only the quarantined node reachable")
+		}
+	}
+	if n := up.dialed("a"); n != 1 {
+		t.Errorf("a dialed %d times, want only by the health check", n)
+	}
+
+	if err := d.ClearQuarantine("a"); err != nil {
+		t.Fatal(err)
+	}
+	if exp.Get("Quarantined").String() != "false" || exp.Get("QuarantineReason").String() != `""` {
+		t.Errorf("published %s, %s after clearing", exp.Get("Quarantined"), exp.Get("QuarantineReason"))
+	}
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if !d.nodes["a"].healthy {
+		t.Error("a not healthy again after clearing")
+	}
+
+	if err := d.QuarantineNode("nope", ""); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("got %v, want ErrUnknownNode", err)
+	}
+	if err := d.ClearQuarantine("nope"); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("got %v, want ErrUnknownNode", err)
+	}
+}
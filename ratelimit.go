@@ -0,0 +1,146 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDialRateLimited is returned if no node could be dialed before the context of the
+// connection expired, because of the dial rate limit.
+var ErrDialRateLimited = errors.New("clustersql: dial rate limit exceeded")
+
+// SetDialRateLimit limits the number of upstream connections dialed by Open to
+// perSecond, evenly spaced, across all nodes. This protects the cluster from a storm
+// of reconnections, e.g. after it recovered from an outage. Dials wait for their turn;
+// if that would be after the deadline of the context of the connection, they fail with
+// ErrDialRateLimited right away. Health checks are not limited. 0 turns the limit off.
+func (d *Driver) SetDialRateLimit(perSecond int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if perSecond <= 0 {
+		d.dialInterval = 0
+		return
+	}
+	d.dialInterval = time.Second / time.Duration(perSecond)
+}
+
+// waitDial waits until the dial rate limit allows the next dial.
+func (d *Driver) waitDial(ctx context.Context) error {
+	d.mu.Lock()
+	if d.dialInterval == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	now := d.now()
+	at := d.nextDial
+	if at.Before(now) {
+		at = now
+	}
+	if deadline, ok := ctx.Deadline(); ok && at.After(deadline) {
+		d.mu.Unlock()
+		return ErrDialRateLimited
+	}
+	d.nextDial = at.Add(d.dialInterval)
+	d.mu.Unlock()
+
+	if wait := at.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ErrDialRateLimited
+		}
+	}
+	return nil
+}
+
+// ErrTooManyPendingOpens is returned (possibly wrapped) by Open if too many Opens are
+// dialing already, see SetMaxPendingOpens.
+var ErrTooManyPendingOpens = errors.New("clustersql: too many pending opens")
+
+// SetMaxPendingOpens limits the number of Opens dialing nodes at the same time, to
+// protect the cluster from a storm of connection attempts by the application. Unlike
+// SetMaxTotalConns, it only bounds connections being established, not those in use.
+// Further Opens wait for one in progress to finish as long as the context of the
+// connection allows, and fail with an error wrapping ErrTooManyPendingOpens and the
+// context's error once it is done. Without a context that can be done, as with Open,
+// ErrTooManyPendingOpens is returned right away. Either is counted as
+// TooManyPendingOpens in the expvar map of the driver. 0, the default, means no limit.
+func (d *Driver) SetMaxPendingOpens(max int) {
+	d.mu.Lock()
+	d.maxPendingOpens = max
+	d.openFinished()
+	d.mu.Unlock()
+}
+
+// enterOpen waits, as described for SetMaxPendingOpens, until an Open may start dialing.
+// It must be followed by leaveOpen.
+func (d *Driver) enterOpen(ctx context.Context) error {
+	d.mu.Lock()
+	for d.maxPendingOpens > 0 && d.pendingOpens >= d.maxPendingOpens {
+		if ctx.Done() == nil {
+			d.mu.Unlock()
+			d.count(nil, "TooManyPendingOpens")
+			return ErrTooManyPendingOpens
+		}
+		if d.opened == nil {
+			d.opened = make(chan struct{})
+		}
+		opened := d.opened
+		d.mu.Unlock()
+		select {
+		case <-opened:
+		case <-ctx.Done():
+			d.count(nil, "TooManyPendingOpens")
+			return fmt.Errorf("%w: %w", ErrTooManyPendingOpens, ctx.Err())
+		}
+		d.mu.Lock()
+	}
+	d.pendingOpens++
+	d.mu.Unlock()
+	return nil
+}
+
+// leaveOpen ends an Open started with enterOpen.
+func (d *Driver) leaveOpen() {
+	d.mu.Lock()
+	d.pendingOpens--
+	d.openFinished()
+	d.mu.Unlock()
+}
+
+// openFinished wakes up the Opens waiting in enterOpen. d.mu must be held.
+func (d *Driver) openFinished() {
+	if d.opened != nil {
+		close(d.opened)
+		d.opened = nil
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialRateLimit(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	d.SetDialRateLimit(100)
+
+	start := time.Now()
+	for i := 0; i < 21; i++ {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	// the first dial is immediate, the other 20 are spaced by 10ms
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("21 dials took %s at 100 per second", elapsed)
+	}
+
+	// a dial that would have to wait beyond the deadline fails right away
+	d.SetDialRateLimit(1)
+	connector, _ := d.OpenConnector("")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c, err := connector.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	start = time.Now()
+	if _, err := connector.Connect(ctx); err != ErrDialRateLimited {
+		t.Errorf("got %v, want %v", err, ErrDialRateLimited)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("rate limited dial took %s to fail", elapsed)
+	}
+	if a := d.nodes["a"]; !a.healthy || a.exp.Get("Errors") != nil {
+		t.Error("rate limiting counted against the node")
+	}
+
+	d.SetDialRateLimit(0)
+	if _, err := connector.Connect(ctx); err != nil {
+		t.Errorf("without a limit: %v", err)
+	}
+}
+
+func TestMaxPendingOpens(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 20*time.Millisecond)
+	d := newTestDriver(up, "a")
+	d.SetMaxPendingOpens(2)
+	var mu sync.Mutex
+	dialing, most := 0, 0
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			mu.Lock()
+			dialing++
+			if dialing > most {
+				most = dialing
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				dialing--
+				mu.Unlock()
+			}()
+			return next(dsn)
+		}
+	})
+
+	// with a context, excess Opens wait their turn
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := (connector{d}).Connect(ctx)
+			if err == nil {
+				c.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Connect: %v", err)
+		}
+	}
+	if most != 2 {
+		t.Errorf("%d Opens dialing at the same time, want 2", most)
+	}
+
+	// without one, they fail right away
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			started <- struct{}{}
+			<-release
+			return next(dsn)
+		}
+	})
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c, err := d.Open(""); err == nil {
+				c.Close()
+			}
+		}()
+		<-started
+	}
+	if _, err := d.Open(""); err != ErrTooManyPendingOpens {
+		t.Errorf("got %v, want ErrTooManyPendingOpens", err)
+	}
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := (connector{d}).Connect(short); !errors.Is(err, ErrTooManyPendingOpens) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrTooManyPendingOpens and the deadline", err)
+	}
+	close(release)
+	wg.Wait()
+	if got := d.exp.Get("TooManyPendingOpens").String(); got != "2" {
+		t.Errorf("TooManyPendingOpens = %s, want 2", got)
+	}
+	if d.pendingOpens != 0 || d.totalConns != 0 {
+		t.Errorf("%d pending Opens and %d connections left over", d.pendingOpens, d.totalConns)
+	}
+}
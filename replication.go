@@ -0,0 +1,77 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+)
+
+// ErrReplicationBehind is returned if the only nodes that could be opened had not
+// yet applied the replication position required with WithMinReplicationPos.
+var ErrReplicationBehind = errors.New("clustersql: node behind required replication position")
+
+// ReplicationGate reports whether the node conn is connected to has applied at least
+// minPos, e.g. by running SELECT WAIT_FOR_EXECUTED_GTID_SET(minPos, 0) on it.
+type ReplicationGate func(ctx context.Context, conn driver.Conn, minPos string) (bool, error)
+
+// SetReplicationGate enables read-your-writes consistency: connections opened with a
+// context from WithMinReplicationPos are checked with gate after dialing, and only
+// handed out if the node has caught up. Otherwise, the next node is tried. Primaries
+// are not checked. nil, the default, turns checking off.
+//
+// Being behind does not make a node unhealthy. Errors returned by gate count as
+// errors of the node.
+func (d *Driver) SetReplicationGate(gate ReplicationGate) {
+	d.mu.Lock()
+	d.replicationGate = gate
+	d.mu.Unlock()
+}
+
+// checkReplication returns nil if conn, a fresh connection to n, can be used for ctx
+// as far as replication is concerned.
+func (d *Driver) checkReplication(ctx context.Context, n *node, conn driver.Conn) error {
+	pos, ok := ctx.Value(minReplicationPosCtx).(string)
+	if !ok {
+		return nil
+	}
+	d.mu.Lock()
+	gate, role := d.replicationGate, n.role
+	d.mu.Unlock()
+	if gate == nil || role == RolePrimary {
+		return nil
+	}
+	applied, err := gate(ctx, conn, pos)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		d.count(n, "ReplicationBehind")
+		return ErrReplicationBehind
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"testing"
+)
+
+func TestReplicationGate(t *testing.T) {
+	up := newFakeDriver()
+	applied := map[string]int{"r1": 5, "r2": 10, "r3": 20}
+	for dsn := range applied {
+		up.node(dsn, nil, 0)
+	}
+	d := newTestDriver(up, "r1", "r2", "r3")
+	for name := range applied {
+		d.SetNodeRole(name, RoleReplica)
+	}
+	d.SetReplicationGate(func(ctx context.Context, conn driver.Conn, minPos string) (bool, error) {
+		min, err := strconv.Atoi(minPos)
+		if err != nil {
+			return false, err
+		}
+		return applied[conn.(*fakeConn).dsn] >= min, nil
+	})
+	connector, _ := d.OpenConnector("")
+
+	for i := 0; i < 10; i++ {
+		c, err := connector.Connect(WithMinReplicationPos(context.Background(), "15"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(wrapped).base().n.Name; got != "r3" {
+			t.Errorf("connection went to %s, which is behind", got)
+		}
+		c.Close()
+	}
+
+	if _, err := connector.Connect(WithMinReplicationPos(context.Background(), "25")); err != ErrReplicationBehind {
+		t.Errorf("all nodes behind: got %v, want %v", err, ErrReplicationBehind)
+	}
+	for name := range applied {
+		n := d.nodes[name]
+		if !n.healthy || n.exp.Get("Errors") != nil {
+			t.Errorf("%s: being behind counted as failure", name)
+		}
+		if n.live != 0 {
+			t.Errorf("%s: %d live connections left", name, n.live)
+		}
+	}
+	if v := d.nodes["r1"].exp.Get("ReplicationBehind"); v == nil || v.String() == "0" {
+		t.Errorf("r1: ReplicationBehind = %v", v)
+	}
+
+	// without a position, any node will do
+	if _, err := connector.Connect(context.Background()); err != nil {
+		t.Error(err)
+	}
+	// primaries are not checked
+	d.SetNodeRole("r1", RolePrimary)
+	c, err := connector.Connect(WithMinReplicationPos(context.Background(), "25"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(wrapped).base().n.Name; got != "r1" {
+		t.Errorf("connection went to %s, want the primary", got)
+	}
+	c.Close()
+	d.SetNodeRole("r1", RoleReplica)
+	// errors of the gate count as node errors
+	if _, err := connector.Connect(WithMinReplicationPos(context.Background(), "x")); err == nil || err == ErrReplicationBehind {
+		t.Errorf("expected the error of the gate, got %v", err)
+	}
+	if d.nodes["r2"].exp.Get("Errors") == nil {
+		t.Error("gate error not recorded")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"math"
+	"time"
+)
+
+// retryPolicy says how often and how patiently Open tries again when no node could be opened.
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// delay returns how long to wait before retry number attempt (starting at 0): the
+// backoff, doubled for every earlier retry, but never more than maxBackoff if set.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	delay := p.backoff
+	for i := 0; i < attempt; i++ {
+		if p.maxBackoff > 0 && delay >= p.maxBackoff {
+			break
+		}
+		if delay > math.MaxInt64/2 {
+			break // don't overflow on long outages without a cap
+		}
+		delay *= 2
+	}
+	if p.maxBackoff > 0 && delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	return delay
+}
+
+// SetRetry makes Open try again, up to attempts times, if no node could be opened. It
+// waits backoff before the first retry, doubling the wait for every further one, but
+// never waits longer than maxBackoff (0 means no cap). Waiting ends early, with the
+// context's error, if the context of the connection is done. attempts 0 turns
+// retrying off, which is the default.
+//
+// Retries are counted as Retries in the expvar map of the driver.
+func (d *Driver) SetRetry(attempts int, backoff, maxBackoff time.Duration) {
+	d.mu.Lock()
+	d.retry = retryPolicy{attempts, backoff, maxBackoff}
+	d.mu.Unlock()
+}
+
+// openRetry opens a connection to one of the nodes accepted by accept, retrying as
+// configured by SetRetry.
+func (d *Driver) openRetry(ctx context.Context, accept func(*node) bool) (driver.Conn, error) {
+	d.mu.Lock()
+	p := d.retry
+	d.mu.Unlock()
+	failed := 0
+	for attempt := 0; ; attempt++ {
+		c, err := d.openOnce(ctx, accept, &failed)
+		if err == nil || err == ErrNoNodes || err == ErrNoEligibleNodes || attempt >= p.attempts || d.fatal(err) {
+			return c, err
+		}
+		if max := maxAttempts(ctx); max > 0 && failed >= max {
+			return c, err
+		}
+		timer := time.NewTimer(p.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		d.count(nil, "Retries")
+	}
+}
+
+// SetReadRetry makes reads that fail with a node-level error (see SetNodeErrorClassifier)
+// before returning any rows be retried on another connection, which database/sql opens
+// right away, by reporting driver.ErrBadConn to it. The node is marked unhealthy, so the
+// new connection goes elsewhere if possible. Only statements the read classifier (see
+// SetReadClassifier) considers reads are retried, and none within transactions. Errors
+// while reading rows can't be retried. Retries are counted as ReadRetries in the expvar
+// map of the node.
+func (d *Driver) SetReadRetry(enabled bool) {
+	d.mu.Lock()
+	d.readRetry = enabled
+	d.mu.Unlock()
+}
@@ -0,0 +1,223 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	capped := retryPolicy{attempts: 100, backoff: 100 * time.Millisecond, maxBackoff: 2 * time.Second}
+	want := []time.Duration{100, 200, 400, 800, 1600, 2000, 2000}
+	for i, w := range want {
+		if got := capped.delay(i); got != w*time.Millisecond {
+			t.Errorf("delay(%d) = %s, want %s", i, got, w*time.Millisecond)
+		}
+	}
+	for i := len(want); i < 100; i++ {
+		if got := capped.delay(i); got != capped.maxBackoff {
+			t.Fatalf("delay(%d) = %s, want it to stay at the cap %s", i, got, capped.maxBackoff)
+		}
+	}
+
+	uncapped := retryPolicy{attempts: 100, backoff: time.Second}
+	if got := uncapped.delay(3); got != 8*time.Second {
+		t.Errorf("uncapped delay(3) = %s, want 8s", got)
+	}
+	for i := 0; i < 100; i++ {
+		if got := uncapped.delay(i); got <= 0 {
+			t.Fatalf("uncapped delay(%d) overflowed: %s", i, got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a")
+	errDown := errors.New("down")
+	var mu sync.Mutex
+	failures := 2
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failures > 0 {
+				failures--
+				return nil, errDown
+			}
+			return next(dsn)
+		}
+	})
+
+	if _, err := d.Open(""); err != errDown {
+		t.Fatalf("without retries: got %v, want %v", err, errDown)
+	}
+
+	d.SetRetry(3, time.Millisecond, 2*time.Millisecond)
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := up.dialed("a"); n != 1 {
+		t.Errorf("a reached %d times, want 1", n)
+	}
+	if v := d.exp.Get("Retries"); v == nil || v.String() != "1" {
+		t.Errorf("Retries = %v, want 1", v)
+	}
+
+	// waiting for a retry ends with the context
+	mu.Lock()
+	failures = 10
+	mu.Unlock()
+	d.SetRetry(3, time.Hour, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	connector, err := d.OpenConnector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connector.Connect(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// droppingConn fails every query as if the node dropped the connection.
+type droppingConn struct{ fakeConn }
+
+func (c *droppingConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return nil, &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+}
+
+func TestReadRetry(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b")
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "a" {
+				return &droppingConn{}, nil
+			}
+			return next(dsn)
+		}
+	})
+	d.SetNodeWeight("a", 10)
+	d.SetFanout(1)
+	d.SetReadRetry(true)
+	db := sql.OpenDB(connector{d})
+	defer db.Close()
+	reset := func() {
+		db.SetMaxIdleConns(0) // drop idle connections
+		db.SetMaxIdleConns(2)
+		d.setHealthy(d.nodes["a"], true)
+	}
+
+	var dsn string
+	if err := db.QueryRow("SELECT 1").Scan(&dsn); err != nil || dsn != "b" {
+		t.Errorf("read not retried on b: %s, %v", dsn, err)
+	}
+	if v := d.nodes["a"].exp.Get("ReadRetries"); v == nil || v.String() != "1" {
+		t.Errorf("ReadRetries = %v, want 1", v)
+	}
+	if d.nodes["a"].healthy {
+		t.Error("a still healthy")
+	}
+
+	// neither are locking reads
+	reset()
+	var nodeErr *NodeError
+	if err := db.QueryRow("SELECT 1 FOR UPDATE").Scan(&dsn); !errors.As(err, &nodeErr) || nodeErr.Node != "a" {
+		t.Errorf("locking read: got %v, want the error of a", err)
+	}
+	// nor reads in transactions
+	reset()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.QueryRow("SELECT 1").Scan(&dsn); !errors.As(err, &nodeErr) || nodeErr.Node != "a" {
+		t.Errorf("read in transaction: got %v, want the error of a", err)
+	}
+	tx.Rollback()
+
+	d.SetReadRetry(false)
+	reset()
+	if err := db.QueryRow("SELECT 1").Scan(&dsn); !errors.As(err, &nodeErr) {
+		t.Errorf("read without retry: got %v, want a NodeError", err)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	var names []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("galera%d", i)
+		names = append(names, name)
+		d.AddNode(name, name) // unreachable
+	}
+	dialed := func() int {
+		total := 0
+		for _, name := range names {
+			total += up.dialed(name)
+		}
+		return total
+	}
+
+	ctx := WithMaxAttempts(context.Background(), 3)
+	if _, err := (connector{d}).Connect(ctx); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := dialed(); got != 3 {
+		t.Errorf("dialed %d nodes, want 3", got)
+	}
+
+	// retries count against the same limit
+	d.SetRetry(5, time.Millisecond, time.Millisecond)
+	if _, err := (connector{d}).Connect(ctx); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := dialed(); got != 6 {
+		t.Errorf("dialed %d nodes with retries, want 3 more", got)
+	}
+
+	if _, err := (connector{d}).Connect(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := dialed(); got != 6+6*10 {
+		t.Errorf("dialed %d nodes without a limit, want all of them on every try", got-6)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RouteTrace describes how Open decided which nodes to dial, see SetRouteTracer.
+type RouteTrace struct {
+	// Balancer is the type of the Balancer used, e.g. "clustersql.Weighted".
+	Balancer string
+	// Candidates are the nodes handed to the Balancer, sorted by name, with the weights,
+	// health and everything else it based its decision on.
+	Candidates []NodeState
+	// Excluded are the registered nodes that are not dialed, sorted by name.
+	Excluded []RouteExclusion
+	// Order are the names of the nodes to be dialed, in order. It is the order of the
+	// Balancer, rearranged for read preference, local zone and SetWarmFanout.
+	Order []string
+	// Fanout is the number of nodes dialed in parallel.
+	Fanout int
+}
+
+// RouteExclusion is a node left out of a RouteTrace, along with the reason, which is one of
+// the Route* constants, and details on the state of the node, if any.
+type RouteExclusion struct {
+	Node   string
+	Reason string
+	Detail string // e.g. the reason given to QuarantineNode
+}
+
+func (e RouteExclusion) String() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("node %q: skipped (%s)", e.Node, e.Reason)
+	}
+	return fmt.Sprintf("node %q: skipped (%s: %s)", e.Node, e.Reason, e.Detail)
+}
+
+// Reasons for a RouteExclusion.
+const (
+	RouteQuarantined = "quarantined"                      // see QuarantineNode
+	RouteIneligible  = "not eligible for this connection" // e.g. a canary or shadow, or not the forced node
+	RouteLeftOut     = "left out by the balancer"
+	RouteGuarded     = "rejected by the selection guard" // see SetSelectionGuard
+	RouteAtLimit     = "at its connection limit"         // see SetNodeMaxConns; not known before dialing
+)
+
+// SetRouteTracer makes tracer be called with the decision of the Balancer on every attempt to
+// open a connection, retries and canary attempts included, just before the nodes are dialed.
+// This is meant for debugging routing, as it is verbose; it is off by default. tracer is
+// called concurrently by concurrent Opens. nil turns it off.
+func (d *Driver) SetRouteTracer(tracer func(RouteTrace)) {
+	d.mu.Lock()
+	d.routeTracer = tracer
+	d.mu.Unlock()
+}
+
+// exclude records that node is not dialed for reason. It does nothing if t is nil.
+func (t *RouteTrace) exclude(node, reason, detail string) {
+	if t != nil {
+		t.Excluded = append(t.Excluded, RouteExclusion{node, reason, detail})
+	}
+}
+
+// posture describes the health of n at now, for a RouteExclusion. d.mu must be held.
+func (d *Driver) posture(n *node, now time.Time) string {
+	switch {
+	case !n.healthy && n.failures > 0:
+		return fmt.Sprintf("unhealthy after %d consecutive failures", n.failures)
+	case !n.healthy:
+		return "unhealthy"
+	case d.settling(n, now):
+		return fmt.Sprintf("recovering, %v of failback debounce remaining", n.upSince.Add(d.failbackDebounce).Sub(now).Round(time.Second))
+	}
+	return "healthy"
+}
+
+// traceRoute completes t with the nodes to be dialed and hands it to tracer, if any. It does
+// nothing if t is nil.
+func traceRoute(tracer func(RouteTrace), t *RouteTrace, b Balancer, nodes []*node, fanout int) {
+	if t == nil {
+		return
+	}
+	t.Balancer = fmt.Sprintf("%T", b)
+	t.Fanout = fanout
+	for _, n := range nodes {
+		t.Order = append(t.Order, n.Name)
+	}
+	t.sortExcluded()
+	if tracer != nil {
+		tracer(*t)
+	}
+}
+
+func (t *RouteTrace) sortExcluded() {
+	sort.Slice(t.Excluded, func(i, j int) bool { return t.Excluded[i].Node < t.Excluded[j].Node })
+}
+
+// skipped returns the nodes excluded in t for a reason worth reporting in an OpenError, sorted
+// by name; nodes not eligible for the connection in the first place are left out.
+func (t *RouteTrace) skipped() []RouteExclusion {
+	var skipped []RouteExclusion
+	for _, e := range t.Excluded {
+		if e.Reason != RouteIneligible {
+			skipped = append(skipped, e)
+		}
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Node < skipped[j].Node })
+	return skipped
+}
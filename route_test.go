@@ -0,0 +1,118 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestRouteTracer(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", nil, 0)
+	d := newTestDriver(up, "a", "b", "c")
+	d.SetNodeWeight("a", 1)
+	d.SetNodeWeight("b", 3)
+	d.checkNode(context.Background(), d.nodes["c"], 0) // c is unreachable, opening its breaker
+	d.SetBalancer(BalancerFunc(func(ctx context.Context, nodes []NodeState) []string {
+		var healthy []NodeState
+		for _, n := range nodes {
+			if n.Healthy {
+				healthy = append(healthy, n)
+			}
+		}
+		return Weighted{}.Order(ctx, healthy)
+	}))
+	var mu sync.Mutex
+	var traces []RouteTrace
+	d.SetRouteTracer(func(rt RouteTrace) {
+		mu.Lock()
+		traces = append(traces, rt)
+		mu.Unlock()
+	})
+
+	c, err := connector{d}.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces, want 1", len(traces))
+	}
+	rt := traces[0]
+	if rt.Balancer != "clustersql.BalancerFunc" {
+		t.Errorf("Balancer = %q, want clustersql.BalancerFunc", rt.Balancer)
+	}
+	type candidate struct {
+		name    string
+		weight  float64
+		healthy bool
+	}
+	var got []candidate
+	for _, n := range rt.Candidates {
+		got = append(got, candidate{n.Name, n.Weight, n.Healthy})
+	}
+	if want := []candidate{{"a", 1, true}, {"b", 3, true}, {"c", 1, false}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Candidates = %v, want %v", got, want)
+	}
+	if want := []RouteExclusion{{"c", RouteLeftOut, "unhealthy after 1 consecutive failures"}}; !reflect.DeepEqual(rt.Excluded, want) {
+		t.Errorf("Excluded = %v, want %v", rt.Excluded, want)
+	}
+	if want := []string{"b", "a"}; !reflect.DeepEqual(rt.Order, want) {
+		t.Errorf("Order = %q, want %q", rt.Order, want)
+	}
+	if rt.Fanout != 2 {
+		t.Errorf("Fanout = %d, want 2", rt.Fanout)
+	}
+}
+
+func TestRouteTracerExclusions(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	d := newTestDriver(up, "a", "b", "c")
+	d.QuarantineNode("b", "maintenance")
+	d.SetSelectionGuard(func(node NodeInfo, ctx context.Context) bool { return node.Name != "c" })
+	var rt RouteTrace
+	d.SetRouteTracer(func(t RouteTrace) { rt = t })
+
+	c, err := connector{d}.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if want := []RouteExclusion{{"b", RouteQuarantined, "maintenance"}, {"c", RouteGuarded, ""}}; !reflect.DeepEqual(rt.Excluded, want) {
+		t.Errorf("Excluded = %v, want %v", rt.Excluded, want)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(rt.Order, want) {
+		t.Errorf("Order = %q, want %q", rt.Order, want)
+	}
+}
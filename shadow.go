@@ -0,0 +1,320 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync"
+)
+
+// ShadowDivergence describes a read whose result on the shadow node differed from the one
+// the application got, see SetShadowNode.
+type ShadowDivergence struct {
+	Query      string
+	Node       string // the node that answered the application
+	Shadow     string
+	Rows       [][]driver.Value // as read by the application
+	ShadowRows [][]driver.Value
+	ShadowErr  error // if the shadow failed to answer, ShadowRows is nil
+}
+
+// SetShadowNode takes the registered node name out of the rotation, and mirrors roughly
+// sampleFraction (between 0 and 1) of the reads (see SetReadClassifier) run on other
+// nodes to it, e.g. to validate a new database version. Divergences are reported to the
+// function set with SetShadowDivergence, and counted as ShadowDivergences in the expvar
+// map of the driver; mirrored reads are counted as ShadowQueries.
+//
+// Mirroring is best-effort and never delays the application: the shadow runs the query
+// on a connection of its own in the background, outside of any transaction, and its result
+// is compared to the first result set once the application closes the rows. The order of
+// the rows does not matter, as it is undefined without ORDER BY. If the application did not
+// read all of them, as with QueryRow, the rows it read only have to be among those of the
+// shadow. Prepared statements are not mirrored.
+//
+// A sampleFraction of 0 stops mirroring and puts the node back into rotation.
+func (d *Driver) SetShadowNode(name string, sampleFraction float64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	n.shadow = sampleFraction
+	return nil
+}
+
+// SetShadowDivergence sets the function reads diverging on the shadow node are reported to.
+// It is called from a goroutine of its own. nil turns reporting off, and with it mirroring.
+func (d *Driver) SetShadowDivergence(report func(ShadowDivergence)) {
+	d.mu.Lock()
+	d.shadowReport = report
+	d.mu.Unlock()
+}
+
+// pickShadow returns the node to mirror query, run on c, to, if any. In that case, the
+// goroutine doing so is added to d.wg, see Close.
+func (c *conn) pickShadow(query string) *node {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if c.d.shadowReport == nil || c.d.closed || !c.d.isRead(query) {
+		return nil
+	}
+	for _, n := range c.d.nodes {
+		if n != nil && n != c.n && n.shadow > 0 && !n.quarantined && rand.Float64() < n.shadow {
+			c.d.wg.Add(1)
+			return n
+		}
+	}
+	return nil
+}
+
+// shadow mirrors query to the shadow node, if it is picked, and returns rows teeing what
+// the application reads for the comparison. Otherwise, it returns rows.
+func (c *conn) shadow(query string, args []driver.NamedValue, rows driver.Rows) driver.Rows {
+	n := c.pickShadow(query)
+	if n == nil {
+		return rows
+	}
+	c.d.mu.Lock()
+	timeout := c.d.queryTimeout
+	c.d.mu.Unlock()
+	c.d.count(nil, "ShadowQueries")
+	args = append([]driver.NamedValue(nil), args...)
+	shadowed := make(chan shadowResult, 1)
+	go func() {
+		defer c.d.wg.Done()
+		ctx, cancel := c.d.closing, context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		defer cancel()
+		rows, err := c.d.queryShadow(ctx, n, query, args)
+		shadowed <- shadowResult{rows, err}
+	}()
+	return &teeRows{Rows: rows, c: c, query: query, shadow: n, shadowed: shadowed}
+}
+
+// queryShadow runs query on a connection of its own to n, and reads all rows of the first result set.
+func (d *Driver) queryShadow(ctx context.Context, n *node, query string, args []driver.NamedValue) ([][]driver.Value, error) {
+	var res [][]driver.Value
+	err := d.queryNode(ctx, n, query, args, func(rows driver.Rows) error {
+		for {
+			dest := make([]driver.Value, len(rows.Columns()))
+			if err := rows.Next(dest); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			res = append(res, copyValues(dest))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+type shadowResult struct {
+	rows [][]driver.Value
+	err  error
+}
+
+// teeRows records the rows of the first result set read by the application, to compare
+// them to the result of the shadow once closed. Its optional methods behave like
+// database/sql does for rows not implementing them.
+type teeRows struct {
+	driver.Rows
+	c        *conn
+	query    string
+	shadow   *node
+	shadowed chan shadowResult
+	read     [][]driver.Value
+	complete bool // all rows of the first result set have been read
+	moved    bool // the application went on to the next result set
+	once     sync.Once
+}
+
+func (r *teeRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if !r.moved {
+		switch err {
+		case nil:
+			r.read = append(r.read, copyValues(dest))
+		case io.EOF:
+			r.complete = true
+		}
+	}
+	return err
+}
+
+func (r *teeRows) Close() error {
+	err := r.Rows.Close()
+	r.once.Do(func() {
+		d := r.c.d
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.closed {
+			return
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			r.compare()
+		}()
+	})
+	return err
+}
+
+// compare waits for the shadow and reports a divergence, if any. It runs in a goroutine
+// added to d.wg, unless the Driver is closed by the time the rows are.
+func (r *teeRows) compare() {
+	res := <-r.shadowed
+	if res.err == nil && sameRows(normalizeRows(r.read), normalizeRows(res.rows), r.complete) {
+		return
+	}
+	if res.err != nil && r.c.d.closing.Err() != nil {
+		return // canceled by Close
+	}
+	r.c.d.count(nil, "ShadowDivergences")
+	r.c.d.mu.Lock()
+	report := r.c.d.shadowReport
+	r.c.d.mu.Unlock()
+	if report != nil {
+		report(ShadowDivergence{
+			Query:      r.query,
+			Node:       r.c.n.Name,
+			Shadow:     r.shadow.Name,
+			Rows:       r.read,
+			ShadowRows: res.rows,
+			ShadowErr:  res.err,
+		})
+	}
+}
+
+func (r *teeRows) HasNextResultSet() bool {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *teeRows) NextResultSet() error {
+	rs, ok := r.Rows.(driver.RowsNextResultSet)
+	if !ok {
+		return io.EOF
+	}
+	r.moved = true
+	return rs.NextResultSet()
+}
+
+func (r *teeRows) ColumnTypeScanType(index int) reflect.Type {
+	if t, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return t.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *teeRows) ColumnTypeDatabaseTypeName(index int) string {
+	if t, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return t.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *teeRows) ColumnTypeLength(index int) (length int64, ok bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return t.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *teeRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return t.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *teeRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return t.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+// sameRows reports whether read and shadow hold the same rows, in any order. If read is not
+// complete, its rows only have to be among those of shadow.
+func sameRows(read, shadow [][]driver.Value, complete bool) bool {
+	if complete && len(read) != len(shadow) || len(read) > len(shadow) {
+		return false
+	}
+	if reflect.DeepEqual(read, shadow[:len(read)]) {
+		return true
+	}
+	matched := make([]bool, len(shadow))
+rows:
+	for _, row := range read {
+		for i, s := range shadow {
+			if !matched[i] && reflect.DeepEqual(row, s) {
+				matched[i] = true
+				continue rows
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// copyValues copies a row, including byte slices, which the driver may reuse.
+func copyValues(row []driver.Value) []driver.Value {
+	res := make([]driver.Value, len(row))
+	for i, v := range row {
+		if b, ok := v.([]byte); ok {
+			v = append([]byte(nil), b...)
+		}
+		res[i] = v
+	}
+	return res
+}
+
+// normalizeRows turns byte slices into strings, as drivers differ in which they return for text columns.
+func normalizeRows(rows [][]driver.Value) [][]driver.Value {
+	res := make([][]driver.Value, len(rows))
+	for i, row := range rows {
+		res[i] = make([]driver.Value, len(row))
+		for j, v := range row {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			res[i][j] = v
+		}
+	}
+	return res
+}
@@ -0,0 +1,191 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShadowNode(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("shadow", nil, 0)
+	d := newTestDriver(up, "a", "shadow")
+	if err := d.SetShadowNode("nope", 1); err == nil {
+		t.Error("SetShadowNode accepted an unknown node")
+	}
+	if err := d.SetShadowNode("shadow", 1); err != nil {
+		t.Fatal(err)
+	}
+	divergences := make(chan ShadowDivergence, 10)
+	d.SetShadowDivergence(func(div ShadowDivergence) { divergences <- div })
+	db := sql.OpenDB(connector{d})
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		var value string
+		if err := db.QueryRow("SELECT value").Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		// the fake answers with the DSN of the node, so the shadow always diverges
+		if value != "a" {
+			t.Fatalf("application got %q from the shadow", value)
+		}
+		select {
+		case div := <-divergences:
+			want := ShadowDivergence{
+				Query:      "SELECT value",
+				Node:       "a",
+				Shadow:     "shadow",
+				Rows:       [][]driver.Value{{"a"}},
+				ShadowRows: [][]driver.Value{{"shadow"}},
+			}
+			if !reflect.DeepEqual(div, want) {
+				t.Errorf("got divergence %+v, want %+v", div, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("divergence not reported")
+		}
+	}
+	if _, err := db.Exec("UPDATE t SET x = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := up.executed("shadow"); !reflect.DeepEqual(got, []string{"SELECT value", "SELECT value", "SELECT value"}) {
+		t.Errorf("shadow ran %q, want the reads only", got)
+	}
+	if got := d.exp.Get("ShadowDivergences").String(); got != "3" {
+		t.Errorf("ShadowDivergences = %s, want 3", got)
+	}
+	if state := d.State(); state != Healthy {
+		t.Errorf("shadow counts for State: %v", state)
+	}
+
+	if err := d.SetShadowNode("shadow", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.PreviewSelection(); len(got) != 2 {
+		t.Errorf("shadow not back in rotation: %v", got)
+	}
+}
+
+func TestShadowAfterClose(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("shadow", nil, 0)
+	d := newTestDriver(up, "a", "shadow")
+	d.SetShadowNode("shadow", 1)
+	d.SetShadowDivergence(func(div ShadowDivergence) { t.Errorf("divergence %+v reported after Close", div) })
+	c, err := connector{d}.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rows, err := c.(driver.QueryerContext).QueryContext(context.Background(), "SELECT value", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	rows.Close()
+	if v := d.exp.Get("ShadowDivergences"); v != nil && v.String() != "0" {
+		t.Errorf("ShadowDivergences = %s after Close, want 0", v)
+	}
+}
+
+func TestShadowCanceledByClose(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("shadow", nil, 0)
+	d := newTestDriver(up, "a", "shadow")
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "shadow" {
+				close(started)
+				<-release // the shadow never answers
+			}
+			return next(dsn)
+		}
+	})
+	d.SetShadowNode("shadow", 1)
+	d.SetShadowDivergence(func(div ShadowDivergence) { t.Errorf("divergence %+v reported for a canceled shadow", div) })
+	c, err := connector{d}.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rows, err := c.(driver.QueryerContext).QueryContext(context.Background(), "SELECT value", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waits for a shadow query that never ends")
+	}
+}
+
+func TestSameRows(t *testing.T) {
+	rows := func(values ...string) [][]driver.Value {
+		var res [][]driver.Value
+		for _, v := range values {
+			res = append(res, []driver.Value{v})
+		}
+		return res
+	}
+	for _, c := range []struct {
+		read, shadow [][]driver.Value
+		complete     bool
+		want         bool
+	}{
+		{rows("a", "b"), rows("a", "b"), true, true},
+		{rows("a", "b"), rows("b", "a"), true, true},
+		{rows("a", "a", "b"), rows("a", "b", "b"), true, false},
+		{rows("a", "b"), rows("a", "b", "c"), true, false},
+		{rows("a", "b", "c"), rows("a", "b"), false, false},
+		// the application stopped reading early
+		{rows("c"), rows("a", "b", "c"), false, true},
+		{rows("d"), rows("a", "b", "c"), false, false},
+		{rows(), rows("a"), false, true},
+	} {
+		if got := sameRows(c.read, c.shadow, c.complete); got != c.want {
+			t.Errorf("sameRows(%v, %v, %v) = %v, want %v", c.read, c.shadow, c.complete, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is what the Driver logs to, see SetLogger. It has the signature of the Logger
+// of Go-MySQL, so the same one can be used for both.
+type Logger interface {
+	Print(v ...interface{})
+}
+
+// defaultLogger is used unless SetLogger is called.
+var defaultLogger Logger = log.New(os.Stderr, "[clustersql] ", log.Ldate|log.Ltime)
+
+// SetLogger sets the Logger the Driver logs to, which is a log.Logger writing to
+// standard error by default. nil restores the default. So far, only the slow Open
+// log (see SetSlowOpenLog) and nodes added with the address of another node are logged.
+func (d *Driver) SetLogger(l Logger) {
+	if l == nil {
+		l = defaultLogger
+	}
+	d.mu.Lock()
+	d.logger = l
+	d.mu.Unlock()
+}
+
+// SetSlowOpenLog makes the Driver log every Open taking longer than threshold, from
+// being called to having a connection or giving up, along with the nodes it dialed
+// and how long each of them took, to surface intermittently slow connects. Dials still
+// in progress when Open returned are logged as such. 0, the default, turns it off.
+func (d *Driver) SetSlowOpenLog(threshold time.Duration) {
+	d.mu.Lock()
+	d.slowOpen = threshold
+	d.mu.Unlock()
+}
+
+// openTrace records the dials of an Open for the slow Open log.
+type openTrace struct {
+	mu    sync.Mutex
+	dials []tracedDial
+}
+
+// tracedDial is a dial recorded in an openTrace.
+type tracedDial struct {
+	node    string
+	elapsed time.Duration
+	err     error
+	done    bool
+}
+
+// traceOpen returns ctx set up to record the dials of an Open, and a function to be
+// called when it's done, if the slow Open log is on. Otherwise it returns ctx as it is
+// and a function doing nothing.
+func (d *Driver) traceOpen(ctx context.Context) (context.Context, func()) {
+	d.mu.Lock()
+	threshold, l, start := d.slowOpen, d.logger, d.now()
+	d.mu.Unlock()
+	if threshold <= 0 {
+		return ctx, func() {}
+	}
+	trace := &openTrace{}
+	return context.WithValue(ctx, openTraceCtx, trace), func() {
+		if elapsed := d.now().Sub(start); elapsed > threshold {
+			l.Print(trace.describe(elapsed))
+		}
+	}
+}
+
+// startDial records that a dial of node started, and returns a function to record its
+// outcome with. It does nothing if ctx is not traced, see traceOpen.
+func startDial(ctx context.Context, d *Driver, node string) func(err error) {
+	trace, ok := ctx.Value(openTraceCtx).(*openTrace)
+	if !ok {
+		return func(error) {}
+	}
+	start := d.now()
+	trace.mu.Lock()
+	i := len(trace.dials)
+	trace.dials = append(trace.dials, tracedDial{node: node})
+	trace.mu.Unlock()
+	return func(err error) {
+		elapsed := d.now().Sub(start)
+		trace.mu.Lock()
+		trace.dials[i] = tracedDial{node, elapsed, err, true}
+		trace.mu.Unlock()
+	}
+}
+
+// describe describes an Open taking elapsed, with the dials recorded so far.
+func (t *openTrace) describe(elapsed time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dials := make([]string, len(t.dials))
+	for i, dial := range t.dials {
+		switch {
+		case !dial.done:
+			dials[i] = dial.node + " still dialing"
+		case dial.err != nil:
+			dials[i] = fmt.Sprintf("%s failed after %v: %v", dial.node, dial.elapsed, dial.err)
+		default:
+			dials[i] = fmt.Sprintf("%s %v", dial.node, dial.elapsed)
+		}
+	}
+	if len(dials) == 0 {
+		dials = []string{"no nodes dialed"}
+	}
+	return fmt.Sprintf("clustersql: slow Open took %v: %s", elapsed, strings.Join(dials, ", "))
+}
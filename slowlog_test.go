@@ -0,0 +1,122 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureLogger is a Logger keeping what is logged.
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Print(v ...interface{}) {
+	l.mu.Lock()
+	l.lines = append(l.lines, fmt.Sprint(v...))
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) logged() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestSlowOpenLog(t *testing.T) {
+	up := newFakeDriver()
+	up.node("fast", nil, 0)
+	up.node("slow", nil, 0)
+	d := newTestDriver(up, "slow", "down")
+	l := &captureLogger{}
+	d.SetLogger(l)
+	// the clock only moves while slow is dialed, which ends after down failed
+	var mu sync.Mutex
+	now := time.Now()
+	d.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	failed := make(chan struct{}, 10)
+	d.SetFatalErrorClassifier(func(err error) bool {
+		// called once the failure of down is traced
+		if errors.Is(err, errFakeUnreachable) {
+			failed <- struct{}{}
+		}
+		return false
+	})
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			if dsn == "slow" {
+				<-failed
+				mu.Lock()
+				now = now.Add(50 * time.Millisecond)
+				mu.Unlock()
+			}
+			return next(dsn)
+		}
+	})
+
+	open := func() {
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	open()
+	if lines := l.logged(); len(lines) != 0 {
+		t.Errorf("logged %q without the slow Open log", lines)
+	}
+
+	d.SetSlowOpenLog(20 * time.Millisecond)
+	open()
+	lines := l.logged()
+	if len(lines) != 1 {
+		t.Fatalf("logged %q, want one line", lines)
+	}
+	for _, want := range []string{`^clustersql: slow Open took [0-9.]+ms: `, `slow [0-9.]+ms`, `down failed after [0-9.]+.?s: ` + errFakeUnreachable.Error()} {
+		if !regexp.MustCompile(want).MatchString(lines[0]) {
+			t.Errorf("logged %q, want it to match %q", lines[0], want)
+		}
+	}
+
+	// fast Opens are not logged
+	d.DelNode("slow")
+	d.AddNode("fast", "fast")
+	open()
+	if lines := l.logged(); len(lines) != 1 {
+		t.Errorf("logged %q for a fast Open", lines[1:])
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"expvar"
+	"math/rand"
+	"time"
+)
+
+// ClusterStats is a snapshot of the statistics the Driver publishes in expvar, see
+// SetSnapshotHook.
+type ClusterStats struct {
+	Time  time.Time
+	State ClusterState
+	// OpenBreakers is the number of nodes marked unhealthy, not counting canaries and
+	// shadows. Anything above 0 means the cluster is degraded.
+	OpenBreakers int
+	Counters     map[string]int64     // the integers of the driver, like Retries and ActiveConnectionsTotal
+	Nodes        map[string]NodeStats // of the registered nodes, by name
+}
+
+// NodeStats is the part of ClusterStats about a single node.
+type NodeStats struct {
+	Healthy      bool
+	Counters     map[string]int64   // the integers of the node, like Connections, Errors and ActiveConnections
+	RecentErrors []TimestampedError // oldest first
+}
+
+// snapshotJitter is the fraction of the interval by which the time between two
+// snapshots varies, so that many processes don't report in lockstep.
+const snapshotJitter = 0.1
+
+// SetSnapshotHook makes the Driver take a snapshot of its statistics about every interval
+// in the background, and hand it to fn, e.g. to persist it or emit it to a time series
+// database on a schedule of its own. The time between two snapshots varies randomly by up
+// to 10% of interval. fn runs on the goroutine taking the snapshots, so a slow fn delays
+// the next one. An interval of 0 stops taking snapshots, as does Close.
+func (d *Driver) SetSnapshotHook(interval time.Duration, fn func(ClusterStats)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopSnapshots != nil {
+		close(d.stopSnapshots)
+		d.stopSnapshots = nil
+	}
+	if interval <= 0 || fn == nil || d.closed {
+		return
+	}
+	stop := make(chan struct{})
+	d.stopSnapshots = stop
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			jitter := time.Duration((2*rand.Float64() - 1) * snapshotJitter * float64(interval))
+			timer := time.NewTimer(interval + jitter)
+			select {
+			case <-timer.C:
+				fn(d.stats())
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stats returns a snapshot of the statistics of the Driver, like the ones handed to the
+// hook of SetSnapshotHook, e.g. to report them to a monitoring system of choice.
+func (d *Driver) Stats() ClusterStats {
+	return d.stats()
+}
+
+// IsGauge reports whether the integer called name in ClusterStats, like ActiveConnections,
+// describes current state. All others count events, like Connections, and only grow
+// until ResetStats.
+func IsGauge(name string) bool {
+	return gauges[name]
+}
+
+// stats takes a snapshot of the statistics of the Driver.
+func (d *Driver) stats() ClusterStats {
+	h := d.summarizeHealth()
+	s := ClusterStats{
+		Time:         d.now(),
+		State:        h.state(),
+		OpenBreakers: h.Unhealthy,
+		Counters:     intVars(d.exp),
+		Nodes:        map[string]NodeStats{},
+	}
+	for _, n := range d.registered() {
+		d.mu.Lock()
+		healthy, errs := n.healthy, n.recentErrors()
+		d.mu.Unlock()
+		s.Nodes[n.Name] = NodeStats{Healthy: healthy, Counters: intVars(n.exp), RecentErrors: errs}
+	}
+	return s
+}
+
+// intVars returns the values of the integers in m.
+func intVars(m *expvar.Map) map[string]int64 {
+	res := map[string]int64{}
+	m.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			res[kv.Key] = v.Value()
+		}
+	})
+	return res
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotHook(t *testing.T) {
+	up := newFakeDriver()
+	up.node("a", nil, 0)
+	up.node("b", errFakeUnreachable, 0)
+	d := newTestDriver(up, "a", "b")
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitDials(t, d) // for a dial of b losing against a
+	d.setHealthy(d.nodes["b"], false)
+
+	const interval = 20 * time.Millisecond
+	type snapshot struct {
+		at    time.Time
+		stats ClusterStats
+	}
+	snapshots := make(chan snapshot, 100)
+	d.SetSnapshotHook(interval, func(s ClusterStats) {
+		snapshots <- snapshot{time.Now(), s}
+	})
+	prev := time.Now()
+	var last ClusterStats
+	for i := 0; i < 3; i++ {
+		select {
+		case s := <-snapshots:
+			if gap := s.at.Sub(prev); gap < interval*9/10 {
+				t.Errorf("snapshot %d after %s, want at least %s", i, gap, interval*9/10)
+			}
+			prev, last = s.at, s.stats
+		case <-time.After(time.Second):
+			t.Fatalf("%d snapshots after a second", i)
+		}
+	}
+
+	if last.State != Degraded {
+		t.Errorf("State = %s, want degraded", last.State)
+	}
+	if v := last.Counters["ActiveConnectionsTotal"]; v != 1 {
+		t.Errorf("ActiveConnectionsTotal = %d, want 1", v)
+	}
+	a, b := last.Nodes["a"], last.Nodes["b"]
+	if !a.Healthy || a.Counters["Connections"] != 1 || a.Counters["ActiveConnections"] != 1 {
+		t.Errorf("stats of a: %+v, want healthy with 1 connection", a)
+	}
+	if b.Healthy || b.Counters["Connections"] != 0 {
+		t.Errorf("stats of b: %+v, want unhealthy without connections", b)
+	}
+
+	// Close waits for the goroutine calling the hook, so everything was taken before
+	d.Close()
+	closed := time.Now()
+	for len(snapshots) > 0 {
+		if s := <-snapshots; s.at.After(closed) {
+			t.Errorf("snapshot taken at %s, after Close returned at %s", s.at, closed)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNoPrimaryAvailable is returned (possibly wrapped) in read/write split mode if
+	// no node taking writes can be reached.
+	ErrNoPrimaryAvailable = errors.New("clustersql: no primary available")
+	// ErrNoReplicaAvailable is returned (possibly wrapped) with strict routing if no
+	// node taking reads can be reached.
+	ErrNoReplicaAvailable = errors.New("clustersql: no replica available")
+)
+
+// Role is the part a node plays in read/write split mode, see SetReadWriteSplit.
+type Role int
+
+const (
+	// RoleAny nodes take reads as well as writes. This is the default, and what
+	// all nodes of a multi-master cluster like galera are.
+	RoleAny Role = iota
+	// RolePrimary nodes take writes. Reads only go to them if no replica is available.
+	RolePrimary
+	// RoleReplica nodes only take reads.
+	RoleReplica
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleAny:
+		return "any"
+	case RolePrimary:
+		return "primary"
+	case RoleReplica:
+		return "replica"
+	}
+	return "invalid"
+}
+
+// MarshalText makes roles show up by name in JSON, like in config dumps.
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// intent tells whether a connection is needed for reading or writing.
+type intent int
+
+const (
+	forWrite intent = iota
+	forRead
+)
+
+// accepts reports whether a node with role r takes statements of intent i.
+func (r Role) accepts(i intent) bool {
+	if i == forRead {
+		return r != RolePrimary
+	}
+	return r != RoleReplica
+}
+
+// SetNodeRole sets the Role of a named Node.
+func (d *Driver) SetNodeRole(name string, role Role) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	n.role = role
+	return nil
+}
+
+// SetReadWriteSplit turns read/write split mode on or off. In this mode, the
+// connections handed out by the Driver are not bound to a single node. Each one
+// lazily opens up to two upstream connections: one to a node taking writes, which
+// is used for write statements and all transactions, and one to a node taking reads
+// (falling back to a primary if no replica can be reached), which is used for
+// read statements. Statements are told apart by the read classifier, see
+// SetReadClassifier, unless run with a context from WithConsistentRead.
+//
+// Note that session state (SET statements, temporary tables, ...) is not shared
+// between the two upstream connections.
+func (d *Driver) SetReadWriteSplit(enabled bool) {
+	d.mu.Lock()
+	d.split = enabled
+	d.mu.Unlock()
+}
+
+// SetReadClassifier replaces the function deciding whether a statement is a read
+// in read/write split mode. Passing nil restores the default, IsReadQuery.
+func (d *Driver) SetReadClassifier(isRead func(query string) bool) {
+	if isRead == nil {
+		isRead = IsReadQuery
+	}
+	d.mu.Lock()
+	d.isRead = isRead
+	d.mu.Unlock()
+}
+
+// IsReadQuery is the default read classifier. It considers SELECT (including
+// SELECT after WITH common table expressions), SHOW, EXPLAIN, DESCRIBE and DESC
+// statements reads, except for locking reads (SELECT ... FOR UPDATE, FOR SHARE and
+// LOCK IN SHARE MODE) and SELECT ... INTO. Everything else, including CALL, is
+// considered a write.
+func IsReadQuery(query string) bool {
+	words := sqlWords(query)
+	if len(words) == 0 {
+		return false
+	}
+	switch words[0].text {
+	case "show", "explain", "describe", "desc":
+		return true
+	case "select":
+	case "with":
+		// the statement following the common table expressions is the first
+		// keyword outside of parentheses
+		main := ""
+		for _, w := range words[1:] {
+			if w.depth == 0 && isStatementKeyword(w.text) {
+				main = w.text
+				break
+			}
+		}
+		if main != "select" {
+			return false
+		}
+	default:
+		return false
+	}
+	for i, w := range words {
+		switch w.text {
+		case "into":
+			return false
+		case "for":
+			if i+1 < len(words) && (words[i+1].text == "update" || words[i+1].text == "share" || words[i+1].text == "no") {
+				return false
+			}
+		case "lock":
+			if i+1 < len(words) && words[i+1].text == "in" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isStatementKeyword(word string) bool {
+	switch word {
+	case "select", "insert", "update", "delete", "replace", "merge":
+		return true
+	}
+	return false
+}
+
+type sqlWord struct {
+	text  string // lowercased
+	depth int    // parentheses nesting
+}
+
+// sqlWords splits query into lowercased words, skipping comments, string literals
+// and quoted identifiers.
+func sqlWords(query string) []sqlWord {
+	var words []sqlWord
+	depth := 0
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == '-' && strings.HasPrefix(query[i:], "--") || ch == '#':
+			if j := strings.IndexByte(query[i:], '\n'); j >= 0 {
+				i += j + 1
+			} else {
+				i = len(query)
+			}
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			if j := strings.Index(query[i+2:], "*/"); j >= 0 {
+				i += j + 4
+			} else {
+				i = len(query)
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			i++
+			for i < len(query) && query[i] != ch {
+				if query[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+		case ch == '(':
+			depth++
+			i++
+		case ch == ')':
+			depth--
+			i++
+		case isWordByte(ch):
+			j := i
+			for j < len(query) && isWordByte(query[j]) {
+				j++
+			}
+			words = append(words, sqlWord{strings.ToLower(query[i:j]), depth})
+			i = j
+		default:
+			i++
+		}
+	}
+	return words
+}
+
+func isWordByte(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_' || ch == '$' || ch >= 0x80
+}
+
+// SetStrictRouting turns strict routing on or off for read/write split mode. With
+// strict routing, reads are never sent to a primary: if no node taking reads can be
+// reached, an error wrapping ErrNoReplicaAvailable is returned instead.
+func (d *Driver) SetStrictRouting(strict bool) {
+	d.mu.Lock()
+	d.strict = strict
+	d.mu.Unlock()
+}
+
+// SetReadOnlyTxToReplicas makes read-only transactions (see sql.TxOptions) in read/write
+// split mode go to a node taking reads, instead of the primary. This only helps if the
+// upstream driver supports read-only transactions.
+func (d *Driver) SetReadOnlyTxToReplicas(enabled bool) {
+	d.mu.Lock()
+	d.readOnlyTxToReplicas = enabled
+	d.mu.Unlock()
+}
+
+// SetReadOnlyFallback turns degraded operation on or off for read/write split mode. With
+// it, a cluster without a reachable primary stays usable for reads: pinging a connection
+// and beginning a read-only transaction (see sql.TxOptions) fall back to a node taking
+// reads, while writes fail with an error wrapping ErrNoPrimaryAvailable as usual.
+// Fallbacks are counted as ReadOnlyFallbacks in the expvar map of the driver.
+func (d *Driver) SetReadOnlyFallback(enabled bool) {
+	d.mu.Lock()
+	d.readOnlyFallback = enabled
+	d.mu.Unlock()
+}
+
+// fallBackToRead reports whether err, returned when opening a connection for writes,
+// should be answered with a connection for reads, see SetReadOnlyFallback.
+func (d *Driver) fallBackToRead(err error) bool {
+	d.mu.Lock()
+	fallback := d.readOnlyFallback
+	d.mu.Unlock()
+	if !fallback || !errors.Is(err, ErrNoPrimaryAvailable) {
+		return false
+	}
+	d.count(nil, "ReadOnlyFallbacks")
+	return true
+}
+
+// openFor opens a connection to a node taking statements of intent i. Unless
+// routing is strict, reads fall back to the nodes taking writes.
+func (d *Driver) openFor(ctx context.Context, i intent) (driver.Conn, error) {
+	if err := d.checkPaused(); err != nil {
+		return nil, err
+	}
+	if i == forWrite {
+		d.resolvePrimary(ctx) // errors leave the roles as they are
+		ctx = context.WithValue(ctx, writeIntentCtx, true)
+	} else {
+		ctx = context.WithValue(ctx, readIntentCtx, true)
+	}
+	c, err := d.openConn(ctx, func(n *node) bool { return n.role.accepts(i) && (i == forWrite || n.readable()) })
+	if err == nil {
+		return c, nil
+	}
+	if i == forRead {
+		d.mu.Lock()
+		strict := d.strict
+		d.mu.Unlock()
+		if strict {
+			return nil, noRole(ErrNoReplicaAvailable, err)
+		}
+		c, err = d.openConn(ctx, func(n *node) bool { return n.role.accepts(forWrite) && n.readable() })
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, noRole(ErrNoPrimaryAvailable, err)
+}
+
+// noRole returns the error for a failure to reach a node of a role. err is the
+// error returned by Open.
+func noRole(roleErr, err error) error {
+	if err == ErrNoNodes {
+		return roleErr
+	}
+	return fmt.Errorf("%w: %w", roleErr, err)
+}
+
+// splitConn is the connection handed out in read/write split mode. Like any
+// driver.Conn, it is not used concurrently.
+type splitConn struct {
+	d     *Driver
+	conns [2]driver.Conn // by intent
+	tx    driver.Conn    // the connection running the current transaction, if any
+}
+
+// get returns the upstream connection for intent i, opening it if needed. The
+// connection for writes is replaced if its node no longer takes writes.
+func (s *splitConn) get(ctx context.Context, i intent) (driver.Conn, error) {
+	if s.tx != nil {
+		return s.tx, nil
+	}
+	if w, ok := s.conns[i].(wrapped); ok && i == forWrite {
+		s.d.mu.Lock()
+		demoted := !w.base().n.role.accepts(forWrite)
+		s.d.mu.Unlock()
+		if demoted {
+			s.conns[i].Close()
+			s.conns[i] = nil
+		}
+	}
+	if s.conns[i] == nil {
+		c, err := s.d.openFor(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		s.conns[i] = c
+	}
+	return s.conns[i], nil
+}
+
+// classify returns the intent of query, run with ctx.
+func (s *splitConn) classify(ctx context.Context, query string) intent {
+	if _, ok := ctx.Value(consistentReadCtx).(bool); ok {
+		return forWrite
+	}
+	s.d.mu.Lock()
+	isRead := s.d.isRead
+	s.d.mu.Unlock()
+	if isRead(query) {
+		return forRead
+	}
+	return forWrite
+}
+
+func (s *splitConn) Prepare(query string) (driver.Stmt, error) {
+	return s.PrepareContext(context.Background(), query)
+}
+
+func (s *splitConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c, err := s.get(ctx, s.classify(ctx, query))
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := c.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Prepare(query)
+}
+
+func (s *splitConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c, err := s.get(ctx, s.classify(ctx, query))
+	if err != nil {
+		return nil, err
+	}
+	return execContext(ctx, c, query, args)
+}
+
+func (s *splitConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c, err := s.get(ctx, s.classify(ctx, query))
+	if err != nil {
+		return nil, err
+	}
+	return queryContext(ctx, c, query, args)
+}
+
+func (s *splitConn) Begin() (driver.Tx, error) {
+	return s.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction on the upstream connection for writes (or reads, for a
+// read-only transaction with SetReadOnlyTxToReplicas or SetReadOnlyFallback). All
+// statements are sent there until the transaction ends.
+func (s *splitConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	i := forWrite
+	s.d.mu.Lock()
+	if opts.ReadOnly && s.d.readOnlyTxToReplicas {
+		i = forRead
+	}
+	s.d.mu.Unlock()
+	c, err := s.get(ctx, i)
+	if err != nil && i == forWrite && opts.ReadOnly && s.d.fallBackToRead(err) {
+		c, err = s.get(ctx, forRead)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tx, err := beginTx(ctx, c, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.tx = c
+	return splitTx{tx, s}, nil
+}
+
+// Ping pings the open upstream connections, opening the one for writes if there is none
+// (or the one for reads, see SetReadOnlyFallback).
+func (s *splitConn) Ping(ctx context.Context) error {
+	if s.conns[forWrite] == nil && s.conns[forRead] == nil {
+		_, err := s.get(ctx, forWrite)
+		if err != nil && s.d.fallBackToRead(err) {
+			_, err = s.get(ctx, forRead)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range s.conns {
+		if p, ok := c.(driver.Pinger); ok {
+			if err := p.Ping(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *splitConn) ResetSession(ctx context.Context) error {
+	for _, c := range s.conns {
+		if r, ok := c.(driver.SessionResetter); ok {
+			if err := r.ResetSession(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *splitConn) IsValid() bool {
+	for _, c := range s.conns {
+		if v, ok := c.(driver.Validator); ok && !v.IsValid() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *splitConn) Close() error {
+	var err error
+	for i, c := range s.conns {
+		if c != nil {
+			if cerr := c.Close(); cerr != nil {
+				err = cerr
+			}
+			s.conns[i] = nil
+		}
+	}
+	return err
+}
+
+type splitTx struct {
+	driver.Tx
+	s *splitConn
+}
+
+func (t splitTx) Commit() error {
+	t.s.tx = nil
+	return t.Tx.Commit()
+}
+
+func (t splitTx) Rollback() error {
+	t.s.tx = nil
+	return t.Tx.Rollback()
+}
+
+// beginTx starts a transaction on c, like database/sql would.
+func beginTx(ctx context.Context, c driver.Conn, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 {
+		return nil, errors.New("clustersql: upstream driver does not support non-default isolation level")
+	}
+	if opts.ReadOnly {
+		return nil, errors.New("clustersql: upstream driver does not support read-only transactions")
+	}
+	return c.Begin()
+}
@@ -0,0 +1,619 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestIsReadQuery(t *testing.T) {
+	for query, want := range map[string]bool{
+		"SELECT * FROM t":                             true,
+		"  select 1":                                  true,
+		"/* hint */ SELECT 1":                         true,
+		"-- comment\nSELECT 1":                        true,
+		"(SELECT 1) UNION (SELECT 2)":                 true,
+		"WITH x AS (SELECT * FROM t) SELECT * FROM x": true,
+		"WITH RECURSIVE r (n) AS (SELECT 1 UNION ALL SELECT n+1 FROM r WHERE n < 5) SELECT n FROM r": true,
+		"WITH x AS (SELECT id FROM t) DELETE FROM u WHERE id IN (SELECT id FROM x)":                  false,
+		"SHOW TABLES":                               true,
+		"show variables like 'wsrep%'":              true,
+		"EXPLAIN SELECT * FROM t":                   true,
+		"DESCRIBE t":                                true,
+		"SELECT * FROM t WHERE id = 1 FOR UPDATE":   false,
+		"SELECT * FROM t FOR SHARE":                 false,
+		"SELECT * FROM t LOCK IN SHARE MODE":        false,
+		"SELECT * FROM t WHERE note = 'for update'": true,
+		"SELECT `for` FROM t":                       true,
+		"SELECT id INTO @id FROM t":                 false,
+		"INSERT INTO t SELECT * FROM u":             false,
+		"UPDATE t SET value = 1":                    false,
+		"DELETE FROM t":                             false,
+		"CALL do_something()":                       false,
+		"SET SESSION sql_mode = ''":                 false,
+		"":                                          false,
+	} {
+		if got := IsReadQuery(query); got != want {
+			t.Errorf("IsReadQuery(%q) = %t, want %t", query, got, want)
+		}
+	}
+}
+
+func TestReadWriteSplit(t *testing.T) {
+	up := newFakeDriver()
+	up.node("primary", nil, 0)
+	up.node("replica", nil, 0)
+	d := newTestDriver(up, "primary", "replica")
+	d.SetNodeRole("primary", RolePrimary)
+	d.SetNodeRole("replica", RoleReplica)
+	d.SetReadWriteSplit(true)
+	connector, _ := d.OpenConnector("")
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	node := func(query string) string {
+		var dsn string
+		if err := db.QueryRow(query).Scan(&dsn); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return dsn
+	}
+	for query, want := range map[string]string{
+		"SELECT 1":                      "replica",
+		"WITH x AS (SELECT 1) SELECT 1": "replica",
+		"SHOW STATUS":                   "replica",
+		"EXPLAIN SELECT 1":              "replica",
+		"SELECT 1 FOR UPDATE":           "primary",
+	} {
+		if got := node(query); got != want {
+			t.Errorf("%s went to %s, want %s", query, got, want)
+		}
+	}
+	if _, err := db.Exec("UPDATE t SET value = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if q := up.executed("primary"); len(q) == 0 || q[len(q)-1] != "UPDATE t SET value = 1" {
+		t.Errorf("UPDATE not sent to primary: %v", q)
+	}
+
+	// transactions stay on the primary
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dsn string
+	if err := tx.QueryRow("SELECT 1").Scan(&dsn); err != nil || dsn != "primary" {
+		t.Errorf("SELECT in transaction went to %s (%v)", dsn, err)
+	}
+	tx.Commit()
+
+	// consistent reads go to the primary
+	var consistent string
+	if err := db.QueryRowContext(WithConsistentRead(context.Background()), "SELECT 1").Scan(&consistent); err != nil || consistent != "primary" {
+		t.Errorf("consistent read went to %s (%v)", consistent, err)
+	}
+	if got := node("SELECT 1"); got != "replica" {
+		t.Errorf("SELECT after a consistent read went to %s", got)
+	}
+
+	// a custom classifier sends everything to the primary
+	d.SetReadClassifier(func(string) bool { return false })
+	if got := node("SELECT 1"); got != "primary" {
+		t.Errorf("custom classifier ignored, SELECT went to %s", got)
+	}
+	d.SetReadClassifier(nil)
+	if got := node("SELECT 1"); got != "replica" {
+		t.Errorf("default classifier not restored, SELECT went to %s", got)
+	}
+
+	// without a replica, reads fall back to the primary
+	d.DelNode("replica")
+	db2 := sql.OpenDB(connector)
+	defer db2.Close()
+	var fallback string
+	if err := db2.QueryRow("SELECT 1").Scan(&fallback); err != nil || fallback != "primary" {
+		t.Errorf("read without replica went to %s (%v)", fallback, err)
+	}
+}
+
+func TestPrimaryResolver(t *testing.T) {
+	up := newFakeDriver()
+	for _, dsn := range []string{"a", "b", "c"} {
+		up.node(dsn, nil, 0)
+	}
+	d := newTestDriver(up, "a", "b", "c")
+	d.SetNodeRole("a", RolePrimary)
+	d.SetNodeRole("b", RoleReplica)
+	d.SetNodeRole("c", RoleReplica)
+	d.SetReadWriteSplit(true)
+	var mu sync.Mutex
+	primary, resolverErr := "a", error(nil)
+	d.SetPrimaryResolver(func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return primary, resolverErr
+	})
+	failover := func(to string, err error) {
+		mu.Lock()
+		primary, resolverErr = to, err
+		mu.Unlock()
+	}
+	wrote := func(dsn string) int {
+		n := 0
+		for _, q := range up.executed(dsn) {
+			if q == "INSERT" {
+				n++
+			}
+		}
+		return n
+	}
+	write := func(c driver.Conn) {
+		if _, err := c.(driver.ExecerContext).ExecContext(context.Background(), "INSERT", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	held, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(held)
+	if wrote("a") != 1 {
+		t.Fatalf("write did not go to a: %v", up.executed("a"))
+	}
+
+	// the next Open learns about the new primary
+	failover("b", nil)
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(c)
+	c.Close()
+	if wrote("b") != 1 {
+		t.Errorf("write did not follow the primary to b: %v", up.executed("b"))
+	}
+	if role := d.nodes["a"].role; role != RoleReplica {
+		t.Errorf("former primary has role %v", role)
+	}
+	// and a connection opened before moves its writes
+	write(held)
+	if wrote("a") != 1 || wrote("b") != 2 {
+		t.Errorf("held connection kept writing to a: a %d, b %d", wrote("a"), wrote("b"))
+	}
+	held.Close()
+
+	// a health check round learns, too
+	failover("c", nil)
+	d.PingAll(context.Background())
+	if role := d.nodes["c"].role; role != RolePrimary {
+		t.Errorf("c has role %v after health check", role)
+	}
+
+	// errors and unknown nodes leave the roles alone
+	for _, f := range []struct {
+		name string
+		err  error
+	}{{"a", errors.New("orchestrator down")}, {"unknown", nil}} {
+		failover(f.name, f.err)
+		c, err := d.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(c)
+		c.Close()
+	}
+	if wrote("c") != 2 {
+		t.Errorf("writes left c: %v", up.executed("c"))
+	}
+	if got := d.exp.Get("PrimaryResolverErrors").String(); got != "2" {
+		t.Errorf("PrimaryResolverErrors = %s, want 2", got)
+	}
+}
+
+func TestReadPreference(t *testing.T) {
+	up := newFakeDriver()
+	nodes := map[string]string{"r1": ReadPrefer, "r2": "", "r3": ReadSecondary, "r4": ReadNever}
+	d := newTestDriver(up, "primary", "r1", "r2", "r3", "r4")
+	d.SetNodeRole("primary", RolePrimary)
+	up.node("primary", nil, 0)
+	for name, pref := range nodes {
+		up.node(name, nil, 0)
+		d.SetNodeRole(name, RoleReplica)
+		if pref != "" {
+			d.SetNodeLabels(name, map[string]string{ReadPreferenceLabel: pref})
+		}
+	}
+	d.SetFanout(1)
+	read := func(ctx context.Context) string {
+		c, err := d.openFor(ctx, forRead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.(wrapped).base().n.Name
+	}
+	for _, step := range []struct {
+		down string // node that stops answering before the step
+		pref string // requested with WithReadPreference
+		want string
+	}{
+		{"", "", "r1"},
+		{"", ReadSecondary, "r3"},
+		{"r1", "", "r2"},
+		{"r2", "", "r3"},
+		{"r3", "", "primary"},
+	} {
+		if step.down != "" {
+			up.node(step.down, errFakeUnreachable, 0)
+		}
+		ctx := context.Background()
+		if step.pref != "" {
+			ctx = WithReadPreference(ctx, step.pref)
+		}
+		if got := read(ctx); got != step.want {
+			t.Errorf("read with %s down and preference %q went to %s, want %s", step.down, step.pref, got, step.want)
+		}
+	}
+	if n := up.dialed("r4"); n != 0 {
+		t.Errorf("never-read node dialed %d times", n)
+	}
+	if n := up.dialed("r1"); n != 3 {
+		t.Errorf("r1 dialed %d times, preferred even though down", n)
+	}
+
+	// writes don't care
+	c, err := d.openFor(context.Background(), forWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(wrapped).base().n.Name; got != "primary" {
+		t.Errorf("write went to %s", got)
+	}
+	c.Close()
+}
+
+func TestStrictRouting(t *testing.T) {
+	up := newFakeDriver()
+	up.node("primary", nil, 0)
+	up.node("replica", nil, 0)
+	d := newTestDriver(up, "primary")
+	d.SetNodeRole("primary", RolePrimary)
+	d.SetReadWriteSplit(true)
+	connector, _ := d.OpenConnector("")
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxIdleConns(0)
+
+	read := func() (string, error) {
+		var dsn string
+		err := db.QueryRow("SELECT 1").Scan(&dsn)
+		return dsn, err
+	}
+
+	// non-strict: reads fall back to the primary
+	if dsn, err := read(); err != nil || dsn != "primary" {
+		t.Errorf("non-strict read without replica: %s, %v", dsn, err)
+	}
+
+	d.SetStrictRouting(true)
+	if _, err := read(); !errors.Is(err, ErrNoReplicaAvailable) {
+		t.Errorf("strict read without replica: expected ErrNoReplicaAvailable, got %v", err)
+	}
+
+	// a replica that can't be reached is not available either
+	d.AddNode("replica", "unreachable")
+	d.SetNodeRole("replica", RoleReplica)
+	if _, err := read(); !errors.Is(err, ErrNoReplicaAvailable) || !errors.Is(err, errFakeUnreachable) {
+		t.Errorf("strict read with unreachable replica: got %v", err)
+	}
+	d.DelNode("replica")
+
+	// writes never go to replicas, strict or not
+	d.DelNode("primary")
+	d.AddNode("replica", "replica")
+	d.SetNodeRole("replica", RoleReplica)
+	for _, strict := range []bool{true, false} {
+		d.SetStrictRouting(strict)
+		if _, err := db.Exec("DELETE FROM t"); !errors.Is(err, ErrNoPrimaryAvailable) {
+			t.Errorf("write without primary (strict %t): expected ErrNoPrimaryAvailable, got %v", strict, err)
+		}
+		if dsn, err := read(); err != nil || dsn != "replica" {
+			t.Errorf("read with replica (strict %t): %s, %v", strict, dsn, err)
+		}
+	}
+}
+
+func TestReadOnlyFallback(t *testing.T) {
+	up := newFakeDriver()
+	up.node("primary", errFakeUnreachable, 0)
+	up.node("replica", nil, 0)
+	d := newTestDriver(up, "primary", "replica")
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			c, err := next(dsn)
+			if err != nil {
+				return nil, err
+			}
+			return txOptsConn{c.(*fakeConn), func(string, driver.TxOptions) {}}, nil // for read-only transactions
+		}
+	})
+	d.SetNodeRole("primary", RolePrimary)
+	d.SetNodeRole("replica", RoleReplica)
+	d.SetReadWriteSplit(true)
+	d.SetReadOnlyFallback(true)
+	connector, _ := d.OpenConnector("")
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxIdleConns(0)
+
+	if err := db.Ping(); err != nil {
+		t.Errorf("Ping without primary: %v", err)
+	}
+	var dsn string
+	if err := db.QueryRow("SELECT 1").Scan(&dsn); err != nil || dsn != "replica" {
+		t.Errorf("read without primary: %s, %v", dsn, err)
+	}
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("read-only transaction without primary: %v", err)
+	}
+	if err := tx.QueryRow("SELECT 1").Scan(&dsn); err != nil || dsn != "replica" {
+		t.Errorf("read in read-only transaction: %s, %v", dsn, err)
+	}
+	tx.Commit()
+
+	if _, err := db.Exec("DELETE FROM t"); !errors.Is(err, ErrNoPrimaryAvailable) {
+		t.Errorf("write without primary: expected ErrNoPrimaryAvailable, got %v", err)
+	}
+	if _, err := db.Begin(); !errors.Is(err, ErrNoPrimaryAvailable) {
+		t.Errorf("read-write transaction without primary: expected ErrNoPrimaryAvailable, got %v", err)
+	}
+	for _, q := range up.executed("replica") {
+		if q == "DELETE FROM t" {
+			t.Error("write sent to the replica")
+		}
+	}
+	if v := d.exp.Get("ReadOnlyFallbacks"); v == nil || v.String() != "2" {
+		t.Errorf("ReadOnlyFallbacks = %v, want 2", v)
+	}
+
+	// without the fallback, pinging needs the primary
+	d.SetReadOnlyFallback(false)
+	if err := db.Ping(); !errors.Is(err, ErrNoPrimaryAvailable) {
+		t.Errorf("Ping without primary and fallback: expected ErrNoPrimaryAvailable, got %v", err)
+	}
+}
+
+// readOnlyConn answers SELECT @@read_only with its read_only setting.
+type readOnlyConn struct {
+	*fakeConn
+	readOnly string
+}
+
+func (c readOnlyConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	if query == readOnlyQuery {
+		return &fakeRows{values: []string{c.readOnly}}, nil
+	}
+	return c.fakeConn.Query(query, args)
+}
+
+func TestWritableCheck(t *testing.T) {
+	up := newFakeDriver()
+	for _, dsn := range []string{"promoted", "primary", "replica"} {
+		up.node(dsn, nil, 0)
+	}
+	d := newTestDriver(up, "promoted", "primary", "replica")
+	readOnly := map[string]string{"promoted": "1", "primary": "0", "replica": "1"}
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			c, err := next(dsn)
+			if err != nil {
+				return nil, err
+			}
+			return readOnlyConn{c.(*fakeConn), readOnly[dsn]}, nil
+		}
+	})
+	d.SetNodeRole("promoted", RolePrimary)
+	d.SetNodeRole("primary", RolePrimary)
+	d.SetNodeRole("replica", RoleReplica)
+	d.SetNodeWeight("promoted", 10)
+	d.SetFanout(1)
+	d.SetReadWriteSplit(true)
+	d.SetWritableCheck(func(rows driver.Rows) (bool, error) {
+		dest := make([]driver.Value, 1)
+		if err := rows.Next(dest); err != nil {
+			return false, err
+		}
+		return dest[0] == "1", nil
+	})
+	connector, _ := d.OpenConnector("")
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxIdleConns(0)
+
+	if _, err := db.Exec("UPDATE t SET value = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if q := up.executed("primary"); len(q) == 0 || q[len(q)-1] != "UPDATE t SET value = 1" {
+		t.Errorf("UPDATE not sent to the writable primary: %v", q)
+	}
+	if q := up.executed("promoted"); len(q) != 0 {
+		t.Errorf("read-only primary executed %v", q)
+	}
+	if v := d.nodes["promoted"].exp.Get("ReadOnlyRejections"); v == nil || v.String() != "1" {
+		t.Errorf("ReadOnlyRejections = %v, want 1", v)
+	}
+	if !d.nodes["promoted"].healthy {
+		t.Error("read-only primary marked unhealthy")
+	}
+
+	// reads are not checked
+	var dsn string
+	if err := db.QueryRow("SELECT 1").Scan(&dsn); err != nil || dsn != "replica" {
+		t.Errorf("read went to %s (%v)", dsn, err)
+	}
+
+	readOnly["primary"] = "1"
+	if _, err := db.Exec("UPDATE t SET value = 1"); !errors.Is(err, ErrNoPrimaryAvailable) || !errors.Is(err, ErrNodeReadOnly) {
+		t.Errorf("write with all primaries read-only: got %v", err)
+	}
+}
+
+// preparedConn only supports querying through prepared statements, answering
+// SELECT @@read_only with its read_only setting.
+type preparedConn struct {
+	driver.Conn
+	readOnly string
+}
+
+func (c preparedConn) Prepare(query string) (driver.Stmt, error) {
+	return preparedStmt{c, query}, nil
+}
+
+type preparedStmt struct {
+	c     preparedConn
+	query string
+}
+
+func (s preparedStmt) Close() error  { return nil }
+func (s preparedStmt) NumInput() int { return -1 }
+func (s preparedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("fake: exec not supported")
+}
+func (s preparedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.query != readOnlyQuery {
+		return nil, errors.New("fake: unexpected query " + s.query)
+	}
+	return &fakeRows{values: []string{s.c.readOnly}}, nil
+}
+
+func TestWritableCheckPrepared(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "primary")
+	defer d.Close()
+	d.SetWritableCheck(func(rows driver.Rows) (bool, error) {
+		dest := make([]driver.Value, 1)
+		if err := rows.Next(dest); err != nil {
+			return false, err
+		}
+		return dest[0] == "1", nil
+	})
+	ctx := context.WithValue(context.Background(), writeIntentCtx, true)
+	n := d.nodes["primary"]
+	if err := d.checkWritable(ctx, n, preparedConn{&fakeConn{}, "0"}); err != nil {
+		t.Errorf("writable node: %v", err)
+	}
+	if err := d.checkWritable(ctx, n, preparedConn{&fakeConn{}, "1"}); err != ErrNodeReadOnly {
+		t.Errorf("read-only node: got %v, want ErrNodeReadOnly", err)
+	}
+}
+
+// txOptsConn supports ConnBeginTx, recording the options of every transaction.
+type txOptsConn struct {
+	*fakeConn
+	began func(dsn string, opts driver.TxOptions)
+}
+
+func (c txOptsConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.began(c.dsn, opts)
+	return c.Begin()
+}
+
+func TestBeginTxOptions(t *testing.T) {
+	up := newFakeDriver()
+	up.node("primary", nil, 0)
+	up.node("replica", nil, 0)
+	d := newTestDriver(up, "primary", "replica")
+	var mu sync.Mutex
+	began := map[string][]driver.TxOptions{}
+	d.SetDialMiddleware(func(next func(string) (driver.Conn, error)) func(string) (driver.Conn, error) {
+		return func(dsn string) (driver.Conn, error) {
+			c, err := next(dsn)
+			if err != nil {
+				return nil, err
+			}
+			return txOptsConn{c.(*fakeConn), func(dsn string, opts driver.TxOptions) {
+				mu.Lock()
+				began[dsn] = append(began[dsn], opts)
+				mu.Unlock()
+			}}, nil
+		}
+	})
+	d.SetNodeRole("primary", RolePrimary)
+	d.SetNodeRole("replica", RoleReplica)
+	connector, _ := d.OpenConnector("")
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	begin := func(opts *sql.TxOptions) {
+		tx, err := db.BeginTx(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+	}
+	last := func(dsn string) (driver.TxOptions, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(began[dsn]) == 0 {
+			return driver.TxOptions{}, false
+		}
+		opts := began[dsn][len(began[dsn])-1]
+		began[dsn] = nil
+		return opts, true
+	}
+
+	// options reach the upstream connection, also without split mode
+	begin(&sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+	opts, ok := last("primary")
+	if !ok {
+		opts, ok = last("replica")
+	}
+	if !ok || opts.Isolation != driver.IsolationLevel(sql.LevelSerializable) || !opts.ReadOnly {
+		t.Errorf("options not passed on: %+v", opts)
+	}
+
+	d.SetReadWriteSplit(true)
+	db.SetMaxIdleConns(0) // get a split connection for every transaction
+	begin(&sql.TxOptions{ReadOnly: true})
+	if _, ok := last("primary"); !ok {
+		t.Error("read-only transaction not on the primary by default")
+	}
+	d.SetReadOnlyTxToReplicas(true)
+	begin(&sql.TxOptions{ReadOnly: true})
+	if opts, ok := last("replica"); !ok || !opts.ReadOnly {
+		t.Error("read-only transaction not on the replica")
+	}
+	begin(&sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if opts, ok := last("primary"); !ok || opts.Isolation != driver.IsolationLevel(sql.LevelReadCommitted) {
+		t.Error("read-write transaction not on the primary")
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package statsd emits the statistics of a clustersql Driver to StatsD (or DogStatsD)
+// over UDP:
+//
+//	e, err := statsd.Start(clusterDriver, "127.0.0.1:8125", "myapp.db", 10*time.Second)
+//	...
+//	defer e.Close()
+//
+// It reports the integers the Driver publishes in expvar, see clustersql.ClusterStats:
+// those of the driver as <prefix>.<name>, those of the nodes as
+// <prefix>.nodes.<node>.<name>. Gauges (see clustersql.IsGauge) are sent as StatsD
+// gauges, the other integers as counters, increased by how much they grew since the
+// last flush. Additionally, the health of every node is sent as the gauge
+// <prefix>.nodes.<node>.Healthy (1 or 0), and the number of unhealthy nodes as
+// <prefix>.OpenBreakers.
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benthor/clustersql"
+)
+
+// maxPacket is the size up to which lines are put into a single UDP packet, small
+// enough not to be fragmented on the usual networks.
+const maxPacket = 1432
+
+// Emitter sends the statistics of a Driver to StatsD, see Start.
+type Emitter struct {
+	d      *clustersql.Driver
+	conn   net.Conn
+	prefix string
+
+	mu   sync.Mutex
+	last map[string]int64 // the values of the counters sent, by metric name
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Start returns an Emitter sending the statistics of d to the StatsD server at addr
+// about every interval, with the names of the metrics prefixed with prefix. An interval
+// of 0 sends them only when Flush is called.
+func Start(d *clustersql.Driver, addr, prefix string, interval time.Duration) (*Emitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	e := &Emitter{
+		d:      d,
+		conn:   conn,
+		prefix: strings.TrimSuffix(prefix, "."),
+		last:   map[string]int64{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.loop(interval)
+	return e, nil
+}
+
+func (e *Emitter) loop(interval time.Duration) {
+	defer close(e.done)
+	if interval <= 0 {
+		<-e.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Flush() // there is no one to report an error to, the next flush may do better
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Flush sends the current statistics right away.
+func (e *Emitter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.send(e.lines(e.d.Stats()))
+}
+
+// lines returns the StatsD lines for s, sorted. e.mu must be held.
+func (e *Emitter) lines(s clustersql.ClusterStats) []string {
+	lines := e.ints(e.prefix, s.Counters)
+	lines = append(lines, gauge(e.prefix+".OpenBreakers", int64(s.OpenBreakers)))
+	for name, n := range s.Nodes {
+		prefix := e.prefix + ".nodes." + sanitize(name)
+		lines = append(lines, e.ints(prefix, n.Counters)...)
+		healthy := int64(0)
+		if n.Healthy {
+			healthy = 1
+		}
+		lines = append(lines, gauge(prefix+".Healthy", healthy))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// ints returns the StatsD lines for the integers in values, the names prefixed with
+// prefix. Counters that did not grow are left out. e.mu must be held.
+func (e *Emitter) ints(prefix string, values map[string]int64) []string {
+	var lines []string
+	for name, v := range values {
+		metric := prefix + "." + sanitize(name)
+		if clustersql.IsGauge(name) {
+			lines = append(lines, gauge(metric, v))
+			continue
+		}
+		delta := v - e.last[metric]
+		if delta < 0 {
+			delta = v // reset, see ResetStats
+		}
+		e.last[metric] = v
+		if delta != 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d|c", metric, delta))
+		}
+	}
+	return lines
+}
+
+func gauge(metric string, v int64) string {
+	return fmt.Sprintf("%s:%d|g", metric, v)
+}
+
+// sanitize replaces the characters with a meaning in StatsD lines, or in metric names,
+// in name.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '.', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// send sends lines, as many at a time as fit into a packet.
+func (e *Emitter) send(lines []string) error {
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxPacket {
+			if _, err := e.conn.Write(packet); err != nil {
+				return fmt.Errorf("statsd: %w", err)
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		if _, err := e.conn.Write(packet); err != nil {
+			return fmt.Errorf("statsd: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close stops sending statistics and waits for a flush in progress to finish. Close may
+// be called more than once.
+func (e *Emitter) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.stop)
+		<-e.done
+		err = e.conn.Close()
+	})
+	return err
+}
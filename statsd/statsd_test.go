@@ -0,0 +1,144 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benthor/clustersql"
+)
+
+// upstream is a driver whose connections can't do anything but be closed.
+type upstream struct{}
+
+func (upstream) Open(dsn string) (driver.Conn, error) {
+	return conn{}, nil
+}
+
+type conn struct{}
+
+func (conn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (conn) Close() error                              { return nil }
+func (conn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func TestEmitter(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	read := func() []string {
+		var lines []string
+		buf := make([]byte, 64*1024)
+		for {
+			l.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := l.ReadFrom(buf)
+			if err != nil {
+				return lines
+			}
+			lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+		}
+	}
+
+	d := clustersql.NewPrivateDriver(upstream{})
+	d.AddNode("db:1", "db1")
+	e, err := Start(d, l.LocalAddr().String(), "app.db.", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	c, err := d.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"app.db.ActiveConnectionsTotal:1|g",
+		"app.db.OpenBreakers:0|g",
+		"app.db.SuccessAfter_0Failures:1|c",
+		"app.db.nodes.db_1.ActiveConnections:1|g",
+		"app.db.nodes.db_1.Connections:1|c",
+		"app.db.nodes.db_1.ConsecutiveFailures:0|g",
+		"app.db.nodes.db_1.ConsecutiveSuccesses:1|g",
+		"app.db.nodes.db_1.Healthy:1|g",
+	}
+	if got := read(); !reflect.DeepEqual(got, want) {
+		t.Errorf("first flush sent\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// counters are sent as they grow
+	c.Close()
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"app.db.ActiveConnectionsTotal:0|g",
+		"app.db.OpenBreakers:0|g",
+		"app.db.nodes.db_1.ActiveConnections:0|g",
+		"app.db.nodes.db_1.ConsecutiveFailures:0|g",
+		"app.db.nodes.db_1.ConsecutiveSuccesses:1|g",
+		"app.db.nodes.db_1.Healthy:1|g",
+	}
+	if got := read(); !reflect.DeepEqual(got, want) {
+		t.Errorf("second flush sent\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestEmitterInterval(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d := clustersql.NewPrivateDriver(upstream{})
+	d.AddNode("a", "a")
+	e, err := Start(d, l.LocalAddr().String(), "app", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("nothing sent: %v", err)
+	}
+	if !strings.Contains(string(buf[:n]), "app.nodes.a.Healthy:1|g") {
+		t.Errorf("sent %q, want the health of a", buf[:n])
+	}
+	if err := e.Close(); err != nil {
+		t.Error(err)
+	}
+	e.Close()
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrQueryTimeout is returned for statements aborted by the query timeout.
+var ErrQueryTimeout = errors.New("clustersql: query timed out")
+
+// SetQueryTimeout caps the time statements run without being prepared (which is how
+// database/sql runs them if the upstream driver supports it) may take. The context of
+// such a statement is canceled after timeout, unless it expires earlier anyway, and
+// ErrQueryTimeout is returned. If the upstream connection does not return within 100ms
+// of that, the statement is abandoned, so that database/sql discards the connection; it
+// is closed once the statement returns. Timeouts are counted as QueryTimeouts in the expvar map of the node. 0, the
+// default, means no timeout.
+//
+// ErrQueryTimeout is returned rather than driver.ErrBadConn, which would make
+// database/sql run the statement again.
+func (d *Driver) SetQueryTimeout(timeout time.Duration) {
+	d.mu.Lock()
+	d.queryTimeout = timeout
+	d.mu.Unlock()
+}
+
+// boundedResult is the outcome of a statement run by bounded.
+type boundedResult struct {
+	v   interface{}
+	err error
+}
+
+// abandonGrace is how long bounded waits for the upstream connection to return after
+// canceling the context of a statement, before abandoning it.
+const abandonGrace = 100 * time.Millisecond
+
+// bounded runs f, which must only use the upstream connection, subject to the query
+// timeout. If f returns something to be closed after it was abandoned, it is.
+func (c *conn) bounded(ctx context.Context, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	c.d.mu.Lock()
+	timeout := c.d.queryTimeout
+	c.d.mu.Unlock()
+	if timeout <= 0 {
+		return f(ctx)
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+		return f(ctx)
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	done := make(chan boundedResult, 1)
+	go func() {
+		v, err := f(ctx)
+		done <- boundedResult{v, err}
+	}()
+	var r boundedResult
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		if parent.Err() != nil {
+			// not our business
+			r := <-done
+			return r.v, r.err
+		}
+		grace := time.NewTimer(abandonGrace)
+		select {
+		case r = <-done:
+			grace.Stop()
+		case <-grace.C:
+			c.abandon(done)
+			return nil, ErrQueryTimeout
+		}
+	}
+	if r.err != nil && parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+		c.d.count(c.n, "QueryTimeouts")
+		return nil, ErrQueryTimeout
+	}
+	return r.v, r.err
+}
+
+// abandon gives up on a statement whose upstream connection ignores the context. Once
+// the statement returns on done, whatever it returned is closed, and so is the connection.
+func (c *conn) abandon(done chan boundedResult) {
+	c.bad = true
+	c.abandoned = true
+	go func() {
+		if r := <-done; r.v != nil {
+			if closer, ok := r.v.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+		c.closeUpstream()
+	}()
+	c.d.count(c.n, "QueryTimeouts")
+}
@@ -0,0 +1,196 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowConn runs every statement for delay, signaling on started when one starts. If
+// honorCtx is set, it gives up when the context is done; otherwise it only stops early
+// when released or the connection is closed.
+type slowConn struct {
+	fakeConn
+	delay    time.Duration
+	honorCtx bool
+	started  chan struct{}
+	release  chan struct{} // ends the statement running, if any
+	closed   chan struct{}
+	closes   int32
+}
+
+func newSlowConn(delay time.Duration, honorCtx bool) *slowConn {
+	return &slowConn{delay: delay, honorCtx: honorCtx, started: make(chan struct{}, 1), release: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *slowConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var ctxDone <-chan struct{}
+	if c.honorCtx {
+		ctxDone = ctx.Done()
+	}
+	select {
+	case c.started <- struct{}{}:
+	default:
+	}
+	select {
+	case <-time.After(c.delay):
+		return driver.RowsAffected(1), nil
+	case <-ctxDone:
+		return nil, ctx.Err()
+	case <-c.release:
+		return driver.RowsAffected(1), nil
+	case <-c.closed:
+		return nil, driver.ErrBadConn
+	}
+}
+
+func (c *slowConn) Close() error {
+	atomic.AddInt32(&c.closes, 1)
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.fakeConn.Close()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	d := newTestDriver(newFakeDriver(), "a")
+	d.SetQueryTimeout(50 * time.Millisecond)
+	exec := func(ctx context.Context, up *slowConn) (driver.Conn, time.Duration, error) {
+		c := d.wrap(up, d.nodes["a"])
+		start := time.Now()
+		_, err := c.(driver.ExecerContext).ExecContext(ctx, "SELECT SLEEP(1)", nil)
+		return c, time.Since(start), err
+	}
+
+	for _, honorCtx := range []bool{true, false} {
+		up := newSlowConn(time.Hour, honorCtx)
+		c, took, err := exec(context.Background(), up)
+		if err != ErrQueryTimeout {
+			t.Errorf("honorCtx %v: got %v, want %v", honorCtx, err, ErrQueryTimeout)
+		}
+		if took < 50*time.Millisecond {
+			t.Errorf("honorCtx %v: aborted after %s, want 50ms", honorCtx, took)
+		}
+		if honorCtx && (up.isClosed() || !c.(driver.Validator).IsValid()) {
+			t.Error("connection honoring the context closed")
+		}
+		if !honorCtx {
+			if c.(driver.Validator).IsValid() {
+				t.Error("abandoned connection still valid")
+			}
+			// database/sql discards it, but the statement still runs
+			c.Close()
+			if up.isClosed() {
+				t.Error("connection closed while the abandoned statement runs")
+			}
+			close(up.release)
+			select {
+			case <-up.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection not closed once the abandoned statement returned")
+			}
+		}
+		c.Close()
+		if n := atomic.LoadInt32(&up.closes); n != 1 {
+			t.Errorf("honorCtx %v: upstream connection closed %d times", honorCtx, n)
+		}
+	}
+	if v := d.nodes["a"].exp.Get("QueryTimeouts"); v == nil || v.String() != "2" {
+		t.Errorf("QueryTimeouts = %v, want 2", v)
+	}
+
+	// fast statements are not affected
+	if _, _, err := exec(context.Background(), newSlowConn(0, false)); err != nil {
+		t.Error(err)
+	}
+	// a shorter deadline of the caller takes precedence
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := exec(ctx, newSlowConn(time.Hour, true)); err != context.DeadlineExceeded {
+		t.Errorf("caller deadline: got %v", err)
+	}
+	// so does canceling, before the query timeout
+	d.SetQueryTimeout(time.Hour)
+	ctx, cancel = context.WithCancel(context.Background())
+	up := newSlowConn(time.Hour, true)
+	go func() {
+		<-up.started
+		cancel()
+	}()
+	if _, _, err := exec(ctx, up); err != context.Canceled {
+		t.Errorf("canceled by caller: got %v", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	up := newFakeDriver()
+	up.node("local", nil, 0)
+	up.node("remote", nil, 50*time.Millisecond)
+	d := newTestDriver(up)
+	d.AddNode("local", "local")
+	d.AddNodeWithTimeout("remote", "remote", time.Second)
+	d.SetDialTimeout(20 * time.Millisecond)
+	open := func(name string) error {
+		c, err := (connector{d}).Connect(WithForcedNode(context.Background(), name))
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	// the remote node gets its own, longer timeout
+	if err := open("local"); err != nil {
+		t.Errorf("local: %v", err)
+	}
+	if err := open("remote"); err != nil {
+		t.Errorf("remote: %v", err)
+	}
+
+	// the local one has to make do with the default
+	up.node("local", nil, 50*time.Millisecond)
+	start := time.Now()
+	if err := open("local"); err != ErrDialTimeout {
+		t.Errorf("local: got %v, want ErrDialTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("gave up on the local node after %v", elapsed)
+	}
+	if d.nodes["local"].healthy || !d.nodes["remote"].healthy {
+		t.Error("the timeout did not count against the local node alone")
+	}
+
+	// without a timeout, it's waited for
+	d.SetDialTimeout(0)
+	if err := open("local"); err != nil {
+		t.Errorf("local without a timeout: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// ErrNoTLSRegistrar is returned by SetNodeTLS if no TLSRegistrar has been set.
+var ErrNoTLSRegistrar = errors.New("clustersql: no TLS registrar set")
+
+// TLSRegistrar makes config known to the upstream driver under key and returns dsn
+// changed to refer to it. Upstream drivers usually keep TLS configs in a registry of
+// their own, see MySQLTLSRegistrar for the Go-MySQL driver.
+type TLSRegistrar func(dsn, key string, config *tls.Config) (string, error)
+
+// VerifyPeerCertificateFunc has the signature of tls.Config.VerifyPeerCertificate.
+type VerifyPeerCertificateFunc func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+// MySQLTLSRegistrar returns a TLSRegistrar for Go-MySQL style DSNs. Pass
+// mysql.RegisterTLSConfig as register; the key is set as the tls parameter of the DSN.
+func MySQLTLSRegistrar(register func(key string, config *tls.Config) error) TLSRegistrar {
+	return func(dsn, key string, config *tls.Config) (string, error) {
+		if err := register(key, config); err != nil {
+			return "", err
+		}
+		return setDSNParam(dsn, "tls", key), nil
+	}
+}
+
+// SetTLSRegistrar sets the TLSRegistrar used by SetNodeTLS.
+func (d *Driver) SetTLSRegistrar(r TLSRegistrar) {
+	d.mu.Lock()
+	d.tlsRegistrar = r
+	d.mu.Unlock()
+}
+
+// SetNodeTLS has the named Node connect using a copy of config, registered with the
+// upstream driver through the TLSRegistrar under a key unique to d and the node, like
+// "clustersql-<n>-<name>", where n tells Drivers apart within the process. If verify is
+// not nil, it is installed as VerifyPeerCertificate of that copy, allowing e.g. a
+// certificate SAN check that is specific to the node. config itself is not modified; a
+// nil config stands for the zero tls.Config.
+func (d *Driver) SetNodeTLS(name string, config *tls.Config, verify VerifyPeerCertificateFunc) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[name]
+	if n == nil {
+		return unknownNode(name)
+	}
+	if d.tlsRegistrar == nil {
+		return ErrNoTLSRegistrar
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if verify != nil {
+		config.VerifyPeerCertificate = verify
+	}
+	dsn, err := d.tlsRegistrar(n.DSN, d.registryKey(name), config)
+	if err != nil {
+		return err
+	}
+	n.DSN = dsn
+	return nil
+}
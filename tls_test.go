@@ -0,0 +1,135 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSetNodeTLS(t *testing.T) {
+	up := newFakeDriver()
+	d := newTestDriver(up)
+	d.AddNode("galera1", "user:pass@tcp(dbhost1:3306)/db")
+	d.AddNode("galera2", "user:pass@tcp(dbhost2:3306)/db?parseTime=true&tls=false")
+
+	if err := d.SetNodeTLS("galera1", &tls.Config{}, nil); err != ErrNoTLSRegistrar {
+		t.Errorf("expected ErrNoTLSRegistrar, got %v", err)
+	}
+
+	registered := map[string]*tls.Config{}
+	d.SetTLSRegistrar(MySQLTLSRegistrar(func(key string, config *tls.Config) error {
+		registered[key] = config
+		return nil
+	}))
+
+	base := &tls.Config{ServerName: "galera"}
+	var verified []string
+	verifier := func(name string) VerifyPeerCertificateFunc {
+		return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			verified = append(verified, name)
+			return nil
+		}
+	}
+	for _, name := range []string{"galera1", "galera2"} {
+		if err := d.SetNodeTLS(name, base, verifier(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if base.VerifyPeerCertificate != nil {
+		t.Error("SetNodeTLS modified the passed config")
+	}
+	for _, name := range []string{"galera1", "galera2"} {
+		cfg := registered[d.registryKey(name)]
+		if cfg == nil {
+			t.Fatalf("no tls config registered for %s", name)
+		}
+		if cfg.ServerName != "galera" {
+			t.Errorf("%s: tls config not based on the passed one", name)
+		}
+		verified = nil
+		cfg.VerifyPeerCertificate(nil, nil)
+		if len(verified) != 1 || verified[0] != name {
+			t.Errorf("%s: VerifyPeerCertificate called node callback(s) %v", name, verified)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"galera1": "user:pass@tcp(dbhost1:3306)/db?tls=" + d.registryKey("galera1"),
+		"galera2": "user:pass@tcp(dbhost2:3306)/db?parseTime=true&tls=" + d.registryKey("galera2"),
+	} {
+		if got := d.nodes[name].DSN; got != want {
+			t.Errorf("%s: DSN = %q, want %q", name, got, want)
+		}
+	}
+
+	if err := d.SetNodeTLS("nope", base, nil); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("expected ErrUnknownNode, got %v", err)
+	}
+
+	// a nil config stands for the zero one
+	if err := d.SetNodeTLS("galera1", nil, verifier("galera1")); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := registered[d.registryKey("galera1")]; cfg == nil || cfg.VerifyPeerCertificate == nil || cfg.ServerName != "" {
+		t.Errorf("nil config registered as %+v", cfg)
+	}
+}
+
+func TestSetNodeTLSTwoDrivers(t *testing.T) {
+	// the registry of the upstream driver is shared by all Drivers in the process
+	registered := map[string]*tls.Config{}
+	register := MySQLTLSRegistrar(func(key string, config *tls.Config) error {
+		registered[key] = config
+		return nil
+	})
+	var drivers []*Driver
+	for _, server := range []string{"one", "two"} {
+		d := NewPrivateDriver(newFakeDriver())
+		d.AddNode("galera1", "user:pass@tcp(dbhost1:3306)/db")
+		d.SetTLSRegistrar(register)
+		if err := d.SetNodeTLS("galera1", &tls.Config{ServerName: server}, nil); err != nil {
+			t.Fatal(err)
+		}
+		drivers = append(drivers, d)
+	}
+	if len(registered) != 2 {
+		t.Fatalf("%d configs registered, want 2", len(registered))
+	}
+	for i, server := range []string{"one", "two"} {
+		d := drivers[i]
+		key := d.registryKey("galera1")
+		if cfg := registered[key]; cfg == nil || cfg.ServerName != server {
+			t.Errorf("driver %d: registered config %+v, want ServerName %q", i, cfg, server)
+		}
+		if dsn := d.nodes["galera1"].DSN; !strings.HasSuffix(dsn, "?tls="+key) {
+			t.Errorf("driver %d: DSN %q does not refer to %q", i, dsn, key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 by tkr@ecix.net (Peering GmbH)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package clustersql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+)
+
+// ErrNodeReadOnly is returned in read/write split mode if the only nodes taking writes
+// that could be opened turned out to be read-only, see SetWritableCheck.
+var ErrNodeReadOnly = errors.New("clustersql: node is read-only")
+
+// readOnlyQuery is run by the writable check.
+const readOnlyQuery = "SELECT @@read_only"
+
+// SetWritableCheck makes the Driver verify that a node is writable before handing out a
+// connection for writes in read/write split mode: after dialing, SELECT @@read_only is
+// run on the connection, and isReadOnly tells from the rows whether the node is read-only,
+// e.g. a freshly promoted replica still running with read_only=ON. Such a connection is
+// closed, and the next node taking writes is tried. nil, the default, turns checking off.
+//
+// Being read-only does not make a node unhealthy, as it still serves reads; it is counted
+// as ReadOnlyRejections in its expvar map. Errors of the check count as errors of the node.
+func (d *Driver) SetWritableCheck(isReadOnly func(rows driver.Rows) (bool, error)) {
+	d.mu.Lock()
+	d.isReadOnly = isReadOnly
+	d.mu.Unlock()
+}
+
+// checkWritable returns nil if conn, a fresh connection to n, can be used for ctx as far
+// as writes are concerned.
+func (d *Driver) checkWritable(ctx context.Context, n *node, conn driver.Conn) error {
+	if _, ok := ctx.Value(writeIntentCtx).(bool); !ok {
+		return nil
+	}
+	d.mu.Lock()
+	isReadOnly := d.isReadOnly
+	d.mu.Unlock()
+	if isReadOnly == nil {
+		return nil
+	}
+	var readOnly bool
+	err := queryConn(ctx, conn, readOnlyQuery, nil, func(rows driver.Rows) (err error) {
+		readOnly, err = isReadOnly(rows)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if readOnly {
+		d.count(n, "ReadOnlyRejections")
+		return ErrNodeReadOnly
+	}
+	return nil
+}